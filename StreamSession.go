@@ -19,6 +19,17 @@ type EnCoder interface {
 	EnCode(o interface{}, b *buffer.Buffer) error
 }
 
+/*
+ *  EnCoder的扩展。EnCodeBuffers将o编码为若干个字节切片追加到bufs之后返回,
+ *  切片可以直接引用o内部的内存而不拷贝,在消息写入完成之前不能被修改。
+ *  StreamSocket的发送线程优先使用EnCodeBuffers,以writev一次写入多个切片。
+ *  aio会话及WebSocket只使用EnCode
+ */
+type BuffersEnCoder interface {
+	EnCoder
+	EnCodeBuffers(o interface{}, bufs net.Buffers) (net.Buffers, error)
+}
+
 type StreamSession interface {
 
 	/*
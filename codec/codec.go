@@ -0,0 +1,387 @@
+/*
+*  长度前缀分帧编解码器
+*
+*  帧格式: | 长度头 | payload |
+*  长度头宽度可为1/2/4/8字节或varint,字节序可配置,
+*  HeaderIncluded为true时长度字段的值包含长度头自身。
+*
+*  Receiver同时实现了socket.StreamSocketInBoundProcessor与aio.AioInBoundProcessor,
+*  可直接用于socket.StreamSocket和socket/aio.Socket。
+ */
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/buffer"
+	"math"
+)
+
+const (
+	HeaderVarint = -1 //varint编码的长度头
+)
+
+const (
+	defaultMaxFrameSize = 65535
+	initBuffSize        = 4096
+)
+
+var (
+	ErrInvaildHeaderSize = errors.New("codec: invaild header size")
+	ErrFrameTooLarge     = errors.New("codec: frame too large")
+	ErrInvaildFrame      = errors.New("codec: invaild frame")
+	ErrUnsupportedObject = errors.New("codec: unsupported object")
+)
+
+type Option struct {
+	HeaderSize     int  //长度头宽度:1,2,4,8或HeaderVarint,默认4
+	LittleEndian   bool //默认大端
+	MaxFrameSize   int  //payload最大字节数,默认65535
+	HeaderIncluded bool //长度字段的值是否包含长度头自身,HeaderVarint不支持该选项
+}
+
+func (this *Option) check() error {
+	if this.HeaderSize == 0 {
+		this.HeaderSize = 4
+	}
+
+	switch this.HeaderSize {
+	case 1, 2, 4, 8:
+	case HeaderVarint:
+		if this.HeaderIncluded {
+			return ErrInvaildHeaderSize
+		}
+	default:
+		return ErrInvaildHeaderSize
+	}
+
+	//长度头所能表示的最大payload
+	limit := this.maxLength()
+	if this.HeaderIncluded {
+		limit -= uint64(this.HeaderSize)
+	}
+
+	if this.MaxFrameSize <= 0 {
+		this.MaxFrameSize = defaultMaxFrameSize
+		if uint64(this.MaxFrameSize) > limit {
+			this.MaxFrameSize = int(limit)
+		}
+	} else if uint64(this.MaxFrameSize) > limit {
+		return fmt.Errorf("codec: MaxFrameSize:%d exceed header limit:%d", this.MaxFrameSize, limit)
+	}
+
+	return nil
+}
+
+//长度字段能表示的最大值
+func (this *Option) maxLength() uint64 {
+	switch this.HeaderSize {
+	case 1:
+		return math.MaxUint8
+	case 2:
+		return math.MaxUint16
+	case 4:
+		return math.MaxUint32
+	default:
+		return math.MaxUint64
+	}
+}
+
+//固定头部的长度,varint返回0
+func (this *Option) headerLen() int {
+	if this.HeaderSize == HeaderVarint {
+		return 0
+	} else {
+		return this.HeaderSize
+	}
+}
+
+func (this *Option) byteOrder() binary.ByteOrder {
+	if this.LittleEndian {
+		return binary.LittleEndian
+	} else {
+		return binary.BigEndian
+	}
+}
+
+/*
+ *  Decoder用于将一帧的payload转换成对象,payload在Decode返回后将被复用,Decode不应持有它
+ */
+type Decoder interface {
+	Decode([]byte) (interface{}, error)
+}
+
+type Encoder struct {
+	option Option
+	inner  kendynet.EnCoder
+}
+
+/*
+ *  inner不为nil时,对象先由inner编码成payload再添加长度头,
+ *  否则只支持[]byte,string和*buffer.Buffer
+ *  注意:StreamSession.Send([]byte)会直接发送原始字节而不经过encoder
+ */
+func NewEncoder(option Option, inner ...kendynet.EnCoder) (*Encoder, error) {
+	if err := option.check(); nil != err {
+		return nil, err
+	}
+	e := &Encoder{option: option}
+	if len(inner) > 0 {
+		e.inner = inner[0]
+	}
+	return e, nil
+}
+
+func (this *Encoder) putHeader(bs []byte, l uint64) {
+	switch this.option.HeaderSize {
+	case 1:
+		bs[0] = byte(l)
+	case 2:
+		this.option.byteOrder().PutUint16(bs, uint16(l))
+	case 4:
+		this.option.byteOrder().PutUint32(bs, uint32(l))
+	case 8:
+		this.option.byteOrder().PutUint64(bs, l)
+	}
+}
+
+func (this *Encoder) EnCode(o interface{}, b *buffer.Buffer) error {
+	if nil == b {
+		return errors.New("b == nil")
+	}
+
+	if this.option.HeaderSize == HeaderVarint {
+		return this.encodeVarint(o, b)
+	}
+
+	begin := b.Len()
+	headerLen := this.option.headerLen()
+	var header [8]byte
+	b.AppendBytes(header[:headerLen])
+
+	if err := this.appendPayload(o, b); nil != err {
+		b.SetLen(begin)
+		return err
+	}
+
+	payloadLen := b.Len() - begin - headerLen
+	if payloadLen > this.option.MaxFrameSize {
+		b.SetLen(begin)
+		return ErrFrameTooLarge
+	}
+
+	l := uint64(payloadLen)
+	if this.option.HeaderIncluded {
+		l += uint64(headerLen)
+	}
+
+	this.putHeader(b.Bytes()[begin:begin+headerLen], l)
+
+	return nil
+}
+
+func (this *Encoder) encodeVarint(o interface{}, b *buffer.Buffer) error {
+	payload := buffer.Get()
+	defer payload.Free()
+
+	if err := this.appendPayload(o, payload); nil != err {
+		return err
+	}
+
+	if payload.Len() > this.option.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	var header [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(payload.Len()))
+	b.AppendBytes(header[:n])
+	b.AppendBytes(payload.Bytes())
+	return nil
+}
+
+func (this *Encoder) appendPayload(o interface{}, b *buffer.Buffer) error {
+	if nil != this.inner {
+		return this.inner.EnCode(o, b)
+	}
+
+	switch o.(type) {
+	case []byte:
+		b.AppendBytes(o.([]byte))
+	case string:
+		b.AppendString(o.(string))
+	case *buffer.Buffer:
+		b.AppendBytes(o.(*buffer.Buffer).Bytes())
+	default:
+		return ErrUnsupportedObject
+	}
+	return nil
+}
+
+func isPow2(size int) bool {
+	return (size & (size - 1)) == 0
+}
+
+func sizeofPow2(size int) int {
+	if isPow2(size) {
+		return size
+	}
+	size = size - 1
+	size = size | (size >> 1)
+	size = size | (size >> 2)
+	size = size | (size >> 4)
+	size = size | (size >> 8)
+	size = size | (size >> 16)
+	return size + 1
+}
+
+type Receiver struct {
+	option  Option
+	decoder Decoder
+	buffer  []byte
+	w       int
+	r       int
+}
+
+/*
+ *  decoder为nil时Unpack返回payload的拷贝([]byte)
+ */
+func NewReceiver(option Option, decoder ...Decoder) (*Receiver, error) {
+	if err := option.check(); nil != err {
+		return nil, err
+	}
+	r := &Receiver{
+		option: option,
+		buffer: make([]byte, initBuffSize),
+	}
+	if len(decoder) > 0 {
+		r.decoder = decoder[0]
+	}
+	return r, nil
+}
+
+func (this *Receiver) GetRecvBuff() []byte {
+	if this.w == len(this.buffer) {
+		//缓冲已满但仍不足以解出一个包(只有在头部尚未完整时才会出现)
+		this.compact(len(this.buffer) * 2)
+	}
+	return this.buffer[this.w:]
+}
+
+func (this *Receiver) OnData(data []byte) {
+	this.w += len(data)
+}
+
+func (this *Receiver) OnSocketClose() {
+
+}
+
+//将未处理的数据移动到缓冲头部,如有必要扩展缓冲
+func (this *Receiver) compact(need int) {
+	if need > len(this.buffer) {
+		buffer := make([]byte, sizeofPow2(need))
+		copy(buffer, this.buffer[this.r:this.w])
+		this.buffer = buffer
+	} else {
+		copy(this.buffer, this.buffer[this.r:this.w])
+	}
+	this.w = this.w - this.r
+	this.r = 0
+}
+
+/*
+ *  解析长度头,返回头部长度与payload长度,头部不完整时headerLen返回0
+ */
+func (this *Receiver) parseHeader(bs []byte) (headerLen int, payloadLen uint64, err error) {
+	if this.option.HeaderSize == HeaderVarint {
+		l, n := binary.Uvarint(bs)
+		if n == 0 {
+			if len(bs) >= binary.MaxVarintLen64 {
+				err = ErrInvaildFrame
+			}
+			return
+		} else if n < 0 {
+			err = ErrInvaildFrame
+			return
+		}
+		return n, l, nil
+	}
+
+	headerLen = this.option.HeaderSize
+	if len(bs) < headerLen {
+		return 0, 0, nil
+	}
+
+	switch headerLen {
+	case 1:
+		payloadLen = uint64(bs[0])
+	case 2:
+		payloadLen = uint64(this.option.byteOrder().Uint16(bs))
+	case 4:
+		payloadLen = uint64(this.option.byteOrder().Uint32(bs))
+	case 8:
+		payloadLen = this.option.byteOrder().Uint64(bs)
+	}
+
+	if this.option.HeaderIncluded {
+		if payloadLen < uint64(headerLen) {
+			return 0, 0, ErrInvaildFrame
+		}
+		payloadLen -= uint64(headerLen)
+	}
+
+	return
+}
+
+func (this *Receiver) Unpack() (interface{}, error) {
+	if this.r == this.w {
+		return nil, nil
+	}
+
+	headerLen, payloadLen, err := this.parseHeader(this.buffer[this.r:this.w])
+	if nil != err {
+		return nil, err
+	} else if headerLen == 0 {
+		if this.r > 0 {
+			this.compact(0)
+		}
+		return nil, nil
+	} else if payloadLen > uint64(this.option.MaxFrameSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	frameSize := headerLen + int(payloadLen)
+
+	if frameSize > this.w-this.r {
+		//数据不足一帧,确保剩余空间可以容纳整帧
+		if frameSize > len(this.buffer)-this.r {
+			this.compact(frameSize)
+		}
+		return nil, nil
+	}
+
+	payload := this.buffer[this.r+headerLen : this.r+frameSize]
+
+	var msg interface{}
+
+	if nil != this.decoder {
+		msg, err = this.decoder.Decode(payload)
+	} else {
+		o := make([]byte, 0, len(payload))
+		msg = append(o, payload...)
+	}
+
+	this.r += frameSize
+	if this.r == this.w {
+		this.r = 0
+		this.w = 0
+	}
+
+	if nil == err && nil == msg {
+		err = ErrInvaildFrame
+	}
+
+	return msg, err
+}
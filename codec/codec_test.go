@@ -0,0 +1,112 @@
+package codec
+
+//go test -covermode=count -v -coverprofile=coverage.out -run=.
+//go tool cover -html=coverage.out
+
+import (
+	"github.com/sniperHW/kendynet/buffer"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+//每次最多向Receiver写入n字节,模拟分段到达
+func feed(r *Receiver, data []byte, n int) (msgs []interface{}, err error) {
+	for len(data) > 0 {
+		buff := r.GetRecvBuff()
+		l := n
+		if l > len(buff) {
+			l = len(buff)
+		}
+		if l > len(data) {
+			l = len(data)
+		}
+		copy(buff, data[:l])
+		r.OnData(buff[:l])
+		data = data[l:]
+		for {
+			var msg interface{}
+			msg, err = r.Unpack()
+			if nil != err {
+				return
+			} else if nil == msg {
+				break
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return
+}
+
+func TestCodec(t *testing.T) {
+	options := []Option{
+		{HeaderSize: 1},
+		{HeaderSize: 2, LittleEndian: true},
+		{HeaderSize: 4},
+		{HeaderSize: 4, HeaderIncluded: true},
+		{HeaderSize: 8, LittleEndian: true, HeaderIncluded: true},
+		{HeaderSize: HeaderVarint, MaxFrameSize: 100000},
+	}
+
+	for _, o := range options {
+		e, err := NewEncoder(o)
+		assert.Nil(t, err)
+		r, err := NewReceiver(o)
+		assert.Nil(t, err)
+
+		payloads := []string{"hello", "", strings.Repeat("a", 200), "world"}
+		if o.HeaderSize != 1 {
+			payloads = append(payloads, strings.Repeat("b", 10000))
+		}
+
+		b := buffer.New()
+		for _, v := range payloads {
+			assert.Nil(t, e.EnCode(v, b))
+		}
+
+		msgs, err := feed(r, b.Bytes(), 7)
+		assert.Nil(t, err)
+		assert.Equal(t, len(payloads), len(msgs))
+		for i, v := range payloads {
+			assert.Equal(t, v, string(msgs[i].([]byte)))
+		}
+	}
+
+	{
+		_, err := NewEncoder(Option{HeaderSize: 3})
+		assert.Equal(t, ErrInvaildHeaderSize, err)
+
+		_, err = NewEncoder(Option{HeaderSize: HeaderVarint, HeaderIncluded: true})
+		assert.Equal(t, ErrInvaildHeaderSize, err)
+
+		_, err = NewEncoder(Option{HeaderSize: 1, MaxFrameSize: 1000})
+		assert.NotNil(t, err)
+
+		e, err := NewEncoder(Option{})
+		assert.Nil(t, err)
+		assert.Equal(t, ErrUnsupportedObject, e.EnCode(1, buffer.New()))
+	}
+
+	{
+		//超过最大帧
+		e, _ := NewEncoder(Option{HeaderSize: 2})
+		b := buffer.New()
+		assert.Nil(t, e.EnCode(strings.Repeat("a", 100), b))
+
+		small, _ := NewEncoder(Option{HeaderSize: 2, MaxFrameSize: 10})
+		l := b.Len()
+		assert.Equal(t, ErrFrameTooLarge, small.EnCode(strings.Repeat("a", 100), b))
+		assert.Equal(t, l, b.Len())
+
+		r, _ := NewReceiver(Option{HeaderSize: 2, MaxFrameSize: 10})
+		_, err := feed(r, b.Bytes(), 1024)
+		assert.Equal(t, ErrFrameTooLarge, err)
+	}
+
+	{
+		//HeaderIncluded时长度小于头部
+		r, _ := NewReceiver(Option{HeaderSize: 4, HeaderIncluded: true})
+		_, err := feed(r, []byte{0, 0, 0, 1}, 1024)
+		assert.Equal(t, ErrInvaildFrame, err)
+	}
+}
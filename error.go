@@ -20,6 +20,12 @@ var (
 	ErrInvaildObject       = fmt.Errorf("object == nil")
 	ErrInvaildEncoder      = fmt.Errorf("encoder == nil")
 	ErrNotStart            = fmt.Errorf("not start yet")
+	ErrInvaildTLSConfig    = fmt.Errorf("tls config == nil")
+	ErrDisconnected        = fmt.Errorf("disconnected")
+	ErrHeartbeatTimeout    = fmt.Errorf("heartbeat timeout")
+	ErrServerShutdown      = fmt.Errorf("server shutdown")
+	ErrSlowConsumer        = fmt.Errorf("slow consumer")
+	ErrSendDropped         = fmt.Errorf("dropped by send queue")
 )
 
 func IsNetTimeout(err error) bool {
@@ -14,7 +14,6 @@ import (
 	"reflect"
 	"runtime"
 	"time"
-	"unsafe"
 )
 
 var aioService *aio.SocketService = aio.NewSocketService(aio.ServiceOption{
@@ -26,37 +25,6 @@ var aioService *aio.SocketService = aio.NewSocketService(aio.ServiceOption{
 	CompleteRoutinePerPoller: runtime.NumCPU(),
 })
 
-type TcpStreamChannel struct {
-	session kendynet.StreamSession
-	name    string
-}
-
-func NewTcpStreamChannel(sess kendynet.StreamSession) *TcpStreamChannel {
-	r := &TcpStreamChannel{session: sess}
-	r.name = sess.RemoteAddr().String() + "<->" + sess.LocalAddr().String()
-	return r
-}
-
-func (this *TcpStreamChannel) SendRequest(message interface{}) error {
-	return this.session.Send(message)
-}
-
-func (this *TcpStreamChannel) SendResponse(message interface{}) error {
-	return this.session.Send(message)
-}
-
-func (this *TcpStreamChannel) Name() string {
-	return this.name
-}
-
-func (this *TcpStreamChannel) UID() uint64 {
-	return uint64(uintptr(unsafe.Pointer(this)))
-}
-
-func (this *TcpStreamChannel) GetSession() kendynet.StreamSession {
-	return this.session
-}
-
 type TestEncoder struct {
 }
 
@@ -81,7 +49,7 @@ func (this *TestEncoder) Encode(message rpc.RPCMessage) (interface{}, error) {
 		resp := message.(*rpc.RPCResponse)
 		response := &testproto.RPCResponse{Seq: proto.Uint64(resp.Seq)}
 		if resp.Err != nil {
-			response.Err = proto.String(resp.Err.Error())
+			response.Err = proto.String(string(rpc.EncodeError(resp.Err)))
 		}
 		if resp.Ret != nil {
 			b, err := pb.Encode(resp.Ret, nil, 1000)
@@ -120,7 +88,7 @@ func (this *TestDecoder) Decode(o interface{}) (rpc.RPCMessage, error) {
 		resp := o.(*testproto.RPCResponse)
 		response := &rpc.RPCResponse{Seq: resp.GetSeq()}
 		if resp.Err != nil {
-			response.Err = fmt.Errorf(resp.GetErr())
+			response.Err = rpc.DecodeError([]byte(resp.GetErr()))
 		}
 		if len(resp.Ret) > 0 {
 			var err error
@@ -158,13 +126,11 @@ func (this *RPCServer) Serve(service string) error {
 	}
 
 	err = this.listener.Serve(func(session kendynet.StreamSession) {
-		channel := NewTcpStreamChannel(session)
 		session.SetEncoder(codec.NewPbEncoder(65535))
 		session.SetInBoundProcessor(codec.NewPBReceiver(65535))
 		session.SetRecvTimeout(5 * time.Second)
-		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
-			this.server.OnRPCMessage(channel, msg)
-		})
+		channel, _ := rpc.NewSessionChannel(session, this.server, nil)
+		channel.BeginRecv()
 	})
 	return err
 }
@@ -186,21 +152,24 @@ func (this *Caller) Dial(service string, timeout time.Duration) error {
 	if err != nil {
 		return err
 	}
-	this.channel = NewTcpStreamChannel(session)
 	this.client = client //rpc.NewClient(&TestDecoder{}, &TestEncoder{})
 	session.SetEncoder(codec.NewPbEncoder(65535))
 	session.SetInBoundProcessor(codec.NewPBReceiver(65535))
 
 	session.SetRecvTimeout(5 * time.Second)
-	session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+
+	channel, err := rpc.NewSessionChannel(session, nil, this.client)
+	if err != nil {
+		return err
+	}
+
+	channel.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
 		fmt.Println("channel close:", reason)
 	})
 
-	session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
-		this.client.OnRPCMessage(msg)
-	})
+	this.channel = channel
 
-	return nil
+	return channel.BeginRecv()
 }
 
 func (this *Caller) AsynCall(method string, arg interface{}, timeout time.Duration, cb rpc.RPCResponseHandler) {
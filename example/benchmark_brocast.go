@@ -4,12 +4,12 @@ import (
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/sniperHW/kendynet"
-	"github.com/sniperHW/kendynet/event"
 	codec "github.com/sniperHW/kendynet/example/codec"
 	"github.com/sniperHW/kendynet/example/pb"
 	"github.com/sniperHW/kendynet/example/testproto"
 	connector "github.com/sniperHW/kendynet/socket/connector/tcp"
 	listener "github.com/sniperHW/kendynet/socket/listener/tcp"
+	"github.com/sniperHW/kendynet/socket/manager"
 	"github.com/sniperHW/kendynet/timer"
 	"net/http"
 	_ "net/http/pprof"
@@ -20,61 +20,36 @@ import (
 )
 
 /*
-*  使用event_queue把多线程事件转换为单线程处理
+*  使用manager管理会话,广播时编码一次,所有会话共享编码后的包
  */
 
 func server(service string) {
-	clientcount := int32(0)
 	packetcount := int32(0)
 
-	//clientMap只被单个goroutine访问，不需要任何保护
-	clientMap := make(map[kendynet.StreamSession]bool)
+	sessions := manager.New(codec.NewPbEncoder(4096))
 
 	timer.Repeat(time.Second, func(_ *timer.Timer, ctx interface{}) {
 		tmp := atomic.LoadInt32(&packetcount)
 		atomic.StoreInt32(&packetcount, 0)
-		fmt.Printf("clientcount:%d,packetcount:%d\n", clientcount, tmp)
+		fmt.Printf("clientcount:%d,packetcount:%d\n", sessions.Len(), tmp)
 	}, nil)
 
-	evQueue := event.NewEventQueue()
-
-	encoder := codec.NewPbEncoder(4096)
-
 	server, err := listener.New("tcp4", service)
 	if server != nil {
-		go func() {
-			fmt.Printf("server running on:%s\n", service)
-			err = server.Serve(func(session kendynet.StreamSession) {
-				session.SetEncoder(codec.NewPbEncoder(4096))
-				session.SetInBoundProcessor(codec.NewPBReceiver(4096))
-				session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
-					evQueue.PostNoWait(0, func() {
-						atomic.AddInt32(&clientcount, -1)
-						delete(clientMap, session)
-					})
-				})
-				session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
-					evQueue.PostNoWait(0, func() {
-						//广播，编码一次，直接发送编码后的包，省得每次发送单独编码一次
-						resp, _ := encoder.EnCode(msg.(proto.Message))
-						atomic.AddInt32(&packetcount, int32(len(clientMap)))
-						for s, _ := range clientMap {
-							s.SendMessage(resp)
-						}
-					})
-				})
-				evQueue.PostNoWait(0, func() {
-					atomic.AddInt32(&clientcount, 1)
-					clientMap[session] = true
-				})
+		fmt.Printf("server running on:%s\n", service)
+		err = server.Serve(func(session kendynet.StreamSession) {
+			session.SetEncoder(codec.NewPbEncoder(4096))
+			session.SetInBoundProcessor(codec.NewPBReceiver(4096))
+			sessions.Add(session)
+			session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+				n, _ := sessions.Broadcast(msg)
+				atomic.AddInt32(&packetcount, int32(n))
 			})
+		})
 
-			if nil != err {
-				fmt.Printf("TcpServer start failed %s\n", err)
-			}
-		}()
-
-		evQueue.Run()
+		if nil != err {
+			fmt.Printf("TcpServer start failed %s\n", err)
+		}
 
 	} else {
 		fmt.Printf("NewTcpServer failed %s\n", err)
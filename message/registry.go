@@ -0,0 +1,150 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sniperHW/kendynet/buffer"
+	"github.com/sniperHW/kendynet/codec"
+	"reflect"
+	"sync"
+)
+
+const idSize = 4
+
+var ErrInvaildSerializer = errors.New("serializer == nil")
+
+/*
+ *  Registry维护消息ID与Go类型的映射,每个实例拥有独立的ID空间
+ *
+ *  编码格式: | 消息ID(uint32) | 序列化后的消息 |
+ *
+ *  Registry本身实现了kendynet.EnCoder与codec.Decoder,
+ *  通常配合codec包的长度前缀分帧使用(见NewEncoder,NewReceiver)
+ */
+type Registry struct {
+	mu         sync.RWMutex
+	serializer Serializer
+	typeToID   map[reflect.Type]uint32
+	idToType   map[uint32]reflect.Type
+}
+
+func NewRegistry(serializer Serializer) *Registry {
+	if nil == serializer {
+		return nil
+	}
+	return &Registry{
+		serializer: serializer,
+		typeToID:   map[reflect.Type]uint32{},
+		idToType:   map[uint32]reflect.Type{},
+	}
+}
+
+/*
+ *  注册消息类型,msg必须是指针,例如Register(&testproto.Hello{}, 1)
+ */
+func (this *Registry) Register(msg interface{}, id uint32) error {
+	if nil == msg {
+		return errors.New("msg == nil")
+	}
+
+	tt := reflect.TypeOf(msg)
+	if tt.Kind() != reflect.Ptr {
+		return fmt.Errorf("%s is not a pointer", tt.String())
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.idToType[id]; ok {
+		return fmt.Errorf("duplicate id:%d", id)
+	}
+
+	if _, ok := this.typeToID[tt]; ok {
+		return fmt.Errorf("%s already register", tt.String())
+	}
+
+	this.typeToID[tt] = id
+	this.idToType[id] = tt.Elem()
+	return nil
+}
+
+func (this *Registry) GetID(msg interface{}) (uint32, error) {
+	tt := reflect.TypeOf(msg)
+	this.mu.RLock()
+	id, ok := this.typeToID[tt]
+	this.mu.RUnlock()
+	if !ok {
+		if nil == tt {
+			return 0, errors.New("msg == nil")
+		}
+		return 0, fmt.Errorf("unregister type:%s", tt.String())
+	}
+	return id, nil
+}
+
+//根据ID创建一个新的消息实例
+func (this *Registry) New(id uint32) (interface{}, error) {
+	this.mu.RLock()
+	tt, ok := this.idToType[id]
+	this.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unregister id:%d", id)
+	}
+	return reflect.New(tt).Interface(), nil
+}
+
+//implement kendynet.EnCoder
+func (this *Registry) EnCode(o interface{}, b *buffer.Buffer) error {
+	if nil == b {
+		return errors.New("b == nil")
+	}
+
+	id, err := this.GetID(o)
+	if nil != err {
+		return err
+	}
+
+	data, err := this.serializer.Marshal(o)
+	if nil != err {
+		return err
+	}
+
+	b.AppendUint32(id)
+	b.AppendBytes(data)
+	return nil
+}
+
+//implement codec.Decoder
+func (this *Registry) Decode(data []byte) (interface{}, error) {
+	if len(data) < idSize {
+		return nil, fmt.Errorf("invaild message size:%d", len(data))
+	}
+
+	reader := buffer.NewReader(data)
+	id := reader.GetUint32()
+
+	msg, err := this.New(id)
+	if nil != err {
+		return nil, err
+	}
+
+	if err = this.serializer.Unmarshal(reader.GetAll(), msg); nil != err {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+/*
+ *  返回添加了长度头的编码器,可直接用于StreamSession.SetEncoder
+ */
+func (this *Registry) NewEncoder(option codec.Option) (*codec.Encoder, error) {
+	return codec.NewEncoder(option, this)
+}
+
+/*
+ *  返回解出已注册类型消息的inbound processor,可直接用于StreamSession.SetInBoundProcessor
+ */
+func (this *Registry) NewReceiver(option codec.Option) (*codec.Receiver, error) {
+	return codec.NewReceiver(option, this)
+}
@@ -0,0 +1,105 @@
+package message
+
+//go test -covermode=count -v -coverprofile=coverage.out -run=.
+//go tool cover -html=coverage.out
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/sniperHW/kendynet/buffer"
+	"github.com/sniperHW/kendynet/codec"
+	"github.com/sniperHW/kendynet/example/testproto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type Login struct {
+	User  string
+	Token []byte
+}
+
+type Logout struct {
+	User string
+}
+
+func unpackAll(t *testing.T, r *codec.Receiver, data []byte) (msgs []interface{}) {
+	buff := r.GetRecvBuff()
+	assert.True(t, len(buff) >= len(data))
+	copy(buff, data)
+	r.OnData(buff[:len(data)])
+	for {
+		msg, err := r.Unpack()
+		assert.Nil(t, err)
+		if nil == msg {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	assert.Nil(t, NewRegistry(nil))
+
+	r := NewRegistry(PBSerializer{})
+	assert.Nil(t, r.Register(&testproto.Hello{}, 1))
+	assert.Nil(t, r.Register(&testproto.World{}, 2))
+	assert.NotNil(t, r.Register(&testproto.Hello{}, 3))
+	assert.NotNil(t, r.Register(&testproto.Test{}, 2))
+	assert.NotNil(t, r.Register(testproto.Test{}, 4))
+	assert.NotNil(t, r.Register(nil, 4))
+
+	id, err := r.GetID(&testproto.World{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), id)
+
+	_, err = r.GetID(&testproto.Test{})
+	assert.NotNil(t, err)
+
+	_, err = r.New(100)
+	assert.NotNil(t, err)
+
+	//另一个Registry使用独立的ID空间
+	r2 := NewRegistry(PBSerializer{})
+	assert.Nil(t, r2.Register(&testproto.World{}, 1))
+
+	b := buffer.New()
+	assert.Nil(t, r.EnCode(&testproto.World{World: proto.String("world")}, b))
+	msg, err := r.Decode(b.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, "world", msg.(*testproto.World).GetWorld())
+
+	_, err = r2.Decode(b.Bytes())
+	assert.NotNil(t, err)
+
+	_, err = r.Decode([]byte{0, 0})
+	assert.NotNil(t, err)
+
+	assert.NotNil(t, r.EnCode(&testproto.Test{}, b))
+}
+
+func TestSerializer(t *testing.T) {
+	for _, s := range []Serializer{JSONSerializer{}, GobSerializer{}} {
+		r := NewRegistry(s)
+		assert.Nil(t, r.Register(&Login{}, 1))
+		assert.Nil(t, r.Register(&Logout{}, 2))
+
+		e, err := r.NewEncoder(codec.Option{HeaderSize: 2})
+		assert.Nil(t, err)
+		receiver, err := r.NewReceiver(codec.Option{HeaderSize: 2})
+		assert.Nil(t, err)
+
+		b := buffer.New()
+		assert.Nil(t, e.EnCode(&Login{User: "sniperHW", Token: []byte("token")}, b))
+		assert.Nil(t, e.EnCode(&Logout{User: "sniperHW"}, b))
+
+		msgs := unpackAll(t, receiver, b.Bytes())
+		assert.Equal(t, 2, len(msgs))
+		assert.Equal(t, &Login{User: "sniperHW", Token: []byte("token")}, msgs[0])
+		assert.Equal(t, &Logout{User: "sniperHW"}, msgs[1])
+	}
+
+	{
+		r := NewRegistry(PBSerializer{})
+		assert.Nil(t, r.Register(&Login{}, 1))
+		assert.NotNil(t, r.EnCode(&Login{}, buffer.New()))
+	}
+}
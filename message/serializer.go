@@ -0,0 +1,72 @@
+package message
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+)
+
+/*
+ *  消息序列化器,Unmarshal的o为Registry.New创建的指针
+ *
+ *  msgpack等第三方格式只需实现该接口,例如:
+ *
+ *  type MsgpackSerializer struct{}
+ *  func (MsgpackSerializer) Marshal(o interface{}) ([]byte, error)      { return msgpack.Marshal(o) }
+ *  func (MsgpackSerializer) Unmarshal(data []byte, o interface{}) error { return msgpack.Unmarshal(data, o) }
+ */
+type Serializer interface {
+	Marshal(o interface{}) ([]byte, error)
+	Unmarshal(data []byte, o interface{}) error
+}
+
+type PBSerializer struct {
+}
+
+func (this PBSerializer) Marshal(o interface{}) ([]byte, error) {
+	if msg, ok := o.(proto.Message); ok {
+		return proto.Marshal(msg)
+	} else {
+		return nil, fmt.Errorf("%s is not a proto.Message", reflect.TypeOf(o).String())
+	}
+}
+
+func (this PBSerializer) Unmarshal(data []byte, o interface{}) error {
+	if msg, ok := o.(proto.Message); ok {
+		return proto.Unmarshal(data, msg)
+	} else {
+		return fmt.Errorf("%s is not a proto.Message", reflect.TypeOf(o).String())
+	}
+}
+
+type JSONSerializer struct {
+}
+
+func (this JSONSerializer) Marshal(o interface{}) ([]byte, error) {
+	return json.Marshal(o)
+}
+
+func (this JSONSerializer) Unmarshal(data []byte, o interface{}) error {
+	return json.Unmarshal(data, o)
+}
+
+/*
+ *  每条消息独立编码,包含完整的类型描述,适合低频的内部消息
+ */
+type GobSerializer struct {
+}
+
+func (this GobSerializer) Marshal(o interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(o); nil != err {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (this GobSerializer) Unmarshal(data []byte, o interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(o)
+}
@@ -1,9 +1,8 @@
 package message
 
-//import (
-//"fmt"
-//"github.com/sniperHW/kendynet"
-//)
+import (
+	"io"
+)
 
 // The message types are defined in RFC 6455, section 11.8.
 const (
@@ -57,3 +56,23 @@ func NewWSMessage(messageType int, data ...interface{}) *WSMessage {
 		return &WSMessage{messageType: messageType}
 	}
 }
+
+/*
+ *  以流的方式接收的消息,Reader只在消息回调中有效
+ */
+type WSStreamMessage struct {
+	messageType int
+	reader      io.Reader
+}
+
+func (this *WSStreamMessage) Type() int {
+	return this.messageType
+}
+
+func (this *WSStreamMessage) Reader() io.Reader {
+	return this.reader
+}
+
+func NewWSStreamMessage(messageType int, reader io.Reader) *WSStreamMessage {
+	return &WSStreamMessage{messageType: messageType, reader: reader}
+}
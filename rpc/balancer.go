@@ -0,0 +1,473 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/util"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type BalancePolicy int
+
+const (
+	RoundRobin     = BalancePolicy(0)
+	LeastPending   = BalancePolicy(1) //选择未完成调用最少的信道
+	ConsistentHash = BalancePolicy(2) //根据CallOption.HashKey选择信道,HashKey为空时退化为RoundRobin
+)
+
+const virtualNodes = 100
+
+var ErrNoAvailableChannel error = NewError(CodeUnavailable, "no available channel")
+
+/*
+ *  socket/connector/tcp及socket/connector/aio的Connector均实现了该接口
+ */
+type SessionDialer interface {
+	Dial(timeout time.Duration) (kendynet.StreamSession, error)
+}
+
+type BalancerOption struct {
+	Policy           BalancePolicy
+	DialTimeout      time.Duration                         //默认5秒
+	RetryInterval    time.Duration                         //重连的初始间隔,默认100毫秒,每次失败翻倍
+	MaxRetryInterval time.Duration                         //重连的最大间隔,默认10秒
+	MaxRetry         int                                   //幂等调用的最大重试次数,默认1
+	SetupSession     func(kendynet.StreamSession)          //连接建立后设置编码器,InBoundProcessor等,必须提供
+	Server           *RPCServer                            //可选,用于处理对端发来的请求
+	OnConnect        func(name string, channel RPCChannel) //可选
+}
+
+type CallOption struct {
+	HashKey    string //ConsistentHash策略使用
+	Idempotent bool   //幂等调用在信道断开或发送失败时换一个信道重试
+}
+
+type endpoint struct {
+	name    string
+	dialer  SessionDialer
+	channel *SessionChannel //nil表示未连接,由Balancer.mu保护
+	removed bool
+	stopC   chan struct{}
+	pending int32
+}
+
+type ringNode struct {
+	hash     uint32
+	endpoint *endpoint
+}
+
+/*
+ *  管理到同一服务的一组信道,按策略为每次调用选择信道。
+ *
+ *  信道断开后立即从可选集合中移除,并在后台以指数退避重连。
+ */
+type Balancer struct {
+	mu        sync.RWMutex
+	client    *RPCClient
+	option    BalancerOption
+	endpoints []*endpoint
+	ring      []ringNode
+	counter   uint64
+	closed    bool
+}
+
+func NewBalancer(client *RPCClient, option BalancerOption) (*Balancer, error) {
+	if nil == client {
+		return nil, errors.New("client == nil")
+	}
+
+	if nil == option.SetupSession {
+		return nil, errors.New("SetupSession == nil")
+	}
+
+	if option.DialTimeout <= 0 {
+		option.DialTimeout = time.Second * 5
+	}
+
+	if option.RetryInterval <= 0 {
+		option.RetryInterval = time.Millisecond * 100
+	}
+
+	if option.MaxRetryInterval < option.RetryInterval {
+		option.MaxRetryInterval = time.Second * 10
+		if option.MaxRetryInterval < option.RetryInterval {
+			option.MaxRetryInterval = option.RetryInterval
+		}
+	}
+
+	if option.MaxRetry <= 0 {
+		option.MaxRetry = 1
+	}
+
+	return &Balancer{
+		client: client,
+		option: option,
+	}, nil
+}
+
+/*
+ *  添加一个服务端点并在后台建立连接,name在Balancer内唯一,同时作为一致性哈希的节点标识
+ */
+func (this *Balancer) Add(name string, dialer SessionDialer) error {
+	if nil == dialer {
+		return errors.New("dialer == nil")
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return errors.New("balancer closed")
+	}
+
+	for _, v := range this.endpoints {
+		if v.name == name {
+			return fmt.Errorf("duplicate endpoint:%s", name)
+		}
+	}
+
+	ep := &endpoint{
+		name:   name,
+		dialer: dialer,
+		stopC:  make(chan struct{}),
+	}
+
+	this.endpoints = append(this.endpoints, ep)
+	this.buildRing()
+
+	go this.connect(ep)
+
+	return nil
+}
+
+/*
+ *  移除端点并关闭其连接,该连接上未完成的调用以ErrChannelDisconnected返回
+ */
+func (this *Balancer) Remove(name string) {
+	this.mu.Lock()
+	var ep *endpoint
+	for i, v := range this.endpoints {
+		if v.name == name {
+			ep = v
+			this.endpoints = append(this.endpoints[:i], this.endpoints[i+1:]...)
+			break
+		}
+	}
+
+	if nil == ep {
+		this.mu.Unlock()
+		return
+	}
+
+	ep.removed = true
+	close(ep.stopC)
+	channel := ep.channel
+	this.buildRing()
+	this.mu.Unlock()
+
+	if nil != channel {
+		channel.GetSession().Close(nil, 0)
+	}
+}
+
+func (this *Balancer) Close() {
+	this.mu.Lock()
+	this.closed = true
+	names := []string{}
+	for _, v := range this.endpoints {
+		names = append(names, v.name)
+	}
+	this.mu.Unlock()
+
+	for _, v := range names {
+		this.Remove(v)
+	}
+}
+
+//已连接的信道数量
+func (this *Balancer) Available() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	c := 0
+	for _, v := range this.endpoints {
+		if nil != v.channel {
+			c++
+		}
+	}
+	return c
+}
+
+func (this *Balancer) buildRing() {
+	this.ring = this.ring[:0]
+	for _, v := range this.endpoints {
+		for i := 0; i < virtualNodes; i++ {
+			this.ring = append(this.ring, ringNode{
+				hash:     crc32.ChecksumIEEE([]byte(v.name + "#" + strconv.Itoa(i))),
+				endpoint: v,
+			})
+		}
+	}
+	sort.Slice(this.ring, func(i, j int) bool {
+		return this.ring[i].hash < this.ring[j].hash
+	})
+}
+
+func (this *Balancer) connect(ep *endpoint) {
+	interval := this.option.RetryInterval
+	for {
+		select {
+		case <-ep.stopC:
+			return
+		default:
+		}
+
+		session, err := ep.dialer.Dial(this.option.DialTimeout)
+		if nil == err {
+			this.option.SetupSession(session)
+			channel, _ := NewSessionChannel(session, this.option.Server, this.client)
+			channel.SetCloseCallBack(func(kendynet.StreamSession, error) {
+				this.onDisconnect(ep, channel)
+			})
+
+			this.mu.Lock()
+			if ep.removed {
+				this.mu.Unlock()
+				session.Close(nil, 0)
+				return
+			}
+			ep.channel = channel
+			this.mu.Unlock()
+
+			if nil != this.option.OnConnect {
+				this.option.OnConnect(ep.name, channel)
+			}
+
+			channel.BeginRecv()
+			return
+		}
+
+		kendynet.GetLogger().Errorf(util.FormatFileLine("Balancer dial %s error:%s,retry after %v\n", ep.name, err.Error(), interval))
+
+		//在[interval/2,interval)之间随机,避免多个客户端同时重连
+		d := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+
+		select {
+		case <-ep.stopC:
+			return
+		case <-time.After(d):
+		}
+
+		if interval *= 2; interval > this.option.MaxRetryInterval {
+			interval = this.option.MaxRetryInterval
+		}
+	}
+}
+
+func (this *Balancer) onDisconnect(ep *endpoint, channel *SessionChannel) {
+	this.mu.Lock()
+	if ep.channel == channel {
+		ep.channel = nil
+	}
+	removed := ep.removed
+	this.mu.Unlock()
+
+	if !removed {
+		go this.connect(ep)
+	}
+}
+
+func (this *Balancer) pick(key string, exclude map[*endpoint]bool) (*endpoint, RPCChannel) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	available := func(ep *endpoint) bool {
+		return nil != ep.channel && !exclude[ep]
+	}
+
+	n := len(this.endpoints)
+	if n == 0 {
+		return nil, nil
+	}
+
+	policy := this.option.Policy
+	if policy == ConsistentHash && key == "" {
+		policy = RoundRobin
+	}
+
+	switch policy {
+	case LeastPending:
+		var ep *endpoint
+		for _, v := range this.endpoints {
+			if available(v) && (nil == ep || atomic.LoadInt32(&v.pending) < atomic.LoadInt32(&ep.pending)) {
+				ep = v
+			}
+		}
+		if nil != ep {
+			return ep, ep.channel
+		}
+	case ConsistentHash:
+		h := crc32.ChecksumIEEE([]byte(key))
+		i := sort.Search(len(this.ring), func(i int) bool {
+			return this.ring[i].hash >= h
+		})
+		for j := 0; j < len(this.ring); j++ {
+			if ep := this.ring[(i+j)%len(this.ring)].endpoint; available(ep) {
+				return ep, ep.channel
+			}
+		}
+	default:
+		start := int(atomic.AddUint64(&this.counter, 1) % uint64(n))
+		for i := 0; i < n; i++ {
+			if ep := this.endpoints[(start+i)%n]; available(ep) {
+				return ep, ep.channel
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func getCallOption(opt []CallOption) CallOption {
+	if len(opt) > 0 {
+		return opt[0]
+	} else {
+		return CallOption{}
+	}
+}
+
+type invokeFunc func(channel RPCChannel, cb RPCResponseHandler) error
+
+//返回新的集合,重试可能在不同的goroutine上发生
+func excludeEndpoint(exclude map[*endpoint]bool, ep *endpoint) map[*endpoint]bool {
+	m := map[*endpoint]bool{ep: true}
+	for k := range exclude {
+		m[k] = true
+	}
+	return m
+}
+
+func (this *Balancer) invoke(o CallOption, retry int, exclude map[*endpoint]bool, call invokeFunc, cb RPCResponseHandler) error {
+	ep, channel := this.pick(o.HashKey, exclude)
+	if nil == ep {
+		return ErrNoAvailableChannel
+	}
+
+	atomic.AddInt32(&ep.pending, 1)
+
+	/*
+	 *  call返回错误之前回调可能已经被执行(例如SendRequest期间信道断开或超时),
+	 *  以done保证每次尝试只完成一次,由CAS成功的一方减少pending并重试或应答
+	 */
+	var done int32
+
+	var wrap RPCResponseHandler
+	if nil != cb {
+		wrap = func(ret interface{}, err error) {
+			if !atomic.CompareAndSwapInt32(&done, 0, 1) {
+				return
+			}
+			atomic.AddInt32(&ep.pending, -1)
+			if err == ErrChannelDisconnected && o.Idempotent && retry < this.option.MaxRetry {
+				if nil == this.invoke(o, retry+1, excludeEndpoint(exclude, ep), call, cb) {
+					return
+				}
+			}
+			cb(ret, err)
+		}
+	}
+
+	err := call(channel, wrap)
+
+	if nil == err {
+		if nil == cb {
+			atomic.AddInt32(&ep.pending, -1)
+		}
+		return nil
+	}
+
+	if !atomic.CompareAndSwapInt32(&done, 0, 1) {
+		//回调已经处理了本次尝试,cb会被调用
+		return nil
+	}
+
+	atomic.AddInt32(&ep.pending, -1)
+
+	if o.Idempotent && retry < this.option.MaxRetry {
+		if e := this.invoke(o, retry+1, excludeEndpoint(exclude, ep), call, cb); e != ErrNoAvailableChannel {
+			return e
+		}
+	}
+
+	return err
+}
+
+/*
+ *  重试时使用相同的timeout重新计时
+ */
+func (this *Balancer) AsynCall(method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler, opt ...CallOption) error {
+	if nil == cb {
+		return errors.New("cb == nil")
+	}
+	return this.invoke(getCallOption(opt), 0, nil, func(channel RPCChannel, cb RPCResponseHandler) error {
+		return this.client.AsynCall(channel, method, arg, timeout, cb)
+	}, cb)
+}
+
+func (this *Balancer) AsynCallContext(ctx context.Context, method string, arg interface{}, cb RPCResponseHandler, opt ...CallOption) error {
+	if nil == cb {
+		return errors.New("cb == nil")
+	}
+	return this.invoke(getCallOption(opt), 0, nil, func(channel RPCChannel, cb RPCResponseHandler) error {
+		return this.client.AsynCallContext(ctx, channel, method, arg, cb)
+	}, cb)
+}
+
+func (this *Balancer) Post(method string, arg interface{}, opt ...CallOption) error {
+	return this.invoke(getCallOption(opt), 0, nil, func(channel RPCChannel, _ RPCResponseHandler) error {
+		return this.client.Post(channel, method, arg)
+	}, nil)
+}
+
+//同步调用
+func (this *Balancer) Call(method string, arg interface{}, timeout time.Duration, opt ...CallOption) (ret interface{}, err error) {
+	waitC := make(chan struct{})
+	f := func(ret_ interface{}, err_ error) {
+		ret = ret_
+		err = err_
+		close(waitC)
+	}
+
+	if e := this.AsynCall(method, arg, timeout, f, opt...); nil == e {
+		<-waitC
+	} else {
+		err = e
+	}
+
+	return
+}
+
+//同步调用,可通过ctx取消
+func (this *Balancer) CallContext(ctx context.Context, method string, arg interface{}, opt ...CallOption) (ret interface{}, err error) {
+	waitC := make(chan struct{})
+	f := func(ret_ interface{}, err_ error) {
+		ret = ret_
+		err = err_
+		close(waitC)
+	}
+
+	if e := this.AsynCallContext(ctx, method, arg, f, opt...); nil == e {
+		<-waitC
+	} else {
+		err = e
+	}
+
+	return
+}
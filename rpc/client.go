@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/sniperHW/kendynet"
@@ -10,8 +11,8 @@ import (
 	"time"
 )
 
-var ErrCallTimeout error = fmt.Errorf("rpc call timeout")
-var ErrChannelDisconnected error = fmt.Errorf("channel disconnected")
+var ErrCallTimeout error = NewError(CodeTimeout, "rpc call timeout")
+var ErrChannelDisconnected error = NewError(CodeDisconnected, "channel disconnected")
 
 var sequence uint64
 
@@ -22,6 +23,7 @@ type callContext struct {
 	channelID     uint64
 	onResponse    RPCResponseHandler
 	deadlineTimer *time.Timer
+	doneC         chan struct{} //调用结束时关闭,用于结束context的监视goroutine
 	rpcCli        *RPCClient
 	pprev         *callContext
 	nnext         *callContext
@@ -38,9 +40,22 @@ func getCallContext() *callContext {
 }
 
 func releaseCallContext(c *callContext) {
+	c.onResponse = nil
+	c.deadlineTimer = nil
+	c.doneC = nil
 	callContextPool.Put(c)
 }
 
+//调用已经从RPCClient中移除,停止超时定时器及context监视
+func (this *callContext) stop() {
+	if nil != this.deadlineTimer {
+		this.deadlineTimer.Stop()
+	}
+	if nil != this.doneC {
+		close(this.doneC)
+	}
+}
+
 type channelCalls struct {
 	calls callContext
 }
@@ -75,6 +90,8 @@ type RPCClient struct {
 	mu           sync.Mutex
 	callContexts map[uint64]*callContext
 	channels     map[uint64]*channelCalls
+	interceptors []ClientInterceptor
+	streams      map[uint64]*Stream
 }
 
 func (this *callContext) onTimeout() {
@@ -96,7 +113,9 @@ func (this *RPCClient) addCall(call *callContext, timeout time.Duration) {
 		this.channels[call.channelID] = cc
 	}
 	cc.add(call)
-	call.deadlineTimer = time.AfterFunc(timeout, call.onTimeout)
+	if timeout > 0 {
+		call.deadlineTimer = time.AfterFunc(timeout, call.onTimeout)
+	}
 }
 
 func (this *RPCClient) removeCallBySeqno(seq uint64) *callContext {
@@ -104,12 +123,14 @@ func (this *RPCClient) removeCallBySeqno(seq uint64) *callContext {
 	defer this.mu.Unlock()
 	if call, ok := this.callContexts[seq]; ok {
 		delete(this.callContexts, seq)
-		cc := this.channels[call.channelID]
-		cc.remove(call)
-		if cc.empty() {
-			delete(this.channels, call.channelID)
+		//通道可能已经被OnChannelDisconnect移除
+		if cc := this.channels[call.channelID]; nil != cc {
+			cc.remove(call)
+			if cc.empty() {
+				delete(this.channels, call.channelID)
+			}
 		}
-		call.deadlineTimer.Stop()
+		call.stop()
 		return call
 	}
 	return nil
@@ -119,46 +140,54 @@ func (this *RPCClient) OnRPCMessage(message interface{}) {
 	if msg, err := this.decoder.Decode(message); nil != err {
 		kendynet.GetLogger().Errorf(util.FormatFileLine("RPCClient rpc message decode err:%s\n", err.Error()))
 	} else {
-		if resp, ok := msg.(*RPCResponse); ok {
-			if call := this.removeCallBySeqno(resp.GetSeq()); nil != call {
-				call.onResponse(resp.Ret, resp.Err)
-				releaseCallContext(call)
-			} else {
-				kendynet.GetLogger().Info("onResponse with no reqContext", resp.GetSeq())
-			}
+		this.dispatch(msg)
+	}
+}
+
+func (this *RPCClient) dispatch(msg RPCMessage) {
+	switch msg.(type) {
+	case *RPCResponse:
+		resp := msg.(*RPCResponse)
+		if call := this.removeCallBySeqno(resp.GetSeq()); nil != call {
+			call.onResponse(resp.Ret, resp.Err)
+			releaseCallContext(call)
+		} else {
+			kendynet.GetLogger().Info("onResponse with no reqContext", resp.GetSeq())
 		}
+	case *RPCStream:
+		this.onStream(msg.(*RPCStream))
 	}
 }
 
 func (this *RPCClient) OnChannelDisconnect(channel RPCChannel) {
+	var calls []*callContext
+
+	//在锁内取出通道上所有的调用,之后其它路径不会再访问这些调用
 	this.mu.Lock()
-	cc, ok := this.channels[channel.UID()]
-	if ok {
+	if cc, ok := this.channels[channel.UID()]; ok {
 		delete(this.channels, channel.UID())
-	}
-	this.mu.Unlock()
-
-	if ok {
-		c := cc.calls.nnext
-		var next *callContext
-		for ; c != &cc.calls; c = next {
-			next = c.nnext
-			this.mu.Lock()
-			if _, ok = this.callContexts[c.seq]; ok {
+		for c := cc.calls.nnext; c != &cc.calls; c = c.nnext {
+			if this.callContexts[c.seq] == c {
 				delete(this.callContexts, c.seq)
-			}
-			this.mu.Unlock()
-			if ok {
-				c.deadlineTimer.Stop()
-				c.onResponse(nil, ErrChannelDisconnected)
-				releaseCallContext(c)
+				c.stop()
+				calls = append(calls, c)
 			}
 		}
 	}
+	this.mu.Unlock()
+
+	for _, c := range calls {
+		c.onResponse(nil, ErrChannelDisconnected)
+		releaseCallContext(c)
+	}
 }
 
 //投递，不关心响应和是否失败
 func (this *RPCClient) Post(channel RPCChannel, method string, arg interface{}) error {
+	return this.invoke(context.Background(), channel, method, arg, nil, this.post)
+}
+
+func (this *RPCClient) post(_ context.Context, channel RPCChannel, method string, arg interface{}, _ RPCResponseHandler) error {
 
 	req := &RPCRequest{
 		Method:   method,
@@ -179,6 +208,71 @@ func (this *RPCClient) Post(channel RPCChannel, method string, arg interface{})
 }
 
 func (this *RPCClient) AsynCall(channel RPCChannel, method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+	if cb == nil {
+		return errors.New("cb == nil")
+	}
+
+	if timeout <= 0 {
+		//保持原有语义,timeout <= 0立即超时
+		timeout = time.Nanosecond
+	}
+
+	return this.invoke(context.Background(), channel, method, arg, cb, func(_ context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler) error {
+		return this.asynCall(nil, channel, method, arg, timeout, cb)
+	})
+}
+
+/*
+ *  ctx被取消时cb以ctx.Err()被调用,到达ctx的截止时间时cb以ErrCallTimeout被调用。
+ *  ctx的剩余时间通过RPCRequest.Timeout传递给服务端
+ */
+func (this *RPCClient) AsynCallContext(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler) error {
+	if nil == ctx {
+		return errors.New("ctx == nil")
+	}
+
+	if cb == nil {
+		return errors.New("cb == nil")
+	}
+
+	return this.invoke(ctx, channel, method, arg, cb, this.asynCallContext)
+}
+
+func (this *RPCClient) asynCallContext(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler) error {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return ErrCallTimeout
+		}
+	}
+
+	if err := ctx.Err(); nil != err {
+		return contextError(err)
+	}
+
+	return this.asynCall(ctx, channel, method, arg, timeout, cb)
+}
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrCallTimeout
+	} else {
+		return err
+	}
+}
+
+func (this *RPCClient) watchContext(ctx context.Context, seq uint64, doneC chan struct{}) {
+	select {
+	case <-ctx.Done():
+		if call := this.removeCallBySeqno(seq); nil != call {
+			call.onResponse(nil, contextError(ctx.Err()))
+			releaseCallContext(call)
+		}
+	case <-doneC:
+	}
+}
+
+func (this *RPCClient) asynCall(ctx context.Context, channel RPCChannel, method string, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
 
 	if cb == nil {
 		return errors.New("cb == nil")
@@ -189,8 +283,13 @@ func (this *RPCClient) AsynCall(channel RPCChannel, method string, arg interface
 		Seq:      atomic.AddUint64(&sequence, 1),
 		Arg:      arg,
 		NeedResp: true,
+		Timeout:  timeout,
 	}
 
+	return this.call(ctx, channel, req, timeout, cb)
+}
+
+func (this *RPCClient) call(ctx context.Context, channel RPCChannel, req *RPCRequest, timeout time.Duration, cb RPCResponseHandler) error {
 	if request, err := this.encoder.Encode(req); err != nil {
 		return err
 	} else {
@@ -199,7 +298,19 @@ func (this *RPCClient) AsynCall(channel RPCChannel, method string, arg interface
 		context.seq = req.Seq
 		context.rpcCli = this
 		context.channelID = channel.UID()
-		this.addCall(context, timeout)
+
+		if nil == ctx {
+			this.addCall(context, timeout)
+		} else if nil == ctx.Done() {
+			this.addCall(context, 0)
+		} else {
+			//超时与取消由ctx负责
+			doneC := make(chan struct{})
+			context.doneC = doneC
+			this.addCall(context, 0)
+			go this.watchContext(ctx, req.Seq, doneC)
+		}
+
 		if err = channel.SendRequest(request); err == nil {
 			return nil
 		} else {
@@ -220,8 +331,30 @@ func (this *RPCClient) Call(channel RPCChannel, method string, arg interface{},
 		close(waitC)
 	}
 
-	if err = this.AsynCall(channel, method, arg, timeout, f); nil == err {
+	//回调可能先于调用返回执行,不能直接赋值给err
+	if e := this.AsynCall(channel, method, arg, timeout, f); nil == e {
+		<-waitC
+	} else {
+		err = e
+	}
+
+	return
+}
+
+//同步调用,可通过ctx取消
+func (this *RPCClient) CallContext(ctx context.Context, channel RPCChannel, method string, arg interface{}) (ret interface{}, err error) {
+	waitC := make(chan struct{})
+	f := func(ret_ interface{}, err_ error) {
+		ret = ret_
+		err = err_
+		close(waitC)
+	}
+
+	//回调可能先于调用返回执行,不能直接赋值给err
+	if e := this.AsynCallContext(ctx, channel, method, arg, f); nil == e {
 		<-waitC
+	} else {
+		err = e
 	}
 
 	return
@@ -237,6 +370,7 @@ func NewClient(decoder RPCMessageDecoder, encoder RPCMessageEncoder) *RPCClient
 			decoder:      decoder,
 			callContexts: map[uint64]*callContext{},
 			channels:     map[uint64]*channelCalls{},
+			streams:      map[uint64]*Stream{},
 		}
 		return c
 	}
@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sniperHW/kendynet/buffer"
+)
+
+/*
+ *  框架产生的错误码,应用自定义错误码从CodeUser开始
+ */
+const (
+	CodeOK              = int32(0)
+	CodeUnknown         = int32(1) //非*Error类型的错误
+	CodeMissingMethod   = int32(2)
+	CodePanic           = int32(3) //方法执行时panic
+	CodeServiceStop     = int32(4) //OnServiceStop
+	CodeTimeout         = int32(5)
+	CodeDisconnected    = int32(6)
+	CodeInvalidArgument = int32(7)
+	CodeCanceled        = int32(8)
+	CodeUnavailable     = int32(9)
+	CodeShuttingDown    = int32(10)
+	CodeUser            = int32(1000)
+)
+
+/*
+ *  带错误码的rpc错误,可通过EncodeError/DecodeError无损的在编解码器中传输
+ */
+type Error struct {
+	Code    int32
+	Message string
+	Details []byte
+}
+
+func NewError(code int32, message string, details ...[]byte) *Error {
+	e := &Error{
+		Code:    code,
+		Message: message,
+	}
+	if len(details) > 0 {
+		e.Details = details[0]
+	}
+	return e
+}
+
+func Errorf(code int32, format string, a ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (this *Error) Error() string {
+	return this.Message
+}
+
+/*
+ *  返回err的错误码,nil返回CodeOK,非*Error类型返回CodeUnknown。
+ *
+ *  errors.Is按实例比较,经过编解码的错误不再是原来的实例,
+ *  例如DecodeError得到的超时错误不满足errors.Is(err, ErrCallTimeout),应以Code(err) == CodeTimeout判断
+ */
+func Code(err error) int32 {
+	if nil == err {
+		return CodeOK
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	} else {
+		return CodeUnknown
+	}
+}
+
+//若err不是*Error,以code包装
+func wrapError(err error, code int32) error {
+	if Code(err) == CodeUnknown {
+		return NewError(code, err.Error())
+	} else {
+		return err
+	}
+}
+
+var ErrShuttingDown error = NewError(CodeShuttingDown, "rpc server shutting down")
+
+const errorMagic = byte(0xEC)
+
+/*
+ *  供编解码器使用,格式: | magic(1字节) | code(int32) | len(message)(uint32) | message | details |
+ *
+ *  非*Error类型的错误以CodeUnknown编码,err == nil返回nil
+ */
+func EncodeError(err error) []byte {
+	if nil == err {
+		return nil
+	}
+
+	var details []byte
+	var e *Error
+	if errors.As(err, &e) {
+		details = e.Details
+	}
+
+	message := err.Error()
+
+	b := make([]byte, 0, 9+len(message)+len(details))
+	b = buffer.AppendByte(b, errorMagic)
+	b = buffer.AppendInt32(b, Code(err))
+	b = buffer.AppendUint32(b, uint32(len(message)))
+	b = buffer.AppendString(b, message)
+	b = buffer.AppendBytes(b, details)
+	return b
+}
+
+/*
+ *  EncodeError的逆操作,len(b) == 0返回nil。
+ *
+ *  不是由EncodeError产生的数据(例如旧版本对端直接传输的错误字符串)整体作为Message,错误码为CodeUnknown
+ */
+func DecodeError(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	if b[0] == errorMagic {
+		reader := buffer.NewReader(b[1:])
+		if code, err := reader.CheckGetInt32(); nil == err {
+			if size, err := reader.CheckGetUint32(); nil == err {
+				if message, err := reader.CheckGetString(int(size)); nil == err {
+					e := NewError(code, message)
+					if details := reader.GetAll(); len(details) > 0 {
+						e.Details = append([]byte{}, details...)
+					}
+					return e
+				}
+			}
+		}
+	}
+
+	return NewError(CodeUnknown, string(b))
+}
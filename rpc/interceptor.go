@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"context"
+)
+
+/*
+ *  服务端拦截器,可通过replyer获取方法名,RPCChannel及context。
+ *
+ *  调用next将请求交给后续的拦截器及方法处理,不调用next则需自行通过replyer.Reply返回结果(例如鉴权失败)。
+ *  注意:方法可能在next返回之后才异步Reply
+ */
+type ServerInterceptor func(replyer *RPCReplyer, arg interface{}, next RPCMethodHandler)
+
+/*
+ *  客户端调用的实际执行者,cb == nil表示Post
+ */
+type RPCInvoker func(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler) error
+
+/*
+ *  客户端拦截器,作用于AsynCall,AsynCallContext,Post(以及基于它们的Call,CallContext)。
+ *
+ *  cb == nil表示Post。拦截器可以包装cb以观察响应,也可以替换ctx(仅对AsynCallContext生效)。
+ *  AsynCall及Post的ctx为context.Background()
+ */
+type ClientInterceptor func(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler, next RPCInvoker) error
+
+func chainServerInterceptors(interceptors []ServerInterceptor, method RPCMethodHandler) RPCMethodHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := method
+		method = func(replyer *RPCReplyer, arg interface{}) {
+			interceptor(replyer, arg, next)
+		}
+	}
+	return method
+}
+
+func chainClientInterceptors(interceptors []ClientInterceptor, invoker RPCInvoker) RPCInvoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := invoker
+		invoker = func(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler) error {
+			return interceptor(ctx, channel, method, arg, cb, next)
+		}
+	}
+	return invoker
+}
+
+/*
+ *  添加服务端拦截器,按添加顺序由外向内执行
+ */
+func (this *RPCServer) Use(interceptors ...ServerInterceptor) {
+	this.Lock()
+	defer this.Unlock()
+	for _, v := range interceptors {
+		if nil != v {
+			this.interceptors = append(this.interceptors, v)
+		}
+	}
+}
+
+/*
+ *  添加客户端拦截器,按添加顺序由外向内执行
+ */
+func (this *RPCClient) Use(interceptors ...ClientInterceptor) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for _, v := range interceptors {
+		if nil != v {
+			this.interceptors = append(this.interceptors, v)
+		}
+	}
+}
+
+func (this *RPCClient) invoke(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler, invoker RPCInvoker) error {
+	this.mu.Lock()
+	interceptors := this.interceptors
+	this.mu.Unlock()
+	return chainClientInterceptors(interceptors, invoker)(ctx, channel, method, arg, cb)
+}
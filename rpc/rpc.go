@@ -1,5 +1,9 @@
 package rpc
 
+import (
+	"time"
+)
+
 /*
 *  注意,传递给RPC模块的所有回调函数可能在底层信道的接收/发送goroutine上执行，
 *  为了避免接收/发送goroutine被阻塞，回调函数中不能调用阻塞函数。
@@ -9,6 +13,15 @@ package rpc
 const (
 	RPC_REQUEST  = 1
 	RPC_RESPONSE = 2
+	RPC_STREAM   = 3
+)
+
+//RPCStream.Flag
+const (
+	StreamData   = byte(1)
+	StreamEnd    = byte(2)
+	StreamCancel = byte(3)
+	StreamWindow = byte(4)
 )
 
 type RPCMessage interface {
@@ -17,10 +30,12 @@ type RPCMessage interface {
 }
 
 type RPCRequest struct {
-	Seq      uint64
-	Method   string
-	Arg      interface{}
-	NeedResp bool
+	Seq          uint64
+	Method       string
+	Arg          interface{}
+	NeedResp     bool
+	Timeout      time.Duration //调用方剩余的等待时间,0表示没有限制。编解码器可选择是否传输该字段
+	StreamWindow uint32        //>0表示流式调用,为双方的初始发送窗口
 }
 
 type RPCResponse struct {
@@ -29,6 +44,18 @@ type RPCResponse struct {
 	Ret interface{}
 }
 
+/*
+ *  流式调用的数据帧,Seq为发起流式调用的RPCRequest.Seq
+ */
+type RPCStream struct {
+	Seq        uint64
+	Flag       byte
+	Data       interface{} //StreamData
+	Err        error       //StreamEnd
+	Window     uint32      //StreamWindow,归还给对端的发送额度
+	FromClient bool        //由客户端发往服务端
+}
+
 func (this *RPCRequest) Type() byte {
 	return RPC_REQUEST
 }
@@ -37,6 +64,10 @@ func (this *RPCResponse) Type() byte {
 	return RPC_RESPONSE
 }
 
+func (this *RPCStream) Type() byte {
+	return RPC_STREAM
+}
+
 func (this *RPCRequest) GetSeq() uint64 {
 	return this.Seq
 }
@@ -45,6 +76,10 @@ func (this *RPCResponse) GetSeq() uint64 {
 	return this.Seq
 }
 
+func (this *RPCStream) GetSeq() uint64 {
+	return this.Seq
+}
+
 type RPCMessageEncoder interface {
 	Encode(RPCMessage) (interface{}, error)
 }
@@ -4,6 +4,8 @@ package rpc
 //go tool cover -html=coverage.out
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/sniperHW/kendynet"
@@ -13,9 +15,12 @@ import (
 	"github.com/sniperHW/kendynet/example/testproto"
 	connector "github.com/sniperHW/kendynet/socket/connector/tcp"
 	listener "github.com/sniperHW/kendynet/socket/listener/tcp"
+	"io"
+	"net"
 	//"github.com/sniperHW/kendynet/util"
 	"github.com/stretchr/testify/assert"
 	"reflect"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -85,7 +90,7 @@ func (this *TestEncoder) Encode(message RPCMessage) (interface{}, error) {
 		resp := message.(*RPCResponse)
 		response := &testproto.RPCResponse{Seq: proto.Uint64(resp.Seq)}
 		if resp.Err != nil {
-			response.Err = proto.String(resp.Err.Error())
+			response.Err = proto.String(string(EncodeError(resp.Err)))
 		}
 		if resp.Ret != nil {
 			b, err := pb.Encode(resp.Ret, nil, 1000)
@@ -131,7 +136,7 @@ func (this *TestDecoder) Decode(o interface{}) (RPCMessage, error) {
 		resp := o.(*testproto.RPCResponse)
 		response := &RPCResponse{Seq: resp.GetSeq()}
 		if resp.Err != nil {
-			response.Err = fmt.Errorf(resp.GetErr())
+			response.Err = DecodeError([]byte(resp.GetErr()))
 		}
 		if len(resp.Ret) > 0 {
 			var err error
@@ -185,6 +190,17 @@ func (this *TestRPCServer) Serve(service string) error {
 	return err
 }
 
+//等待在另一个goroutine中启动的服务端开始监听
+func waitServe(service string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", service); nil == err {
+			conn.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
 func (this *TestRPCServer) Stop() {
 	this.listener.Close()
 }
@@ -253,6 +269,7 @@ func TestRPC2(t *testing.T) {
 		})
 
 		go server.Serve("localhost:8111")
+		waitServe("localhost:8111")
 
 		caller := NewCaller(&TestDecoder{}, &TestEncoder{})
 		caller.Dial("localhost:8111", 10*time.Second, nil)
@@ -282,6 +299,7 @@ func TestRPC2(t *testing.T) {
 		})
 
 		go server.Serve("localhost:8112")
+		waitServe("localhost:8112")
 
 		caller := NewCaller(&TestDecoder{}, &TestEncoder{})
 		caller.Dial("localhost:8112", 10*time.Second, nil)
@@ -315,6 +333,7 @@ func TestRPC2(t *testing.T) {
 		})
 
 		go server.Serve("localhost:8113")
+		waitServe("localhost:8113")
 
 		caller := NewCaller(&TestDecoder{}, &TestEncoder{})
 		caller.Dial("localhost:8113", 10*time.Second, nil)
@@ -361,6 +380,7 @@ func TestRPC(t *testing.T) {
 	}))
 
 	go server.Serve("localhost:8110")
+	waitServe("localhost:8110")
 
 	server.server.PendingCount()
 
@@ -374,7 +394,8 @@ func TestRPC(t *testing.T) {
 		assert.Nil(t, caller.Post("hello", &testproto.Hello{Hello: proto.String("hello")}))
 
 		{
-			caller.Call("panic", &testproto.Hello{Hello: proto.String("hello")}, time.Second*2)
+			_, err := caller.Call("panic", &testproto.Hello{Hello: proto.String("hello")}, time.Second*2)
+			assert.Equal(t, CodePanic, Code(err))
 		}
 
 		{
@@ -386,6 +407,7 @@ func TestRPC(t *testing.T) {
 		{
 			_, err := caller.Call("world", &testproto.Hello{Hello: proto.String("hello")}, time.Second*2)
 			assert.Equal(t, err.Error(), "invaild method:world")
+			assert.Equal(t, CodeMissingMethod, Code(err))
 		}
 
 		{
@@ -399,6 +421,7 @@ func TestRPC(t *testing.T) {
 			fmt.Println("5 begin", time.Now())
 			_, err := caller.Call("world", &testproto.Hello{Hello: proto.String("hello")}, time.Second*2)
 			assert.Equal(t, err.Error(), "invaild method:world")
+			assert.Equal(t, CodeMissingMethod, Code(err))
 		}
 
 		{
@@ -485,7 +508,8 @@ func TestRPC(t *testing.T) {
 		server.halt.Store(true)
 
 		_, err := caller.Call("hello", &testproto.Hello{Hello: proto.String("hello")}, time.Second)
-		assert.Equal(t, err, errHalt)
+		assert.Equal(t, err.Error(), errHalt.Error())
+		assert.Equal(t, CodeServiceStop, Code(err))
 
 	}
 
@@ -494,3 +518,938 @@ func TestRPC(t *testing.T) {
 	assert.Equal(t, int32(0), server.server.PendingCount())
 
 }
+
+//直接在进程内传递RPCMessage的编解码器与通道,用于不依赖网络的测试
+type memCodec struct {
+}
+
+func (this *memCodec) Encode(message RPCMessage) (interface{}, error) {
+	return message, nil
+}
+
+func (this *memCodec) Decode(o interface{}) (RPCMessage, error) {
+	if msg, ok := o.(RPCMessage); ok {
+		return msg, nil
+	} else {
+		return nil, fmt.Errorf("invaild obj type:%s", reflect.TypeOf(o).String())
+	}
+}
+
+var memChannelUID uint64
+
+type memChannel struct {
+	uid       uint64
+	server    *RPCServer
+	client    *RPCClient
+	requestC  chan interface{}
+	responseC chan interface{}
+	closed    int32
+}
+
+func newMemChannel(server *RPCServer, client *RPCClient) *memChannel {
+	c := &memChannel{
+		uid:       atomic.AddUint64(&memChannelUID, 1),
+		server:    server,
+		client:    client,
+		requestC:  make(chan interface{}, 1024),
+		responseC: make(chan interface{}, 1024),
+	}
+
+	go func() {
+		for msg := range c.requestC {
+			c.server.OnRPCMessage(c, msg)
+		}
+	}()
+
+	go func() {
+		for msg := range c.responseC {
+			c.client.OnRPCMessage(msg)
+		}
+	}()
+
+	return c
+}
+
+func (this *memChannel) SendRequest(message interface{}) error {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return kendynet.ErrSocketClose
+	}
+	this.requestC <- message
+	return nil
+}
+
+func (this *memChannel) SendResponse(message interface{}) error {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return kendynet.ErrSocketClose
+	}
+	this.responseC <- message
+	return nil
+}
+
+func (this *memChannel) Name() string {
+	return fmt.Sprintf("memChannel:%d", this.uid)
+}
+
+func (this *memChannel) UID() uint64 {
+	return this.uid
+}
+
+func (this *memChannel) Close() {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		this.client.OnChannelDisconnect(this)
+		this.server.OnChannelDisconnect(this)
+	}
+}
+
+func (this *RPCClient) pendingCalls() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.callContexts) + len(this.channels)
+}
+
+func TestCallContext(t *testing.T) {
+	server := NewRPCServer(&memCodec{}, &memCodec{})
+	client := NewClient(&memCodec{}, &memCodec{})
+	channel := newMemChannel(server, client)
+
+	deadlineC := make(chan time.Time, 1)
+	ctxDoneC := make(chan struct{})
+
+	server.RegisterMethod("hello", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Reply(arg, nil)
+	})
+
+	server.RegisterMethod("block", func(replyer *RPCReplyer, arg interface{}) {
+		deadline, ok := replyer.Deadline()
+		if ok {
+			deadlineC <- deadline
+			go func() {
+				<-replyer.Context().Done()
+				assert.Equal(t, context.DeadlineExceeded, replyer.Context().Err())
+				close(ctxDoneC)
+				//调用方已经超时,响应将被丢弃
+				time.Sleep(time.Millisecond * 50)
+				replyer.Reply(nil, nil)
+			}()
+		}
+	})
+
+	{
+		ret, err := client.CallContext(context.Background(), channel, "hello", "hello")
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", ret.(string))
+	}
+
+	{
+		//取消
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			cancel()
+		}()
+		_, err := client.CallContext(ctx, channel, "block", nil)
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 0, client.pendingCalls())
+
+		//已经取消的ctx直接返回错误
+		_, err = client.CallContext(ctx, channel, "hello", "hello")
+		assert.Equal(t, context.Canceled, err)
+	}
+
+	{
+		//截止时间传递到服务端
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+		beg := time.Now()
+		_, err := client.CallContext(ctx, channel, "block", nil)
+		assert.Equal(t, ErrCallTimeout, err)
+		assert.Equal(t, 0, client.pendingCalls())
+		deadline := <-deadlineC
+		//服务端以收到请求的时间计算截止时间,允许少量误差
+		assert.True(t, deadline.Sub(beg) < time.Millisecond*300)
+		<-ctxDoneC
+	}
+
+	{
+		//channel断开
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			channel.Close()
+		}()
+		_, err := client.CallContext(ctx, channel, "block", nil)
+		assert.Equal(t, ErrChannelDisconnected, err)
+		assert.Equal(t, 0, client.pendingCalls())
+	}
+
+	{
+		//取消与channel断开并发,每个调用只回调一次
+		for i := 0; i < 20; i++ {
+			channel := newMemChannel(server, client)
+			var wg sync.WaitGroup
+			var count int32
+			cancels := make([]context.CancelFunc, 0, 50)
+			for j := 0; j < 50; j++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels = append(cancels, cancel)
+				wg.Add(1)
+				assert.Nil(t, client.AsynCallContext(ctx, channel, "block", nil, func(_ interface{}, err error) {
+					assert.NotNil(t, err)
+					if err == ErrChannelDisconnected {
+						//拖慢OnChannelDisconnect,使取消在其执行期间发生
+						time.Sleep(time.Millisecond)
+					}
+					atomic.AddInt32(&count, 1)
+					wg.Done()
+				}))
+			}
+
+			for _, cancel := range cancels {
+				go cancel()
+			}
+			channel.Close()
+
+			wg.Wait()
+			assert.Equal(t, int32(50), atomic.LoadInt32(&count))
+			assert.Equal(t, 0, client.pendingCalls())
+		}
+	}
+}
+
+type HelloReq struct {
+	Name string
+}
+
+type HelloResp struct {
+	Greeting string
+}
+
+type Echo struct {
+}
+
+func (this *Echo) Hello(ctx context.Context, req *HelloReq) (*HelloResp, error) {
+	if nil == req {
+		return nil, errors.New("req == nil")
+	}
+	return &HelloResp{Greeting: "hello " + req.Name}, nil
+}
+
+func (this *Echo) Fail(ctx context.Context, req *HelloReq) (*HelloResp, error) {
+	return nil, errors.New("fail")
+}
+
+//签名不符,不会被注册
+func (this *Echo) Ignore(req *HelloReq) *HelloResp {
+	return nil
+}
+
+func TestService(t *testing.T) {
+	server := NewRPCServer(&memCodec{}, &memCodec{})
+	client := NewClient(&memCodec{}, &memCodec{})
+	channel := newMemChannel(server, client)
+
+	assert.Nil(t, server.RegisterService(&Echo{}))
+	assert.NotNil(t, server.RegisterService(&Echo{}))
+	assert.Nil(t, server.RegisterService(&Echo{}, "Echo2"))
+	assert.NotNil(t, server.RegisterService(&HelloReq{}))
+	assert.NotNil(t, server.RegisterService(nil))
+
+	_, ok := server.methods.Load("Echo.Ignore")
+	assert.False(t, ok)
+
+	{
+		ret, err := client.Call(channel, "Echo.Hello", &HelloReq{Name: "sniperHW"}, time.Second)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello sniperHW", ret.(*HelloResp).Greeting)
+
+		_, err = client.Call(channel, "Echo2.Fail", &HelloReq{}, time.Second)
+		assert.Equal(t, "fail", err.Error())
+
+		//参数类型不符由服务端返回错误
+		_, err = client.Call(channel, "Echo.Hello", "sniperHW", time.Second)
+		assert.True(t, errors.Is(err, ErrInvaildArgType))
+	}
+
+	{
+		_, err := client.NewStub("Echo.Hello", HelloReq{}, &HelloResp{})
+		assert.Equal(t, ErrInvaildArgType, err)
+
+		_, err = client.NewStub("Echo.Hello", &HelloReq{}, nil)
+		assert.Equal(t, ErrInvaildRetType, err)
+
+		stub, err := client.NewStub("Echo.Hello", &HelloReq{}, &HelloResp{})
+		assert.Nil(t, err)
+
+		ret, err := stub.CallContext(context.Background(), channel, &HelloReq{Name: "sniperHW"})
+		assert.Nil(t, err)
+		assert.Equal(t, "hello sniperHW", ret.(*HelloResp).Greeting)
+
+		//参数类型不符在调用处返回错误
+		_, err = stub.Call(channel, &HelloResp{}, time.Second)
+		assert.True(t, errors.Is(err, ErrInvaildArgType))
+
+		//nil参数
+		_, err = stub.Call(channel, nil, time.Second)
+		assert.Equal(t, "req == nil", err.Error())
+
+		waitC := make(chan struct{})
+		assert.Nil(t, stub.AsynCall(channel, &HelloReq{Name: "sniperHW"}, time.Second, func(ret interface{}, err error) {
+			assert.Nil(t, err)
+			assert.Equal(t, "hello sniperHW", ret.(*HelloResp).Greeting)
+			close(waitC)
+		}))
+		<-waitC
+
+		//返回值类型不符
+		stub, _ = client.NewStub("Echo.Hello", &HelloReq{}, &HelloReq{})
+		_, err = stub.Call(channel, &HelloReq{Name: "sniperHW"}, time.Second)
+		assert.True(t, errors.Is(err, ErrInvaildRetType))
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	server := NewRPCServer(&memCodec{}, &memCodec{})
+	client := NewClient(&memCodec{}, &memCodec{})
+	channel := newMemChannel(server, client)
+
+	var mu sync.Mutex
+	var trace []string
+
+	record := func(s string) {
+		mu.Lock()
+		trace = append(trace, s)
+		mu.Unlock()
+	}
+
+	getTrace := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, trace...)
+	}
+
+	resetTrace := func() {
+		mu.Lock()
+		trace = trace[:0]
+		mu.Unlock()
+	}
+
+	server.RegisterMethod("hello", func(replyer *RPCReplyer, arg interface{}) {
+		record("hello")
+		replyer.Reply(arg, nil)
+	})
+
+	server.Use(func(replyer *RPCReplyer, arg interface{}, next RPCMethodHandler) {
+		record("s1:" + replyer.Method())
+		assert.Equal(t, channel, replyer.GetChannel())
+		next(replyer, arg)
+	}, func(replyer *RPCReplyer, arg interface{}, next RPCMethodHandler) {
+		record("s2")
+		if arg.(string) == "deny" {
+			replyer.Reply(nil, errors.New("permission denied"))
+		} else {
+			next(replyer, arg)
+		}
+	})
+
+	client.Use(func(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler, next RPCInvoker) error {
+		record("c1:" + method)
+		if nil == cb {
+			return next(ctx, channel, method, arg, cb)
+		} else {
+			return next(ctx, channel, method, arg, func(ret interface{}, err error) {
+				record("c1 response")
+				cb(ret, err)
+			})
+		}
+	}, func(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler, next RPCInvoker) error {
+		record("c2")
+		if arg.(string) == "reject" {
+			return errors.New("rejected")
+		}
+		return next(ctx, channel, method, arg, cb)
+	})
+
+	ret, err := client.Call(channel, "hello", "hello", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", ret.(string))
+	assert.Equal(t, []string{"c1:hello", "c2", "s1:hello", "s2", "hello", "c1 response"}, getTrace())
+
+	resetTrace()
+	_, err = client.CallContext(context.Background(), channel, "hello", "deny")
+	assert.Equal(t, "permission denied", err.Error())
+	assert.Equal(t, []string{"c1:hello", "c2", "s1:hello", "s2", "c1 response"}, getTrace())
+
+	resetTrace()
+	_, err = client.Call(channel, "hello", "reject", time.Second)
+	assert.Equal(t, "rejected", err.Error())
+	assert.Equal(t, []string{"c1:hello", "c2"}, getTrace())
+	assert.Equal(t, 0, client.pendingCalls())
+
+	resetTrace()
+	assert.Nil(t, client.Post(channel, "hello", "post"))
+	for len(getTrace()) < 5 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, []string{"c1:hello", "c2", "s1:hello", "s2", "hello"}, getTrace())
+}
+
+func TestError(t *testing.T) {
+	assert.Nil(t, EncodeError(nil))
+	assert.Nil(t, DecodeError(nil))
+
+	assert.Equal(t, CodeOK, Code(nil))
+	assert.Equal(t, CodeUnknown, Code(errors.New("error")))
+	assert.Equal(t, CodeTimeout, Code(ErrCallTimeout))
+	assert.Equal(t, CodeInvalidArgument, Code(fmt.Errorf("%w:string", ErrInvaildArgType)))
+
+	{
+		e := NewError(CodeUser+1, "user error", []byte("details"))
+		err := DecodeError(EncodeError(e))
+		assert.Equal(t, e, err)
+		assert.Equal(t, CodeUser+1, Code(err))
+		//errors.Is按实例比较,错误码相同的不同实例不匹配
+		assert.False(t, errors.Is(err, NewError(CodeUser+1, "")))
+		assert.False(t, errors.Is(err, ErrCallTimeout))
+	}
+
+	{
+		assert.True(t, errors.Is(fmt.Errorf("call:%w", ErrCallTimeout), ErrCallTimeout))
+
+		err := DecodeError(EncodeError(ErrCallTimeout))
+		assert.False(t, errors.Is(err, ErrCallTimeout))
+		assert.Equal(t, CodeTimeout, Code(err))
+		assert.Equal(t, ErrCallTimeout.Error(), err.Error())
+	}
+
+	{
+		err := DecodeError(EncodeError(errors.New("error")))
+		assert.Equal(t, CodeUnknown, Code(err))
+		assert.Equal(t, "error", err.Error())
+	}
+
+	{
+		//旧格式的错误字符串
+		err := DecodeError([]byte("invaild method:world"))
+		assert.Equal(t, CodeUnknown, Code(err))
+		assert.Equal(t, "invaild method:world", err.Error())
+
+		err = DecodeError(EncodeError(NewError(CodePanic, "panic"))[:6])
+		assert.Equal(t, CodeUnknown, Code(err))
+	}
+}
+
+func TestStream(t *testing.T) {
+	server := NewRPCServer(&memCodec{}, &memCodec{})
+	client := NewClient(&memCodec{}, &memCodec{})
+	channel := newMemChannel(server, client)
+
+	var sent int32
+	var inflight int32
+
+	server.RegisterMethod("range", func(replyer *RPCReplyer, arg interface{}) {
+		stream := replyer.Stream()
+		assert.NotNil(t, stream)
+		go func() {
+			for i := 0; i < arg.(int); i++ {
+				assert.Nil(t, stream.Send(i))
+				atomic.AddInt32(&sent, 1)
+			}
+			stream.CloseSend()
+		}()
+	})
+
+	server.RegisterMethod("echo", func(replyer *RPCReplyer, arg interface{}) {
+		stream := replyer.Stream()
+		go func() {
+			for {
+				data, err := stream.Recv()
+				if err == io.EOF {
+					stream.CloseSend()
+					return
+				}
+				assert.Nil(t, err)
+				assert.Nil(t, stream.Send(data))
+			}
+		}()
+	})
+
+	errC := make(chan error, 1)
+
+	server.RegisterMethod("block", func(replyer *RPCReplyer, arg interface{}) {
+		stream := replyer.Stream()
+		go func() {
+			var err error
+			for nil == err {
+				err = stream.Send("data")
+			}
+			errC <- err
+		}()
+	})
+
+	server.RegisterMethod("fail", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Stream().Send("data")
+		replyer.Reply(nil, NewError(CodeUser, "fail"))
+	})
+
+	{
+		//服务端流,消费缓慢时服务端的发送受窗口限制
+		stream, err := client.OpenStream(context.Background(), channel, "range", 20, 4)
+		assert.Nil(t, err)
+		for i := 0; i < 20; i++ {
+			time.Sleep(time.Millisecond * 5)
+			if n := atomic.LoadInt32(&sent) - int32(i); n > inflight {
+				inflight = n
+			}
+			data, err := stream.Recv()
+			assert.Nil(t, err)
+			assert.Equal(t, i, data.(int))
+		}
+		_, err = stream.Recv()
+		assert.Equal(t, io.EOF, err)
+		assert.True(t, inflight <= 4)
+		assert.Equal(t, 0, client.pendingCalls())
+		assert.Equal(t, int32(0), server.PendingCount())
+	}
+
+	{
+		//双向流
+		stream, err := client.OpenStream(context.Background(), channel, "echo", nil, 2)
+		assert.Nil(t, err)
+		go func() {
+			for i := 0; i < 10; i++ {
+				assert.Nil(t, stream.Send(i))
+			}
+			assert.Nil(t, stream.CloseSend())
+			assert.Equal(t, ErrStreamClosed, stream.Send(10))
+		}()
+
+		for i := 0; i < 10; i++ {
+			data, err := stream.Recv()
+			assert.Nil(t, err)
+			assert.Equal(t, i, data.(int))
+		}
+		_, err = stream.Recv()
+		assert.Equal(t, io.EOF, err)
+	}
+
+	{
+		//以错误结束,已收到的数据仍可取出
+		stream, err := client.OpenStream(context.Background(), channel, "fail", nil)
+		assert.Nil(t, err)
+		data, err := stream.Recv()
+		assert.Nil(t, err)
+		assert.Equal(t, "data", data.(string))
+		_, err = stream.Recv()
+		assert.Equal(t, CodeUser, Code(err))
+	}
+
+	{
+		//客户端取消
+		stream, err := client.OpenStream(context.Background(), channel, "block", nil, 1)
+		assert.Nil(t, err)
+		time.Sleep(time.Millisecond * 50)
+		stream.Cancel()
+		assert.Equal(t, ErrStreamCanceled, <-errC)
+		_, err = stream.Recv()
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, 0, client.pendingCalls())
+		assert.Equal(t, int32(0), server.PendingCount())
+	}
+
+	{
+		//ctx超时
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		stream, err := client.OpenStream(ctx, channel, "block", nil, 1)
+		assert.Nil(t, err)
+		for nil == err {
+			_, err = stream.Recv()
+		}
+		assert.Equal(t, ErrCallTimeout, err)
+		assert.Equal(t, 0, client.pendingCalls())
+		//服务端同样知道截止时间,可能先于Cancel到达而超时
+		err = <-errC
+		assert.True(t, err == ErrStreamCanceled || err == ErrCallTimeout)
+	}
+
+	{
+		//信道断开
+		stream, err := client.OpenStream(context.Background(), channel, "block", nil, 1)
+		assert.Nil(t, err)
+		time.Sleep(time.Millisecond * 50)
+		channel.Close()
+		assert.Equal(t, ErrChannelDisconnected, <-errC)
+		_, err = stream.Recv()
+		assert.Equal(t, ErrChannelDisconnected, err)
+		assert.Equal(t, 0, client.pendingCalls())
+		assert.Equal(t, int32(0), server.PendingCount())
+	}
+}
+
+func TestSessionChannel(t *testing.T) {
+	_, err := NewSessionChannel(nil, nil, nil)
+	assert.NotNil(t, err)
+
+	l, err := listener.New("tcp", "localhost:8114")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	//双方既是客户端也是服务端
+	server := NewRPCServer(&TestDecoder{}, &TestEncoder{})
+	client := NewClient(&TestDecoder{}, &TestEncoder{})
+
+	server.RegisterMethod("hello", func(replyer *RPCReplyer, arg interface{}) {
+		channel := replyer.GetChannel()
+		//回调对端
+		go func() {
+			ret, err := client.Call(channel, "world", arg, time.Second)
+			if nil != err {
+				replyer.Reply(nil, err)
+			} else {
+				replyer.Reply(ret, nil)
+			}
+		}()
+	})
+
+	server.RegisterMethod("block", func(replyer *RPCReplyer, arg interface{}) {
+	})
+
+	disconnectC := make(chan struct{})
+
+	go l.Serve(func(session kendynet.StreamSession) {
+		session.SetEncoder(codec.NewPbEncoder(65535)).SetInBoundProcessor(codec.NewPBReceiver(65535))
+		channel, err := NewSessionChannel(session, server, client)
+		assert.Nil(t, err)
+		channel.SetCloseCallBack(func(kendynet.StreamSession, error) {
+			close(disconnectC)
+		})
+		channel.BeginRecv()
+	})
+
+	time.Sleep(time.Millisecond * 100)
+
+	peerServer := NewRPCServer(&TestDecoder{}, &TestEncoder{})
+	peerServer.RegisterMethod("world", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Reply(&testproto.World{World: proto.String("world")}, nil)
+	})
+	peerClient := NewClient(&TestDecoder{}, &TestEncoder{})
+
+	c, _ := connector.New("tcp", "localhost:8114")
+	session, err := c.Dial(time.Second)
+	assert.Nil(t, err)
+	session.SetEncoder(codec.NewPbEncoder(65535)).SetInBoundProcessor(codec.NewPBReceiver(65535))
+
+	channel1, _ := NewSessionChannel(session, peerServer, peerClient)
+	channel2, _ := NewSessionChannel(session, peerServer, peerClient)
+	assert.True(t, channel2.UID() > channel1.UID())
+
+	channel, err := NewSessionChannel(session, peerServer, peerClient)
+	assert.Nil(t, err)
+	assert.Nil(t, channel.BeginRecv())
+
+	ret, err := peerClient.Call(channel, "hello", &testproto.Hello{Hello: proto.String("hello")}, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", ret.(*testproto.World).GetWorld())
+
+	//断开时通知RPCClient
+	waitC := make(chan struct{})
+	peerClient.AsynCall(channel, "block", &testproto.Hello{Hello: proto.String("hello")}, time.Second*5, func(ret interface{}, err error) {
+		assert.Equal(t, ErrChannelDisconnected, err)
+		close(waitC)
+	})
+	session.Close(nil, 0)
+	<-waitC
+	<-disconnectC
+}
+
+type balanceServer struct {
+	name     string
+	addr     string
+	server   *RPCServer
+	listener *listener.Listener
+	mu       sync.Mutex
+	sessions []kendynet.StreamSession
+}
+
+func newBalanceServer(t *testing.T, name string, addr string) *balanceServer {
+	s := &balanceServer{
+		name:   name,
+		addr:   addr,
+		server: NewRPCServer(&TestDecoder{}, &TestEncoder{}),
+	}
+
+	s.server.RegisterMethod("whoami", func(replyer *RPCReplyer, arg interface{}) {
+		replyer.Reply(&testproto.World{World: proto.String(name)}, nil)
+	})
+
+	s.server.RegisterMethod("close", func(replyer *RPCReplyer, arg interface{}) {
+		if name == "A" {
+			replyer.GetChannel().(*SessionChannel).GetSession().Close(nil, 0)
+		} else {
+			replyer.Reply(&testproto.World{World: proto.String(name)}, nil)
+		}
+	})
+
+	s.start(t)
+	return s
+}
+
+func (this *balanceServer) start(t *testing.T) {
+	var err error
+	this.listener, err = listener.New("tcp", this.addr)
+	assert.Nil(t, err)
+	go this.listener.Serve(func(session kendynet.StreamSession) {
+		this.mu.Lock()
+		this.sessions = append(this.sessions, session)
+		this.mu.Unlock()
+		session.SetEncoder(codec.NewPbEncoder(65535)).SetInBoundProcessor(codec.NewPBReceiver(65535))
+		channel, _ := NewSessionChannel(session, this.server, nil)
+		channel.BeginRecv()
+	})
+}
+
+func (this *balanceServer) stop() {
+	this.listener.Close()
+	this.mu.Lock()
+	sessions := this.sessions
+	this.sessions = nil
+	this.mu.Unlock()
+	for _, v := range sessions {
+		v.Close(nil, 0)
+	}
+}
+
+func whoami(b *Balancer, method string, opt ...CallOption) (string, error) {
+	ret, err := b.Call(method, &testproto.Hello{Hello: proto.String("hello")}, time.Second, opt...)
+	if nil != err {
+		return "", err
+	}
+	return ret.(*testproto.World).GetWorld(), nil
+}
+
+func waitAvailable(b *Balancer, n int) {
+	for b.Available() != n {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestBalancer(t *testing.T) {
+	client := NewClient(&TestDecoder{}, &TestEncoder{})
+
+	_, err := NewBalancer(client, BalancerOption{})
+	assert.NotNil(t, err)
+
+	setup := func(session kendynet.StreamSession) {
+		session.SetEncoder(codec.NewPbEncoder(65535)).SetInBoundProcessor(codec.NewPBReceiver(65535))
+	}
+
+	serverA := newBalanceServer(t, "A", "localhost:8115")
+	serverB := newBalanceServer(t, "B", "localhost:8116")
+	defer serverB.stop()
+
+	newBalancer := func(policy BalancePolicy) *Balancer {
+		b, err := NewBalancer(client, BalancerOption{
+			Policy:           policy,
+			SetupSession:     setup,
+			RetryInterval:    time.Millisecond * 50,
+			MaxRetryInterval: time.Millisecond * 200,
+		})
+		assert.Nil(t, err)
+		ca, _ := connector.New("tcp", "localhost:8115")
+		cb, _ := connector.New("tcp", "localhost:8116")
+		assert.Nil(t, b.Add("A", ca))
+		assert.Nil(t, b.Add("B", cb))
+		assert.NotNil(t, b.Add("B", cb))
+		waitAvailable(b, 2)
+		return b
+	}
+
+	{
+		b := newBalancer(RoundRobin)
+		counter := map[string]int{}
+		for i := 0; i < 4; i++ {
+			name, err := whoami(b, "whoami")
+			assert.Nil(t, err)
+			counter[name]++
+		}
+		assert.Equal(t, map[string]int{"A": 2, "B": 2}, counter)
+
+		//A停止后被移除,所有调用转到B
+		serverA.stop()
+		waitAvailable(b, 1)
+		for i := 0; i < 4; i++ {
+			name, err := whoami(b, "whoami")
+			assert.Nil(t, err)
+			assert.Equal(t, "B", name)
+		}
+
+		//A恢复后自动重连
+		serverA.start(t)
+		waitAvailable(b, 2)
+
+		b.Remove("B")
+		assert.Equal(t, 1, b.Available())
+		name, _ := whoami(b, "whoami")
+		assert.Equal(t, "A", name)
+
+		b.Close()
+		assert.Equal(t, 0, b.Available())
+		_, err = whoami(b, "whoami")
+		assert.Equal(t, ErrNoAvailableChannel, err)
+	}
+
+	{
+		b := newBalancer(LeastPending)
+		waitC := make(chan struct{})
+		//A上有一个未完成的调用
+		serverA.server.RegisterMethod("block", func(replyer *RPCReplyer, arg interface{}) {
+			close(waitC)
+		})
+		b.AsynCall("block", &testproto.Hello{Hello: proto.String("hello")}, time.Second*5, func(interface{}, error) {}, CallOption{HashKey: "A"})
+		<-waitC
+		for i := 0; i < 4; i++ {
+			name, _ := whoami(b, "whoami")
+			assert.Equal(t, "B", name)
+		}
+		b.Close()
+	}
+
+	{
+		b := newBalancer(ConsistentHash)
+
+		//找到一个映射到A的key
+		var key string
+		for i := 0; ; i++ {
+			key = fmt.Sprintf("key:%d", i)
+			if name, _ := whoami(b, "whoami", CallOption{HashKey: key}); name == "A" {
+				break
+			}
+		}
+
+		for i := 0; i < 4; i++ {
+			name, _ := whoami(b, "whoami", CallOption{HashKey: key})
+			assert.Equal(t, "A", name)
+		}
+
+		//非幂等调用直接返回错误
+		_, err := whoami(b, "close", CallOption{HashKey: key})
+		assert.Equal(t, ErrChannelDisconnected, err)
+		waitAvailable(b, 2)
+
+		//幂等调用在另一个信道上重试
+		name, err := whoami(b, "close", CallOption{HashKey: key, Idempotent: true})
+		assert.Nil(t, err)
+		assert.Equal(t, "B", name)
+
+		b.Close()
+	}
+
+	serverA.stop()
+}
+
+//SendRequest时信道断开,调用的回调先于SendRequest返回错误执行
+type disconnectChannel struct {
+	uid    uint64
+	client *RPCClient
+}
+
+func (this *disconnectChannel) SendRequest(message interface{}) error {
+	this.client.OnChannelDisconnect(this)
+	return kendynet.ErrSocketClose
+}
+
+func (this *disconnectChannel) SendResponse(message interface{}) error {
+	return kendynet.ErrSocketClose
+}
+
+func (this *disconnectChannel) Name() string {
+	return fmt.Sprintf("disconnectChannel:%d", this.uid)
+}
+
+func (this *disconnectChannel) UID() uint64 {
+	return this.uid
+}
+
+func TestBalancerCompleteOnce(t *testing.T) {
+	client := NewClient(&memCodec{}, &memCodec{})
+	b, err := NewBalancer(client, BalancerOption{SetupSession: func(kendynet.StreamSession) {}})
+	assert.Nil(t, err)
+
+	epA := &endpoint{name: "A", channel: &SessionChannel{}}
+	epB := &endpoint{name: "B", channel: &SessionChannel{}}
+	b.endpoints = []*endpoint{epA, epB}
+
+	call := func(_ RPCChannel, cb RPCResponseHandler) error {
+		return client.AsynCall(&disconnectChannel{uid: atomic.AddUint64(&memChannelUID, 1), client: client}, "hello", nil, time.Second, cb)
+	}
+
+	for _, idempotent := range []bool{false, true} {
+		var count int32
+		err = b.invoke(CallOption{Idempotent: idempotent}, 0, nil, call, func(_ interface{}, err error) {
+			atomic.AddInt32(&count, 1)
+			assert.Equal(t, ErrChannelDisconnected, err)
+		})
+
+		//回调已经应答,不再返回错误
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&epA.pending))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&epB.pending))
+		assert.Equal(t, 0, client.pendingCalls())
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server := NewRPCServer(&memCodec{}, &memCodec{})
+	client := NewClient(&memCodec{}, &memCodec{})
+	channel := newMemChannel(server, client)
+
+	replyerC := make(chan *RPCReplyer, 1)
+
+	server.RegisterMethod("slow", func(replyer *RPCReplyer, arg interface{}) {
+		go func() {
+			time.Sleep(time.Millisecond * 100)
+			replyer.Reply(arg, nil)
+		}()
+	})
+
+	server.RegisterMethod("block", func(replyer *RPCReplyer, arg interface{}) {
+		replyerC <- replyer
+	})
+
+	respC := make(chan error, 1)
+	assert.Nil(t, client.AsynCall(channel, "slow", "slow", time.Second, func(ret interface{}, err error) {
+		respC <- err
+	}))
+
+	client.AsynCall(channel, "block", nil, time.Second, func(interface{}, error) {})
+	replyer := <-replyerC
+
+	for server.PendingCount() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//进行中的请求未完成前超时
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+
+	//进行中的请求正常完成
+	assert.Nil(t, <-respC)
+	assert.Equal(t, int32(1), server.PendingCount())
+
+	//新的请求被拒绝
+	_, err := client.Call(channel, "slow", "slow", time.Second)
+	assert.Equal(t, ErrShuttingDown, err)
+	assert.Equal(t, CodeShuttingDown, Code(err))
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		replyer.DropResponse()
+	}()
+
+	assert.Nil(t, server.Shutdown(context.Background()))
+	assert.Equal(t, int32(0), server.PendingCount())
+	assert.Nil(t, server.Shutdown(context.Background()))
+}
@@ -1,20 +1,27 @@
 package rpc
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/util"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type RPCReplyer struct {
-	encoder RPCMessageEncoder
-	channel RPCChannel
-	req     *RPCRequest
-	fired   int32 //防止重复Reply
-	s       *RPCServer
+	encoder  RPCMessageEncoder
+	channel  RPCChannel
+	req      *RPCRequest
+	fired    int32 //防止重复Reply
+	s        *RPCServer
+	deadline time.Time
+	mu       sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	stream   *Stream
 }
 
 func (this *RPCReplyer) Reply(ret interface{}, err error) {
@@ -23,18 +30,70 @@ func (this *RPCReplyer) Reply(ret interface{}, err error) {
 			response := &RPCResponse{Seq: this.req.Seq, Ret: ret, Err: err}
 			this.reply(response)
 		}
-		atomic.AddInt32(&this.s.pendingCount, -1)
+		this.done()
+		this.s.onReplyerDone()
 	}
 }
 
 func (this *RPCReplyer) DropResponse() {
 	if atomic.CompareAndSwapInt32(&this.fired, 0, 1) {
+		this.done()
 		if nil != this.s {
-			atomic.AddInt32(&this.s.pendingCount, -1)
+			this.s.onReplyerDone()
 		}
 	}
 }
 
+func (this *RPCReplyer) done() {
+	this.mu.Lock()
+	cancel := this.cancel
+	this.mu.Unlock()
+	if nil != cancel {
+		cancel()
+	}
+
+	if nil != this.stream {
+		this.stream.finish(ErrStreamClosed, ErrStreamClosed, true)
+		if nil != this.s {
+			this.s.removeStream(this.stream)
+		}
+	}
+}
+
+/*
+ *  调用方的截止时间(根据RPCRequest.Timeout计算),ok为false表示调用方没有设置超时
+ */
+func (this *RPCReplyer) Deadline() (deadline time.Time, ok bool) {
+	return this.deadline, !this.deadline.IsZero()
+}
+
+/*
+ *  调用方是否已经放弃等待,此时Reply的结果将被调用方丢弃
+ */
+func (this *RPCReplyer) Expired() bool {
+	return !this.deadline.IsZero() && !time.Now().Before(this.deadline)
+}
+
+/*
+ *  返回与本次调用关联的context,在到达调用方截止时间或Reply/DropResponse之后被取消
+ */
+func (this *RPCReplyer) Context() context.Context {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if nil == this.ctx {
+		if this.deadline.IsZero() {
+			this.ctx, this.cancel = context.WithCancel(context.Background())
+		} else {
+			this.ctx, this.cancel = context.WithDeadline(context.Background(), this.deadline)
+		}
+
+		if atomic.LoadInt32(&this.fired) == 1 {
+			this.cancel()
+		}
+	}
+	return this.ctx
+}
+
 func (this *RPCReplyer) reply(response RPCMessage) {
 	msg, err := this.encoder.Encode(response)
 	if nil != err {
@@ -51,6 +110,10 @@ func (this *RPCReplyer) GetChannel() RPCChannel {
 	return this.channel
 }
 
+func (this *RPCReplyer) Method() string {
+	return this.req.Method
+}
+
 type RPCMethodHandler func(*RPCReplyer, interface{})
 
 type RPCServer struct {
@@ -61,20 +124,59 @@ type RPCServer struct {
 	lastSeq            uint64
 	pendingCount       int32
 	errOnMissingMethod atomic.Value
+	interceptors       []ServerInterceptor
+	streams            map[streamKey]*Stream
+	shuttingDown       int32
+	drainOnce          sync.Once
+	drainC             chan struct{}
 }
 
 func (this *RPCServer) PendingCount() int32 {
 	return atomic.LoadInt32(&this.pendingCount)
 }
 
+func (this *RPCServer) onReplyerDone() {
+	if atomic.AddInt32(&this.pendingCount, -1) == 0 && atomic.LoadInt32(&this.shuttingDown) == 1 {
+		this.drainOnce.Do(func() {
+			close(this.drainC)
+		})
+	}
+}
+
+/*
+ *  停止处理新的请求(以ErrShuttingDown响应),等待所有已接收请求的RPCReplyer执行Reply或DropResponse。
+ *
+ *  全部完成返回nil,ctx先到期则返回ctx.Err(),此时仍可再次调用Shutdown继续等待。
+ *  已建立的流式调用不受影响,直到其结束。
+ */
+func (this *RPCServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&this.shuttingDown, 1)
+
+	if atomic.LoadInt32(&this.pendingCount) == 0 {
+		this.drainOnce.Do(func() {
+			close(this.drainC)
+		})
+	}
+
+	select {
+	case <-this.drainC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+ *  errOnMissingMethod不是*Error时以CodeMissingMethod包装
+ */
 func (this *RPCServer) SetErrorCodeOnMissingMethod(errOnMissingMethod error) {
 	if nil != errOnMissingMethod {
-		this.errOnMissingMethod.Store(errOnMissingMethod)
+		this.errOnMissingMethod.Store(wrapError(errOnMissingMethod, CodeMissingMethod))
 	}
 }
 
 /*
- *  在服务停止的情况下直接向对端返回错误响应
+ *  在服务停止的情况下直接向对端返回错误响应,errorCode不是*Error时以CodeServiceStop包装
  */
 func (this *RPCServer) OnServiceStop(channel RPCChannel, message interface{}, errorCode error) {
 
@@ -88,6 +190,12 @@ func (this *RPCServer) OnServiceStop(channel RPCChannel, message interface{}, er
 	case *RPCRequest:
 		req := msg.(*RPCRequest)
 
+		if nil == errorCode {
+			errorCode = NewError(CodeServiceStop, "service stop")
+		} else {
+			errorCode = wrapError(errorCode, CodeServiceStop)
+		}
+
 		response := &RPCResponse{Seq: req.Seq, Err: errorCode}
 
 		msg, err := this.encoder.Encode(response)
@@ -123,10 +231,13 @@ func (this *RPCServer) UnRegisterMethod(name string) {
 func (this *RPCServer) callMethod(method RPCMethodHandler, replyer *RPCReplyer, arg interface{}) {
 	defer func() {
 		if r := recover(); r != nil {
-			replyer.Reply(nil, errors.New(fmt.Sprintf("%v", r)))
+			replyer.Reply(nil, Errorf(CodePanic, "%v", r))
 		}
 	}()
-	method(replyer, arg)
+	this.RLock()
+	interceptors := this.interceptors
+	this.RUnlock()
+	chainServerInterceptors(interceptors, method)(replyer, arg)
 }
 
 /*
@@ -138,29 +249,52 @@ func (this *RPCServer) OnRPCMessage(channel RPCChannel, message interface{}) {
 		kendynet.GetLogger().Error(util.FormatFileLine("RPCServer rpc message from(%s) decode err:%s\n", channel.Name(), err.Error()))
 		return
 	}
+	this.dispatch(channel, msg)
+}
 
+func (this *RPCServer) dispatch(channel RPCChannel, msg RPCMessage) {
 	switch msg.(type) {
 	case *RPCRequest:
 		{
 			req := msg.(*RPCRequest)
 			m, ok := this.methods.Load(req.Method)
 			replyer := &RPCReplyer{encoder: this.encoder, channel: channel, req: req, s: this}
+			if req.Timeout > 0 {
+				replyer.deadline = time.Now().Add(req.Timeout)
+			}
 			atomic.AddInt32(&this.pendingCount, 1)
 
+			//先计数再检查,保证Shutdown不会遗漏正在进入的请求
+			if atomic.LoadInt32(&this.shuttingDown) == 1 {
+				replyer.Reply(nil, ErrShuttingDown)
+				return
+			}
+
+			if req.StreamWindow > 0 {
+				s := newStream(req.Seq, channel, this.encoder, int(req.StreamWindow), false)
+				s.replyer = replyer
+				s.ctx = replyer.Context()
+				replyer.stream = s
+				this.Lock()
+				this.streams[streamKey{channelID: channel.UID(), seq: req.Seq}] = s
+				this.Unlock()
+			}
+
 			if !ok {
 				kendynet.GetLogger().Errorf(util.FormatFileLine("rpc request from(%s) invaild method %s\n", channel.Name(), req.Method))
 				errOnMissingMethod := this.errOnMissingMethod.Load()
 				if nil != errOnMissingMethod {
 					replyer.Reply(nil, errOnMissingMethod.(error))
 				} else {
-					replyer.Reply(nil, fmt.Errorf("invaild method:%s", req.Method))
+					replyer.Reply(nil, Errorf(CodeMissingMethod, "invaild method:%s", req.Method))
 				}
 			} else {
 				this.callMethod(m.(RPCMethodHandler), replyer, req.Arg)
 			}
 		}
+	case *RPCStream:
+		this.onStream(channel, msg.(*RPCStream))
 	}
-
 }
 
 func NewRPCServer(decoder RPCMessageDecoder, encoder RPCMessageEncoder) *RPCServer {
@@ -170,6 +304,8 @@ func NewRPCServer(decoder RPCMessageDecoder, encoder RPCMessageEncoder) *RPCServ
 		return &RPCServer{
 			decoder: decoder,
 			encoder: encoder,
+			streams: map[streamKey]*Stream{},
+			drainC:  make(chan struct{}),
 		}
 	}
 }
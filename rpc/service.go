@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var (
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+var ErrInvaildArgType error = NewError(CodeInvalidArgument, "invaild arg type")
+var ErrInvaildRetType error = NewError(CodeInvalidArgument, "invaild ret type")
+
+type serviceMethod struct {
+	method  reflect.Value
+	argType reflect.Type
+	retType reflect.Type
+}
+
+/*
+ *  func(context.Context, *Req) (*Resp, error)
+ */
+func checkServiceMethod(mtype reflect.Type) (argType reflect.Type, retType reflect.Type, ok bool) {
+	if mtype.NumIn() != 2 || mtype.NumOut() != 2 {
+		return
+	}
+
+	if mtype.In(0) != typeOfContext || mtype.Out(1) != typeOfError {
+		return
+	}
+
+	argType = mtype.In(1)
+	retType = mtype.Out(0)
+
+	if argType.Kind() != reflect.Ptr || retType.Kind() != reflect.Ptr {
+		return
+	}
+
+	ok = true
+	return
+}
+
+func (this *serviceMethod) call(replyer *RPCReplyer, arg interface{}) {
+	var argv reflect.Value
+	if nil == arg {
+		argv = reflect.Zero(this.argType)
+	} else if reflect.TypeOf(arg) != this.argType {
+		replyer.Reply(nil, fmt.Errorf("%w:%s", ErrInvaildArgType, reflect.TypeOf(arg).String()))
+		return
+	} else {
+		argv = reflect.ValueOf(arg)
+	}
+
+	out := this.method.Call([]reflect.Value{reflect.ValueOf(replyer.Context()), argv})
+
+	var ret interface{}
+	var err error
+
+	if !out[0].IsNil() {
+		ret = out[0].Interface()
+	}
+
+	if !out[1].IsNil() {
+		err = out[1].Interface().(error)
+	}
+
+	replyer.Reply(ret, err)
+}
+
+/*
+ *  将rcvr中所有形如 func(ctx context.Context, arg *Req) (*Resp, error) 的导出方法注册为"服务名.方法名",
+ *  服务名默认为rcvr的类型名,可通过name指定。不符合上述签名的方法被忽略。
+ *
+ *  arg的类型与注册类型不一致时直接向调用方返回ErrInvaildArgType,ctx由RPCReplyer.Context()提供。
+ *
+ *  注意:方法在OnRPCMessage的调用goroutine上同步执行,如需调用阻塞函数请自行处理。
+ */
+func (this *RPCServer) RegisterService(rcvr interface{}, name ...string) error {
+	if nil == rcvr {
+		return errors.New("rcvr == nil")
+	}
+
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+
+	serviceName := reflect.Indirect(v).Type().Name()
+	if len(name) > 0 {
+		serviceName = name[0]
+	}
+
+	if serviceName == "" {
+		return fmt.Errorf("no service name for type %s", t.String())
+	}
+
+	methods := map[string]*serviceMethod{}
+
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if m.PkgPath != "" {
+			continue
+		}
+
+		method := v.Method(i)
+
+		if argType, retType, ok := checkServiceMethod(method.Type()); ok {
+			methods[serviceName+"."+m.Name] = &serviceMethod{
+				method:  method,
+				argType: argType,
+				retType: retType,
+			}
+		}
+	}
+
+	if len(methods) == 0 {
+		return fmt.Errorf("type %s has no suitable method", t.String())
+	}
+
+	for k := range methods {
+		if _, ok := this.methods.Load(k); ok {
+			return fmt.Errorf("duplicate method:%s", k)
+		}
+	}
+
+	for k, m := range methods {
+		if err := this.RegisterMethod(k, m.call); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ *  Stub绑定方法名与参数/返回值类型,在调用处检查参数类型,
+ *  调用成功时返回值的类型保证与ret一致,可直接断言
+ */
+type Stub struct {
+	client  *RPCClient
+	method  string
+	argType reflect.Type
+	retType reflect.Type
+}
+
+/*
+ *  arg与ret为参数及返回值的原型,例如 NewStub("Echo.Hello", &HelloReq{}, &HelloResp{})
+ */
+func (this *RPCClient) NewStub(method string, arg interface{}, ret interface{}) (*Stub, error) {
+	if method == "" {
+		return nil, errors.New("method is empty")
+	}
+
+	if nil == arg || reflect.TypeOf(arg).Kind() != reflect.Ptr {
+		return nil, ErrInvaildArgType
+	}
+
+	if nil == ret || reflect.TypeOf(ret).Kind() != reflect.Ptr {
+		return nil, ErrInvaildRetType
+	}
+
+	return &Stub{
+		client:  this,
+		method:  method,
+		argType: reflect.TypeOf(arg),
+		retType: reflect.TypeOf(ret),
+	}, nil
+}
+
+func (this *Stub) Method() string {
+	return this.method
+}
+
+func (this *Stub) checkArg(arg interface{}) error {
+	if nil != arg && reflect.TypeOf(arg) != this.argType {
+		return fmt.Errorf("%w:%s", ErrInvaildArgType, reflect.TypeOf(arg).String())
+	} else {
+		return nil
+	}
+}
+
+func (this *Stub) wrapCallback(cb RPCResponseHandler) RPCResponseHandler {
+	return func(ret interface{}, err error) {
+		cb(this.checkRet(ret, err))
+	}
+}
+
+func (this *Stub) AsynCall(channel RPCChannel, arg interface{}, timeout time.Duration, cb RPCResponseHandler) error {
+	if err := this.checkArg(arg); nil != err {
+		return err
+	}
+	if nil == cb {
+		return errors.New("cb == nil")
+	}
+	return this.client.AsynCall(channel, this.method, arg, timeout, this.wrapCallback(cb))
+}
+
+func (this *Stub) AsynCallContext(ctx context.Context, channel RPCChannel, arg interface{}, cb RPCResponseHandler) error {
+	if err := this.checkArg(arg); nil != err {
+		return err
+	}
+	if nil == cb {
+		return errors.New("cb == nil")
+	}
+	return this.client.AsynCallContext(ctx, channel, this.method, arg, this.wrapCallback(cb))
+}
+
+//同步调用
+func (this *Stub) Call(channel RPCChannel, arg interface{}, timeout time.Duration) (interface{}, error) {
+	if err := this.checkArg(arg); nil != err {
+		return nil, err
+	}
+	ret, err := this.client.Call(channel, this.method, arg, timeout)
+	return this.checkRet(ret, err)
+}
+
+//同步调用,可通过ctx取消
+func (this *Stub) CallContext(ctx context.Context, channel RPCChannel, arg interface{}) (interface{}, error) {
+	if err := this.checkArg(arg); nil != err {
+		return nil, err
+	}
+	ret, err := this.client.CallContext(ctx, channel, this.method, arg)
+	return this.checkRet(ret, err)
+}
+
+func (this *Stub) checkRet(ret interface{}, err error) (interface{}, error) {
+	if nil == err && nil != ret && reflect.TypeOf(ret) != this.retType {
+		return nil, fmt.Errorf("%w:%s", ErrInvaildRetType, reflect.TypeOf(ret).String())
+	} else {
+		return ret, err
+	}
+}
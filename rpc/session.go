@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/util"
+	"sync/atomic"
+)
+
+var channelUID uint64
+
+/*
+ *  将kendynet.StreamSession包装成RPCChannel
+ *
+ *  收到的消息只解码一次,请求及客户端发出的流数据帧交给server,响应及服务端发出的流数据帧交给client,
+ *  server与client可以只提供其中之一,此时发往另一方的消息被丢弃。
+ *
+ *  session关闭时依次调用client及server的OnChannelDisconnect。
+ */
+type SessionChannel struct {
+	session   kendynet.StreamSession
+	server    *RPCServer
+	client    *RPCClient
+	decoder   RPCMessageDecoder
+	name      string
+	uid       uint64
+	onClose   func(kendynet.StreamSession, error)
+	closeFlag int32
+}
+
+/*
+ *  session的编码器与InBoundProcessor需由调用方设置,该函数会占用session的关闭回调,
+ *  如需在关闭时执行其它处理请使用SessionChannel.SetCloseCallBack
+ */
+func NewSessionChannel(session kendynet.StreamSession, server *RPCServer, client *RPCClient) (*SessionChannel, error) {
+	if nil == session {
+		return nil, errors.New("session == nil")
+	}
+
+	if nil == server && nil == client {
+		return nil, errors.New("server and client are both nil")
+	}
+
+	c := &SessionChannel{
+		session: session,
+		server:  server,
+		client:  client,
+		name:    session.RemoteAddr().String() + "<->" + session.LocalAddr().String(),
+		uid:     atomic.AddUint64(&channelUID, 1),
+	}
+
+	if nil != server {
+		c.decoder = server.decoder
+	} else {
+		c.decoder = client.decoder
+	}
+
+	session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+		c.onDisconnect(reason)
+	})
+
+	return c, nil
+}
+
+func (this *SessionChannel) SendRequest(message interface{}) error {
+	return this.session.Send(message)
+}
+
+func (this *SessionChannel) SendResponse(message interface{}) error {
+	return this.session.Send(message)
+}
+
+func (this *SessionChannel) Name() string {
+	return this.name
+}
+
+//进程内单调递增,不会因对象地址复用而重复
+func (this *SessionChannel) UID() uint64 {
+	return this.uid
+}
+
+func (this *SessionChannel) GetSession() kendynet.StreamSession {
+	return this.session
+}
+
+/*
+ *  session关闭且OnChannelDisconnect执行完之后回调
+ */
+func (this *SessionChannel) SetCloseCallBack(cb func(kendynet.StreamSession, error)) *SessionChannel {
+	this.onClose = cb
+	return this
+}
+
+/*
+ *  以OnRPCMessage作为消息回调开始接收
+ */
+func (this *SessionChannel) BeginRecv() error {
+	return this.session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+		this.OnRPCMessage(msg)
+	})
+}
+
+func (this *SessionChannel) OnRPCMessage(message interface{}) {
+	msg, err := this.decoder.Decode(message)
+	if nil != err {
+		kendynet.GetLogger().Error(util.FormatFileLine("SessionChannel rpc message from(%s) decode err:%s\n", this.name, err.Error()))
+		return
+	}
+
+	toServer := false
+	switch msg.(type) {
+	case *RPCRequest:
+		toServer = true
+	case *RPCStream:
+		toServer = msg.(*RPCStream).FromClient
+	}
+
+	if toServer {
+		if nil != this.server {
+			this.server.dispatch(this, msg)
+		} else {
+			kendynet.GetLogger().Errorf(util.FormatFileLine("SessionChannel(%s) drop rpc message seq:%d,no server\n", this.name, msg.GetSeq()))
+		}
+	} else {
+		if nil != this.client {
+			this.client.dispatch(msg)
+		} else {
+			kendynet.GetLogger().Errorf(util.FormatFileLine("SessionChannel(%s) drop rpc message seq:%d,no client\n", this.name, msg.GetSeq()))
+		}
+	}
+}
+
+func (this *SessionChannel) onDisconnect(reason error) {
+	if !atomic.CompareAndSwapInt32(&this.closeFlag, 0, 1) {
+		return
+	}
+
+	if nil != this.client {
+		this.client.OnChannelDisconnect(this)
+	}
+
+	if nil != this.server {
+		this.server.OnChannelDisconnect(this)
+	}
+
+	if nil != this.onClose {
+		this.onClose(this.session, reason)
+	}
+}
@@ -0,0 +1,426 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/util"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultStreamWindow = 64
+
+var ErrStreamClosed = errors.New("stream closed")
+var ErrStreamCanceled error = NewError(CodeCanceled, "stream canceled by peer")
+
+/*
+ *  流式调用
+ *
+ *  客户端通过OpenStream发起流式调用,服务端在方法中通过RPCReplyer.Stream()获取对应的Stream,双方均可Send/Recv。
+ *
+ *  流控:双方的初始发送窗口均为RPCRequest.StreamWindow,每发送一个数据帧消耗一个额度,额度耗尽时Send阻塞。
+ *  接收方每通过Recv取走一半窗口的数据帧向对端归还额度,因此消费缓慢的一方不会导致对端无限制的向信道发送数据。
+ *
+ *  结束:
+ *  客户端CloseSend表示不再发送数据,服务端此后的Recv返回io.EOF。
+ *  服务端CloseSend(或直接Reply)结束整个流,客户端的Recv在取完已收到的数据后返回io.EOF(或Reply的错误)。
+ *  任意一方Cancel立即终止流,对端的Send/Recv返回ErrStreamCanceled。
+ *
+ *  注意:Send/Recv可能阻塞,不能在底层信道的接收goroutine上调用。
+ *  使用流式调用要求编解码器支持RPC_STREAM消息及RPCRequest.StreamWindow字段。
+ */
+type Stream struct {
+	seq        uint64
+	channel    RPCChannel
+	encoder    RPCMessageEncoder
+	fromClient bool //本端是否客户端
+	window     int
+	ctx        context.Context
+	mu         sync.Mutex
+	notifyC    chan struct{} //状态变更时关闭并替换,唤醒所有等待者
+	doneC      chan struct{}
+	done       bool
+	recvQ      []interface{}
+	recvDone   bool
+	recvErr    error
+	consumed   int
+	credit     int
+	sendErr    error
+	replyer    *RPCReplyer //服务端
+	client     *RPCClient  //客户端
+}
+
+func newStream(seq uint64, channel RPCChannel, encoder RPCMessageEncoder, window int, fromClient bool) *Stream {
+	return &Stream{
+		seq:        seq,
+		channel:    channel,
+		encoder:    encoder,
+		fromClient: fromClient,
+		window:     window,
+		credit:     window,
+		notifyC:    make(chan struct{}),
+		doneC:      make(chan struct{}),
+	}
+}
+
+func (this *Stream) Context() context.Context {
+	return this.ctx
+}
+
+func (this *Stream) notifyLocked() {
+	close(this.notifyC)
+	this.notifyC = make(chan struct{})
+}
+
+//调用前持有锁,返回时重新持有锁
+func (this *Stream) waitLocked() error {
+	notifyC := this.notifyC
+	this.mu.Unlock()
+	var err error
+	select {
+	case <-notifyC:
+	case <-this.ctx.Done():
+		err = contextError(this.ctx.Err())
+		if this.fromClient {
+			//不等待watch goroutine,立即终止流
+			this.cancel(err)
+		}
+	}
+	this.mu.Lock()
+	return err
+}
+
+func (this *Stream) send(msg *RPCStream) error {
+	msg.Seq = this.seq
+	msg.FromClient = this.fromClient
+	if m, err := this.encoder.Encode(msg); nil != err {
+		return err
+	} else if this.fromClient {
+		return this.channel.SendRequest(m)
+	} else {
+		return this.channel.SendResponse(m)
+	}
+}
+
+/*
+ *  发送一个数据帧,发送窗口耗尽时阻塞直到对端归还额度或流结束
+ */
+func (this *Stream) Send(data interface{}) error {
+	this.mu.Lock()
+	for {
+		if nil != this.sendErr {
+			err := this.sendErr
+			this.mu.Unlock()
+			return err
+		} else if this.credit > 0 {
+			this.credit--
+			this.mu.Unlock()
+			return this.send(&RPCStream{Flag: StreamData, Data: data})
+		} else if err := this.waitLocked(); nil != err {
+			this.mu.Unlock()
+			return err
+		}
+	}
+}
+
+/*
+ *  接收一个数据帧,对端正常结束后返回io.EOF
+ */
+func (this *Stream) Recv() (interface{}, error) {
+	this.mu.Lock()
+	for {
+		if len(this.recvQ) > 0 {
+			data := this.recvQ[0]
+			this.recvQ[0] = nil
+			this.recvQ = this.recvQ[1:]
+			var window int
+			if !this.recvDone {
+				this.consumed++
+				if this.consumed*2 >= this.window {
+					window = this.consumed
+					this.consumed = 0
+				}
+			}
+			this.mu.Unlock()
+
+			if window > 0 {
+				if err := this.send(&RPCStream{Flag: StreamWindow, Window: uint32(window)}); nil != err {
+					kendynet.GetLogger().Errorf(util.FormatFileLine("send stream window to (%s) error:%s\n", this.channel.Name(), err.Error()))
+				}
+			}
+
+			return data, nil
+		} else if this.recvDone {
+			err := this.recvErr
+			this.mu.Unlock()
+			if nil == err {
+				err = io.EOF
+			}
+			return nil, err
+		} else if err := this.waitLocked(); nil != err {
+			this.mu.Unlock()
+			return nil, err
+		}
+	}
+}
+
+/*
+ *  客户端:通知服务端不再发送数据
+ *  服务端:结束整个流,等价于replyer.Reply(nil, nil),如需以错误结束可直接调用Reply
+ */
+func (this *Stream) CloseSend() error {
+	if !this.fromClient {
+		this.replyer.Reply(nil, nil)
+		return nil
+	}
+
+	this.mu.Lock()
+	if nil != this.sendErr {
+		err := this.sendErr
+		this.mu.Unlock()
+		return err
+	}
+	this.sendErr = ErrStreamClosed
+	this.notifyLocked()
+	this.mu.Unlock()
+
+	return this.send(&RPCStream{Flag: StreamEnd})
+}
+
+/*
+ *  终止流并通知对端,本端此后的Send/Recv返回context.Canceled
+ */
+func (this *Stream) Cancel() {
+	this.cancel(context.Canceled)
+}
+
+func (this *Stream) cancel(err error) {
+	if this.fromClient {
+		if !this.client.removeStream(this) {
+			return
+		}
+	} else if atomic.LoadInt32(&this.replyer.fired) == 1 {
+		return
+	}
+
+	this.send(&RPCStream{Flag: StreamCancel})
+	this.finish(err, err, true)
+
+	if !this.fromClient {
+		this.replyer.DropResponse()
+	}
+}
+
+/*
+ *  recvErr:取完接收队列后Recv返回的错误
+ *  sendErr:Send返回的错误
+ *  drop:是否丢弃尚未取走的数据
+ */
+func (this *Stream) finish(recvErr error, sendErr error, drop bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.done {
+		return
+	}
+	this.done = true
+	this.recvDone = true
+	this.recvErr = recvErr
+	this.sendErr = sendErr
+	if drop {
+		this.recvQ = nil
+	}
+	close(this.doneC)
+	this.notifyLocked()
+}
+
+func (this *Stream) onFrame(msg *RPCStream) {
+	switch msg.Flag {
+	case StreamData:
+		this.mu.Lock()
+		if !this.recvDone {
+			this.recvQ = append(this.recvQ, msg.Data)
+			this.notifyLocked()
+		}
+		this.mu.Unlock()
+	case StreamWindow:
+		this.mu.Lock()
+		this.credit += int(msg.Window)
+		this.notifyLocked()
+		this.mu.Unlock()
+	case StreamEnd:
+		//只有客户端会发送End,服务端通过Reply结束
+		this.mu.Lock()
+		if !this.recvDone {
+			this.recvDone = true
+			this.recvErr = msg.Err
+			this.notifyLocked()
+		}
+		this.mu.Unlock()
+	case StreamCancel:
+		if this.fromClient {
+			if this.client.removeStream(this) {
+				this.finish(ErrStreamCanceled, ErrStreamCanceled, true)
+			}
+		} else {
+			this.finish(ErrStreamCanceled, ErrStreamCanceled, true)
+			this.replyer.DropResponse()
+		}
+	}
+}
+
+/*
+ *  服务端:返回流式调用对应的Stream,非流式调用返回nil
+ */
+func (this *RPCReplyer) Stream() *Stream {
+	return this.stream
+}
+
+/*
+ *  发起流式调用,window为双方的初始发送窗口(默认DefaultStreamWindow)。
+ *
+ *  ctx被取消或到达截止时间时流被终止,ctx的剩余时间传递给服务端
+ */
+func (this *RPCClient) OpenStream(ctx context.Context, channel RPCChannel, method string, arg interface{}, window ...int) (*Stream, error) {
+	if nil == ctx {
+		return nil, errors.New("ctx == nil")
+	}
+
+	w := DefaultStreamWindow
+	if len(window) > 0 && window[0] > 0 {
+		w = window[0]
+	}
+
+	var stream *Stream
+
+	err := this.invoke(ctx, channel, method, arg, func(interface{}, error) {}, func(ctx context.Context, channel RPCChannel, method string, arg interface{}, cb RPCResponseHandler) error {
+		var timeout time.Duration
+		if deadline, ok := ctx.Deadline(); ok {
+			if timeout = time.Until(deadline); timeout <= 0 {
+				return ErrCallTimeout
+			}
+		}
+
+		if err := ctx.Err(); nil != err {
+			return contextError(err)
+		}
+
+		req := &RPCRequest{
+			Method:       method,
+			Seq:          atomic.AddUint64(&sequence, 1),
+			Arg:          arg,
+			NeedResp:     true,
+			Timeout:      timeout,
+			StreamWindow: uint32(w),
+		}
+
+		s := newStream(req.Seq, channel, this.encoder, w, true)
+		s.ctx = ctx
+		s.client = this
+
+		this.mu.Lock()
+		this.streams[s.seq] = s
+		this.mu.Unlock()
+
+		//流的超时与取消由下面的goroutine负责,不设置定时器
+		err := this.call(nil, channel, req, 0, func(ret interface{}, err error) {
+			cb(ret, err)
+			if this.removeStream(s) {
+				if err == ErrChannelDisconnected {
+					s.finish(err, err, true)
+				} else {
+					s.finish(err, ErrStreamClosed, false)
+				}
+			}
+		})
+
+		if nil != err {
+			this.removeStream(s)
+			return err
+		}
+
+		stream = s
+
+		if nil != ctx.Done() {
+			go func() {
+				select {
+				case <-ctx.Done():
+					s.cancel(contextError(ctx.Err()))
+				case <-s.doneC:
+				}
+			}()
+		}
+
+		return nil
+	})
+
+	return stream, err
+}
+
+//从RPCClient中移除流及对应的调用,返回false表示流已经被移除
+func (this *RPCClient) removeStream(s *Stream) bool {
+	this.mu.Lock()
+	_, ok := this.streams[s.seq]
+	if ok {
+		delete(this.streams, s.seq)
+	}
+	this.mu.Unlock()
+
+	if ok {
+		if call := this.removeCallBySeqno(s.seq); nil != call {
+			releaseCallContext(call)
+		}
+	}
+
+	return ok
+}
+
+func (this *RPCClient) onStream(msg *RPCStream) {
+	this.mu.Lock()
+	s, ok := this.streams[msg.Seq]
+	this.mu.Unlock()
+	if ok {
+		s.onFrame(msg)
+	}
+}
+
+type streamKey struct {
+	channelID uint64
+	seq       uint64
+}
+
+func (this *RPCServer) onStream(channel RPCChannel, msg *RPCStream) {
+	this.RLock()
+	s, ok := this.streams[streamKey{channelID: channel.UID(), seq: msg.Seq}]
+	this.RUnlock()
+	if ok {
+		s.onFrame(msg)
+	}
+}
+
+func (this *RPCServer) removeStream(s *Stream) {
+	this.Lock()
+	delete(this.streams, streamKey{channelID: s.channel.UID(), seq: s.seq})
+	this.Unlock()
+}
+
+/*
+ *  信道断开时终止该信道上所有的服务端流
+ */
+func (this *RPCServer) OnChannelDisconnect(channel RPCChannel) {
+	var streams []*Stream
+	this.RLock()
+	for k, v := range this.streams {
+		if k.channelID == channel.UID() {
+			streams = append(streams, v)
+		}
+	}
+	this.RUnlock()
+
+	for _, v := range streams {
+		v.finish(ErrChannelDisconnected, ErrChannelDisconnected, true)
+		v.replyer.DropResponse()
+	}
+}
@@ -7,11 +7,14 @@ import (
 	"fmt"
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/buffer"
+	"github.com/sniperHW/kendynet/socket"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
 	"net"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -617,6 +620,239 @@ func TestShutDownRead(t *testing.T) {
 
 }
 
+func TestSendQueueOption(t *testing.T) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8153")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, _ := net.Dial("tcp", "localhost:8153")
+	peer := <-accepted
+	session := NewSocket(aioService, conn)
+
+	high := make(chan struct{}, 1)
+	low := make(chan struct{}, 1)
+
+	assert.Nil(t, session.(*Socket).SetSendQueueOption(socket.SendQueueOption{
+		HighWatermark:   10,
+		LowWatermark:    2,
+		OnHighWatermark: func() { high <- struct{}{} },
+		OnLowWatermark:  func() { low <- struct{}{} },
+	}))
+
+	assert.Nil(t, session.Send([]byte(strings.Repeat("a", 20))))
+	<-high
+
+	b := make([]byte, 20)
+	io.ReadFull(peer, b)
+	assert.Equal(t, strings.Repeat("a", 20), string(b))
+
+	//写入完成之后释放计入水位的字节数
+	select {
+	case <-low:
+	case <-time.After(time.Second):
+		t.Fatal("low watermark not reached")
+	}
+	assert.Equal(t, 0, session.(*Socket).Stats().SendQueueBytes)
+
+	session.Close(nil, 0)
+	peer.Close()
+	listener.Close()
+}
+
+func TestSendPriority(t *testing.T) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8151")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		session := NewSocket(aioService, conn)
+		//发送任务启动前加入队列的消息在同一批次中按优先级排列
+		session.(*Socket).sendQueue.Add([]byte("b"))
+		session.(*Socket).sendQueue.AddWithPriority([]byte("a"), 1)
+		session.(*Socket).sendQueue.AddWithPriority([]byte("d"), 3)
+		session.(socket.PrioritySender).SendWithPriority([]byte("c"), 0)
+		session.Close(nil, time.Second)
+	}()
+
+	conn, _ := net.Dial("tcp", "localhost:8151")
+	b, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, "dabc", string(b))
+	conn.Close()
+	listener.Close()
+}
+
+type buffersEncoder struct {
+	encoder
+}
+
+func (this *buffersEncoder) EnCodeBuffers(o interface{}, bufs net.Buffers) (net.Buffers, error) {
+	switch o.(type) {
+	case string:
+		s := o.(string)
+		return append(bufs, []byte{byte(len(s))}, []byte(s)), nil
+	default:
+		return bufs, errors.New("invaild o")
+	}
+}
+
+func TestWritev(t *testing.T) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8154")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	big := []byte(strings.Repeat("x", socket.BorrowThreshold*4))
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		session := NewSocket(aioService, conn)
+		//aio会话不使用writev,BuffersEnCoder只使用其EnCode
+		session.SetEncoder(&buffersEncoder{})
+		session.Send([]byte("head"))
+		session.Send(big)
+		session.Send("hello")
+		session.Send(1) //编码错误
+		session.Send([]byte("tail"))
+		session.Close(nil, time.Second)
+	}()
+
+	conn, _ := net.Dial("tcp", "localhost:8154")
+	b, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, "head"+string(big)+"hello"+"tail", string(b))
+	conn.Close()
+	listener.Close()
+}
+
+func TestSendCallback(t *testing.T) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8152")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	//写入完成及编码错误
+	{
+		conn, _ := net.Dial("tcp", "localhost:8152")
+		peer := <-accepted
+		session := NewSocket(aioService, conn)
+		session.SetEncoder(&encoder{})
+
+		results := make(chan error, 2)
+		cb := func(err error) {
+			results <- err
+		}
+
+		assert.Nil(t, session.(socket.CallbackSender).SendWithCallback("hello", cb))
+		assert.Nil(t, session.(socket.CallbackSender).SendWithCallback(1, cb))
+
+		got := []error{<-results, <-results}
+		assert.Contains(t, got, nil)
+		assert.Contains(t, got, errors.New("invaild o"))
+
+		b := make([]byte, 5)
+		io.ReadFull(peer, b)
+		assert.Equal(t, "hello", string(b))
+
+		session.Close(nil, 0)
+		//关闭之后不再加入队列,不调用回调
+		assert.Equal(t, kendynet.ErrSocketClose, session.(socket.CallbackSender).SendWithCallback("hello", cb))
+		peer.Close()
+	}
+
+	//发送超时
+	{
+		conn, _ := net.Dial("tcp", "localhost:8152")
+		peer := <-accepted //不读取
+		session := NewSocket(aioService, conn)
+		session.SetSendTimeout(time.Millisecond * 100)
+
+		closed := make(chan error, 1)
+		session.SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+			closed <- reason
+		})
+
+		var mu sync.Mutex
+		var results []error
+		var wg sync.WaitGroup
+
+		//发送队列满时返回错误,不调用回调
+		for i := 0; i < 1000; i++ {
+			wg.Add(1)
+			if nil != session.(socket.CallbackSender).SendWithCallback(make([]byte, 64*1024), func(err error) {
+				mu.Lock()
+				results = append(results, err)
+				mu.Unlock()
+				wg.Done()
+			}) {
+				wg.Done()
+			}
+		}
+
+		//没有设置errorCallback,发送超时关闭会话
+		assert.Equal(t, kendynet.ErrSendTimeout, <-closed)
+		wg.Wait()
+
+		mu.Lock()
+		assert.Contains(t, results, kendynet.ErrSendTimeout)
+		mu.Unlock()
+		peer.Close()
+	}
+
+	//关闭时尚未发送
+	{
+		conn, _ := net.Dial("tcp", "localhost:8152")
+		peer := <-accepted //不读取
+		session := NewSocket(aioService, conn)
+
+		var mu sync.Mutex
+		var results []error
+		var wg sync.WaitGroup
+
+		for i := 0; i < 1000; i++ {
+			wg.Add(1)
+			if nil != session.(socket.CallbackSender).SendWithCallback(make([]byte, 64*1024), func(err error) {
+				mu.Lock()
+				results = append(results, err)
+				mu.Unlock()
+				wg.Done()
+			}) {
+				wg.Done()
+			}
+		}
+
+		time.Sleep(time.Millisecond * 100)
+		session.Close(nil, 0)
+		wg.Wait()
+
+		mu.Lock()
+		assert.Contains(t, results, kendynet.ErrSocketClose)
+		mu.Unlock()
+		peer.Close()
+	}
+
+	listener.Close()
+}
+
 func TestFinal(t *testing.T) {
 	aioService.Close()
 }
@@ -159,8 +159,16 @@ type Socket struct {
 	swaped           []interface{}
 	sendTimeout      int64
 	recvTimeout      int64
+	heartbeat        *socket.Heartbeat
+	closeNotify      socket.CloseNotify
+	metrics          *socket.SessionMetrics
+	swapedCBs        []func(error)
+	sendCBs          []func(error) //当前批次等待写入完成的回调
 }
 
+var _ socket.PrioritySender = &Socket{}
+var _ socket.CallbackSender = &Socket{}
+
 func (s *Socket) IsClosed() bool {
 	return s.flag.AtomicTest(fclosed)
 }
@@ -175,6 +183,21 @@ func (s *Socket) SetSendQueueSize(size int) kendynet.StreamSession {
 	return s
 }
 
+/*
+ *  设置发送队列的溢出策略及水位回调,必须在Send之前调用。
+ *  OverflowClose策略下队列满时会话以kendynet.ErrSlowConsumer关闭,Send返回kendynet.ErrSlowConsumer
+ */
+func (s *Socket) SetSendQueueOption(option socket.SendQueueOption) error {
+	onDrop := option.OnDrop
+	option.OnDrop = func(o interface{}) {
+		s.metrics.Add(socket.MetricSendDrops, 1)
+		if nil != onDrop {
+			onDrop(o)
+		}
+	}
+	return s.sendQueue.SetOption(option)
+}
+
 func (this *Socket) SetRecvTimeout(timeout time.Duration) kendynet.StreamSession {
 	atomic.StoreInt64(&this.recvTimeout, int64(timeout))
 	return this
@@ -203,6 +226,13 @@ func (s *Socket) SetCloseCallBack(cb func(kendynet.StreamSession, error)) kendyn
 	return s
 }
 
+/*
+ *  在关闭回调之后调用fn,与SetCloseCallBack互不覆盖。会话已经关闭时立即调用
+ */
+func (s *Socket) NotifyClose(fn func(kendynet.StreamSession, error)) {
+	s.closeNotify.Add(s, fn)
+}
+
 func (s *Socket) SetUserData(ud interface{}) kendynet.StreamSession {
 	s.ud.Store(ud)
 	return s
@@ -237,6 +267,7 @@ func (s *Socket) onRecvComplete(r *goaio.AIOResult) {
 		if nil != r.Err {
 			if r.Err == goaio.ErrRecvTimeout {
 				r.Err = kendynet.ErrRecvTimeout
+				s.metrics.Add(socket.MetricRecvTimeouts, 1)
 				recvAgain = true
 			} else {
 				s.flag.AtomicSet(frclosed)
@@ -249,6 +280,7 @@ func (s *Socket) onRecvComplete(r *goaio.AIOResult) {
 			}
 
 		} else {
+			s.metrics.Add(socket.MetricBytesIn, int64(r.Bytestransfer))
 			s.inboundProcessor.OnData(r.Buff[:r.Bytestransfer])
 			for !s.flag.AtomicTest(fclosed | frclosed) {
 				msg, err := s.inboundProcessor.Unpack()
@@ -259,6 +291,7 @@ func (s *Socket) onRecvComplete(r *goaio.AIOResult) {
 					}
 					break
 				} else if nil != msg {
+					s.metrics.Add(socket.MetricMessagesIn, 1)
 					s.inboundCallBack(s, msg)
 				} else {
 					recvAgain = true
@@ -280,19 +313,40 @@ func (s *Socket) doSend(b *buffer.Buffer) {
 		s.sendContext.b = b
 	}
 
+	/*
+	 *  goaio没有提供vectored send,aio会话不使用writev,
+	 *  一批消息总是拷贝合并到b中以一次Send1发送,BuffersEnCoder只使用其EnCode
+	 */
 	if b.Len() == 0 {
-		_, s.swaped = s.sendQueue.Get(s.swaped)
+		_, s.swaped, s.swapedCBs = s.sendQueue.GetWithCallbacks(s.swaped, s.swapedCBs)
 
 		for i := 0; i < len(s.swaped); i++ {
+			var cb func(error)
+			if len(s.swapedCBs) > 0 {
+				cb, s.swapedCBs[i] = s.swapedCBs[i], nil
+			}
+
 			l := b.Len()
+			var err error
 			switch s.swaped[i].(type) {
 			case []byte:
 				b.AppendBytes(s.swaped[i].([]byte))
 			default:
-				if err := s.encoder.EnCode(s.swaped[i], b); nil != err {
-					//EnCode错误，这个包已经写入到b中的内容需要直接丢弃
-					b.SetLen(l)
-					kendynet.GetLogger().Errorf("encode error:%v", err)
+				err = s.encoder.EnCode(s.swaped[i], b)
+			}
+
+			if nil != err {
+				//EnCode错误，这个包已经写入到b中的内容需要直接丢弃
+				b.SetLen(l)
+				kendynet.GetLogger().Errorf("encode error:%v", err)
+				s.metrics.Add(socket.MetricEncodeErrors, 1)
+				if nil != cb {
+					cb(err)
+				}
+			} else {
+				s.metrics.Add(socket.MetricMessagesOut, 1)
+				if nil != cb {
+					s.sendCBs = append(s.sendCBs, cb)
 				}
 			}
 			s.swaped[i] = nil
@@ -306,6 +360,15 @@ func (s *Socket) doSend(b *buffer.Buffer) {
 	}
 }
 
+//以err调用当前批次的完成回调
+func (s *Socket) notifySendResult(err error) {
+	for i, cb := range s.sendCBs {
+		cb(err)
+		s.sendCBs[i] = nil
+	}
+	s.sendCBs = s.sendCBs[:0]
+}
+
 func (s *Socket) SendWithTimeout(o interface{}, timeout time.Duration) error {
 	if o == nil {
 		return kendynet.ErrInvaildObject
@@ -318,6 +381,9 @@ func (s *Socket) SendWithTimeout(o interface{}, timeout time.Duration) error {
 				err = kendynet.ErrSendQueFull
 			} else if err == socket.ErrAddTimeout {
 				err = kendynet.ErrSendTimeout
+			} else if err == socket.ErrQueueOverflow {
+				err = kendynet.ErrSlowConsumer
+				s.Close(err, 0)
 			} else {
 				err = kendynet.ErrSocketClose
 			}
@@ -350,8 +416,10 @@ func (s *Socket) DirectSend(bytes []byte, timeout ...time.Duration) (int, error)
 		cb: func(res *goaio.AIOResult, _ *buffer.Buffer) {
 			n = res.Bytestransfer
 			err = res.Err
+			s.metrics.Add(socket.MetricBytesOut, int64(n))
 			if err == goaio.ErrSendTimeout {
 				err = kendynet.ErrSendTimeout
+				s.metrics.Add(socket.MetricSendTimeouts, 1)
 			}
 			close(ch)
 		},
@@ -368,17 +436,50 @@ func (s *Socket) DirectSend(bytes []byte, timeout ...time.Duration) (int, error)
 }
 
 func (s *Socket) Send(o interface{}) error {
+	if p, ok := o.(socket.Prioritized); ok {
+		return s.SendWithPriority(o, p.Priority())
+	} else {
+		return s.SendWithPriority(o, 0)
+	}
+}
+
+/*
+ *  o进入发送队列中priority对应的优先级通道(0到socket.SendPriorityCount-1),高优先级的消息先于已经在队列中的低优先级消息发送
+ */
+func (s *Socket) SendWithPriority(o interface{}, priority int) error {
+	return s.send(o, priority, nil)
+}
+
+/*
+ *  o处理完成后调用cb:nil表示已经全部写入内核,否则为编码错误,kendynet.ErrSendTimeout,
+ *  kendynet.ErrSendDropped(被溢出策略丢弃)或kendynet.ErrSocketClose(会话关闭时尚未发送)。
+ *  返回错误时不会调用cb。cb由completeRoutine调用,不能阻塞
+ */
+func (s *Socket) SendWithCallback(o interface{}, cb func(error), priority ...int) error {
+	if len(priority) > 0 {
+		return s.send(o, priority[0], cb)
+	} else if p, ok := o.(socket.Prioritized); ok {
+		return s.send(o, p.Priority(), cb)
+	} else {
+		return s.send(o, 0, cb)
+	}
+}
+
+func (s *Socket) send(o interface{}, priority int, cb func(error)) error {
 	if o == nil {
 		return kendynet.ErrInvaildObject
 	} else if _, ok := o.([]byte); !ok && nil == s.encoder {
 		return kendynet.ErrInvaildEncoder
 	} else {
 		//send:1
-		if err := s.sendQueue.Add(o); nil != err {
+		if err := s.sendQueue.AddWithCallback(o, priority, cb); nil != err {
 			if err == socket.ErrQueueFull {
 				err = kendynet.ErrSendQueFull
 			} else if err == socket.ErrAddTimeout {
 				err = kendynet.ErrSendTimeout
+			} else if err == socket.ErrQueueOverflow {
+				err = kendynet.ErrSlowConsumer
+				s.Close(err, 0)
 			} else {
 				err = kendynet.ErrSocketClose
 			}
@@ -397,7 +498,14 @@ func (s *Socket) Send(o interface{}) error {
 }
 
 func (s *Socket) onSendComplete(r *goaio.AIOResult, b *buffer.Buffer) {
+	if r.Bytestransfer > 0 {
+		s.metrics.Add(socket.MetricBytesOut, int64(r.Bytestransfer))
+	}
+
 	if nil == r.Err {
+		s.sendQueue.Written()
+		s.notifySendResult(nil)
+
 		if s.sendQueue.Empty() {
 			//onSendComplete:1
 			atomic.StoreInt32(&s.sendLock, 0)
@@ -440,6 +548,7 @@ func (s *Socket) onSendComplete(r *goaio.AIOResult, b *buffer.Buffer) {
 
 		if r.Err == goaio.ErrSendTimeout {
 			r.Err = kendynet.ErrSendTimeout
+			s.metrics.Add(socket.MetricSendTimeouts, 1)
 		}
 
 		if nil != s.errorCallback {
@@ -465,6 +574,15 @@ func (s *Socket) onSendComplete(r *goaio.AIOResult, b *buffer.Buffer) {
 		}
 	}
 
+	if nil != r.Err {
+		s.sendQueue.Written()
+		if r.Err == kendynet.ErrSendTimeout {
+			s.notifySendResult(r.Err)
+		} else {
+			s.notifySendResult(kendynet.ErrSocketClose)
+		}
+	}
+
 	b.Free()
 
 	s.ioDone()
@@ -483,6 +601,56 @@ func (s *Socket) ShutdownWrite() {
 	}
 }
 
+/*
+ *  启用心跳,必须在BeginRecv之前调用
+ */
+func (s *Socket) SetHeartbeat(option socket.HeartbeatOption) error {
+	if atomic.LoadInt32(&s.beginOnce) == 1 {
+		return kendynet.ErrStarted
+	}
+
+	h, err := socket.NewHeartbeat(s, option)
+	if nil != err {
+		return err
+	}
+
+	s.heartbeat = h
+	return nil
+}
+
+/*
+ *  没有启用心跳或尚未测得时返回0
+ */
+func (s *Socket) RTT() time.Duration {
+	if nil == s.heartbeat {
+		return 0
+	} else {
+		return s.heartbeat.RTT()
+	}
+}
+
+/*
+ *  会话接入MetricsSink,必须在BeginRecv及Send之前调用
+ */
+func (s *Socket) SetMetrics(sink socket.MetricsSink) {
+	if nil == sink {
+		return
+	}
+	s.metrics.SetSink(sink)
+	s.sendQueue.SetWaitObserver(sink.ObserveQueueWait)
+	sink.OnOpen(s)
+	s.NotifyClose(func(sess kendynet.StreamSession, _ error) {
+		sink.OnClose(sess)
+	})
+}
+
+func (s *Socket) Stats() socket.Stats {
+	stats := s.metrics.Stats()
+	stats.SendQueueLen = s.sendQueue.Len()
+	stats.SendQueueBytes = s.sendQueue.Bytes()
+	return stats
+}
+
 /*
  * cb由completeRoutine调用，禁止在cb中调用会导致阻塞（例如SendWithTimeout和DirectSend）或耗时长的任务
  */
@@ -498,7 +666,16 @@ func (s *Socket) BeginRecv(cb func(kendynet.StreamSession, interface{})) (err er
 					buffer: make([]byte, 4096),
 				}
 			}
-			s.inboundCallBack = cb
+			if h := s.heartbeat; nil != h {
+				s.inboundCallBack = func(sess kendynet.StreamSession, msg interface{}) {
+					if !h.OnMessage(msg) {
+						cb(sess, msg)
+					}
+				}
+				h.Start()
+			} else {
+				s.inboundCallBack = cb
+			}
 			s.addIO()
 			if err = s.aioConn.Recv(&s.recvContext, s.inboundProcessor.GetRecvBuff(), s.getRecvTimeout()); nil != err {
 				s.ioDone()
@@ -516,6 +693,7 @@ func (s *Socket) ioDone() {
 	if atomic.AddInt32(&s.ioCount, -1) == 0 && s.flag.AtomicTest(fdoclose) {
 		if atomic.CompareAndSwapInt32(&s.doCloseOnce, 0, 1) {
 			s.aioConn.Close(nil)
+			s.sendQueue.Discard(kendynet.ErrSocketClose)
 
 			if nil != s.inboundProcessor {
 				s.inboundProcessor.OnSocketClose()
@@ -523,6 +701,7 @@ func (s *Socket) ioDone() {
 			if nil != s.closeCallBack {
 				s.closeCallBack(s, s.closeReason)
 			}
+			s.closeNotify.Notify(s, s.closeReason)
 		}
 	}
 }
@@ -531,9 +710,13 @@ func (s *Socket) Close(reason error, delay time.Duration) {
 	if atomic.CompareAndSwapInt32(&s.closeOnce, 0, 1) {
 		runtime.SetFinalizer(s, nil)
 		s.flag.AtomicSet(fclosed)
+		if nil != s.heartbeat {
+			s.heartbeat.Stop()
+		}
 		s.ShutdownRead()
 		_, remain := s.sendQueue.Close()
-		if remain > 0 && delay > 0 {
+		//队列为空时可能还有一批已经取出尚未写完的消息
+		if (remain > 0 || atomic.LoadInt32(&s.sendLock) == 1) && delay > 0 {
 			ticker := time.NewTicker(delay)
 			go func() {
 				select {
@@ -554,6 +737,7 @@ func (s *Socket) Close(reason error, delay time.Duration) {
 		if atomic.LoadInt32(&s.ioCount) == 0 {
 			if atomic.CompareAndSwapInt32(&s.doCloseOnce, 0, 1) {
 				s.aioConn.Close(nil)
+				s.sendQueue.Discard(kendynet.ErrSocketClose)
 
 				if nil != s.inboundProcessor {
 					s.inboundProcessor.OnSocketClose()
@@ -561,6 +745,7 @@ func (s *Socket) Close(reason error, delay time.Duration) {
 				if nil != s.closeCallBack {
 					s.closeCallBack(s, reason)
 				}
+				s.closeNotify.Notify(s, reason)
 			}
 		}
 	}
@@ -575,6 +760,7 @@ func NewSocket(service *SocketService, netConn net.Conn) kendynet.StreamSession
 	}
 	s.aioConn = c
 	s.sendQueue = socket.NewSendQueue(128)
+	s.metrics = &socket.SessionMetrics{}
 	s.netconn = netConn
 	s.sendOverChan = make(chan struct{})
 	s.sendContext.cb = func(r *goaio.AIOResult, b *buffer.Buffer) {
@@ -0,0 +1,77 @@
+package socket
+
+import (
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/buffer"
+	"net"
+)
+
+/*
+ *  不小于BorrowThreshold的[]byte直接引用,不拷贝到发送缓冲中
+ */
+const BorrowThreshold = 1024
+
+/*
+ *  将发送队列中取出的一批消息组装为net.Buffers用于writev。
+ *  小的消息拷贝合并到buffer.Buffer中,大的[]byte及BuffersEnCoder返回的切片直接引用。
+ *  在Buffers()返回的数据写入完成之前不能Reset
+ */
+type BuffersBuilder struct {
+	b     *buffer.Buffer
+	bufs  net.Buffers
+	start int //b中尚未加入bufs的起始位置
+}
+
+func (this *BuffersBuilder) Reset(b *buffer.Buffer) {
+	b.Reset()
+	this.b = b
+	for i := range this.bufs {
+		this.bufs[i] = nil
+	}
+	this.bufs = this.bufs[:0]
+	this.start = 0
+}
+
+/*
+ *  b中新写入的部分作为一个切片加入bufs。之后b扩容不影响已经加入的切片,它们仍然引用原来的内存
+ */
+func (this *BuffersBuilder) seal() {
+	if this.b.Len() > this.start {
+		this.bufs = append(this.bufs, this.b.Bytes()[this.start:])
+		this.start = this.b.Len()
+	}
+}
+
+/*
+ *  加入一个消息,[]byte不经过encoder。编码失败时这个消息已经写入的内容被丢弃
+ */
+func (this *BuffersBuilder) Add(o interface{}, encoder kendynet.EnCoder) (err error) {
+	switch o.(type) {
+	case []byte:
+		if data := o.([]byte); len(data) >= BorrowThreshold {
+			this.seal()
+			this.bufs = append(this.bufs, data)
+		} else {
+			this.b.AppendBytes(data)
+		}
+	default:
+		if e, ok := encoder.(kendynet.BuffersEnCoder); ok {
+			this.seal()
+			bufs := this.bufs
+			if this.bufs, err = e.EnCodeBuffers(o, bufs); nil != err {
+				this.bufs = bufs
+			}
+		} else {
+			l := this.b.Len()
+			if err = encoder.EnCode(o, this.b); nil != err {
+				this.b.SetLen(l)
+			}
+		}
+	}
+	return
+}
+
+func (this *BuffersBuilder) Buffers() net.Buffers {
+	this.seal()
+	return this.bufs
+}
@@ -0,0 +1,459 @@
+package reconnect
+
+import (
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/util"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  tcp,aio,udp及rudp的Connector都实现了Dialer,websocket.Connector可通过DialFunc适配
+ */
+type Dialer interface {
+	Dial(timeout time.Duration) (kendynet.StreamSession, error)
+}
+
+type DialFunc func(timeout time.Duration) (kendynet.StreamSession, error)
+
+func (f DialFunc) Dial(timeout time.Duration) (kendynet.StreamSession, error) {
+	return f(timeout)
+}
+
+type Option struct {
+	DialTimeout         time.Duration                    //默认5秒
+	RetryInterval       time.Duration                    //重连的初始间隔,默认100毫秒,每次失败翻倍
+	MaxRetryInterval    time.Duration                    //重连的最大间隔,默认10秒
+	MaxRetry            int                              //连续失败多少次后放弃并关闭会话,0表示不限制
+	BufferSize          int                              //断开期间最多缓存多少个待发送对象,0表示断开期间Send返回ErrDisconnected
+	NewInBoundProcessor func() kendynet.InBoundProcessor //可选,为每个连接创建新的InBoundProcessor
+	OnConnect           func(*Session)                   //可选,每次连接建立后回调,此时缓存的对象已经投递
+	OnDisconnect        func(*Session, error)            //可选,连接断开且即将重连时回调
+}
+
+/*
+ *  自动重连的客户端会话,实现kendynet.StreamSession
+ *
+ *  每次连接建立后将编码器,InBoundProcessor,超时,发送队列大小及回调重新设置到新的底层会话上。
+ *  InBoundProcessor通常是有状态的,应通过Option.NewInBoundProcessor为每个连接创建新的实例,
+ *  否则SetInBoundProcessor设置的实例会被所有连接共用。
+ *
+ *  消息回调的参数为Session本身;错误回调的参数为底层会话,关闭它将触发重连。
+ *  只有调用Close或连续失败超过MaxRetry次后会话才真正关闭并回调关闭回调。
+ */
+type Session struct {
+	dialer          Dialer
+	option          Option
+	mu              sync.Mutex
+	cur             kendynet.StreamSession
+	pending         []interface{}
+	ud              atomic.Value
+	closed          int32
+	closeC          chan struct{}
+	closeReason     error
+	encoder         kendynet.EnCoder
+	inbound         kendynet.InBoundProcessor
+	recvTimeout     time.Duration
+	sendTimeout     time.Duration
+	sendQueueSize   int
+	errorCallback   func(kendynet.StreamSession, error)
+	closeCallBack   func(kendynet.StreamSession, error)
+	inboundCallBack func(kendynet.StreamSession, interface{})
+}
+
+/*
+ *  立即开始连接,连接过程在独立的goroutine中进行
+ */
+func New(dialer Dialer, option Option) (*Session, error) {
+	if nil == dialer {
+		return nil, errors.New("dialer == nil")
+	}
+
+	if option.DialTimeout <= 0 {
+		option.DialTimeout = time.Second * 5
+	}
+
+	if option.RetryInterval <= 0 {
+		option.RetryInterval = time.Millisecond * 100
+	}
+
+	if option.MaxRetryInterval < option.RetryInterval {
+		option.MaxRetryInterval = time.Second * 10
+		if option.MaxRetryInterval < option.RetryInterval {
+			option.MaxRetryInterval = option.RetryInterval
+		}
+	}
+
+	s := &Session{
+		dialer: dialer,
+		option: option,
+		closeC: make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (this *Session) run() {
+	interval := this.option.RetryInterval
+	failures := 0
+	for {
+		session, err := this.dialer.Dial(this.option.DialTimeout)
+		if nil == err {
+			failures = 0
+			interval = this.option.RetryInterval
+			reason := this.serve(session)
+			if atomic.LoadInt32(&this.closed) == 1 {
+				break
+			}
+
+			if nil != this.option.OnDisconnect {
+				this.option.OnDisconnect(this, reason)
+			}
+		} else {
+			failures++
+			if this.option.MaxRetry > 0 && failures >= this.option.MaxRetry {
+				this.Close(err, 0)
+				break
+			}
+			kendynet.GetLogger().Errorf(util.FormatFileLine("reconnect dial error:%s,retry after %v\n", err.Error(), interval))
+		}
+
+		//在[interval/2,interval)之间随机,避免多个客户端同时重连
+		d := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+
+		select {
+		case <-this.closeC:
+		case <-time.After(d):
+		}
+
+		if atomic.LoadInt32(&this.closed) == 1 {
+			break
+		}
+
+		if nil != err {
+			if interval *= 2; interval > this.option.MaxRetryInterval {
+				interval = this.option.MaxRetryInterval
+			}
+		}
+	}
+
+	this.mu.Lock()
+	cb := this.closeCallBack
+	reason := this.closeReason
+	this.mu.Unlock()
+
+	if nil != cb {
+		cb(this, reason)
+	}
+}
+
+//使用新连接直到其断开,返回断开原因
+func (this *Session) serve(session kendynet.StreamSession) error {
+	disconnectC := make(chan error, 1)
+
+	this.mu.Lock()
+	if atomic.LoadInt32(&this.closed) == 1 {
+		this.mu.Unlock()
+		session.Close(this.closeReason, 0)
+		return nil
+	}
+
+	if nil != this.encoder {
+		session.SetEncoder(this.encoder)
+	}
+
+	if nil != this.option.NewInBoundProcessor {
+		session.SetInBoundProcessor(this.option.NewInBoundProcessor())
+	} else if nil != this.inbound {
+		session.SetInBoundProcessor(this.inbound)
+	}
+
+	session.SetRecvTimeout(this.recvTimeout)
+	session.SetSendTimeout(this.sendTimeout)
+
+	if this.sendQueueSize > 0 {
+		session.SetSendQueueSize(this.sendQueueSize)
+	}
+
+	if nil != this.errorCallback {
+		session.SetErrorCallBack(this.errorCallback)
+	}
+
+	session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+		disconnectC <- reason
+	})
+
+	//在设置cur之前投递缓存的对象,保证先于之后的Send
+	for _, o := range this.pending {
+		session.Send(o)
+	}
+	this.pending = nil
+
+	this.cur = session
+	cb := this.inboundCallBack
+	this.mu.Unlock()
+
+	if nil != cb {
+		session.BeginRecv(func(_ kendynet.StreamSession, msg interface{}) {
+			cb(this, msg)
+		})
+	}
+
+	if nil != this.option.OnConnect {
+		this.option.OnConnect(this)
+	}
+
+	reason := <-disconnectC
+
+	this.mu.Lock()
+	this.cur = nil
+	this.mu.Unlock()
+
+	return reason
+}
+
+/*
+ *  当前的底层会话,断开期间返回nil
+ */
+func (this *Session) Current() kendynet.StreamSession {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.cur
+}
+
+func (this *Session) IsConnected() bool {
+	return nil != this.Current()
+}
+
+//断开期间缓存或拒绝
+func (this *Session) sendDisconnected(o interface{}) error {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return kendynet.ErrSocketClose
+	} else if this.option.BufferSize <= 0 {
+		return kendynet.ErrDisconnected
+	} else if len(this.pending) >= this.option.BufferSize {
+		return kendynet.ErrSendQueFull
+	} else {
+		this.pending = append(this.pending, o)
+		return nil
+	}
+}
+
+func (this *Session) Send(o interface{}) error {
+	if nil == o {
+		return kendynet.ErrInvaildObject
+	}
+
+	this.mu.Lock()
+	cur := this.cur
+	if nil == cur {
+		err := this.sendDisconnected(o)
+		this.mu.Unlock()
+		return err
+	}
+	this.mu.Unlock()
+
+	return cur.Send(o)
+}
+
+func (this *Session) SendWithTimeout(o interface{}, timeout time.Duration) error {
+	if nil == o {
+		return kendynet.ErrInvaildObject
+	}
+
+	this.mu.Lock()
+	cur := this.cur
+	if nil == cur {
+		err := this.sendDisconnected(o)
+		this.mu.Unlock()
+		return err
+	}
+	this.mu.Unlock()
+
+	return cur.SendWithTimeout(o, timeout)
+}
+
+func (this *Session) DirectSend(bytes []byte, timeout ...time.Duration) (int, error) {
+	if cur := this.Current(); nil != cur {
+		return cur.DirectSend(bytes, timeout...)
+	} else if atomic.LoadInt32(&this.closed) == 1 {
+		return 0, kendynet.ErrSocketClose
+	} else {
+		return 0, kendynet.ErrDisconnected
+	}
+}
+
+/*
+ *  停止重连并关闭当前连接,缓存的对象被丢弃
+ */
+func (this *Session) Close(reason error, delay time.Duration) {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		this.mu.Lock()
+		this.closeReason = reason
+		this.pending = nil
+		cur := this.cur
+		this.mu.Unlock()
+
+		close(this.closeC)
+
+		if nil != cur {
+			cur.Close(reason, delay)
+		}
+	}
+}
+
+func (this *Session) ShutdownRead() {
+	if cur := this.Current(); nil != cur {
+		cur.ShutdownRead()
+	}
+}
+
+func (this *Session) ShutdownWrite() {
+	if cur := this.Current(); nil != cur {
+		cur.ShutdownWrite()
+	}
+}
+
+func (this *Session) IsClosed() bool {
+	return atomic.LoadInt32(&this.closed) == 1
+}
+
+func (this *Session) SetCloseCallBack(cb func(kendynet.StreamSession, error)) kendynet.StreamSession {
+	this.mu.Lock()
+	this.closeCallBack = cb
+	this.mu.Unlock()
+	return this
+}
+
+func (this *Session) SetErrorCallBack(cb func(kendynet.StreamSession, error)) kendynet.StreamSession {
+	this.mu.Lock()
+	this.errorCallback = cb
+	cur := this.cur
+	this.mu.Unlock()
+	if nil != cur {
+		cur.SetErrorCallBack(cb)
+	}
+	return this
+}
+
+/*
+ *  只对之后建立的连接生效,当前连接已经开始接收时不能替换
+ */
+func (this *Session) SetInBoundProcessor(in kendynet.InBoundProcessor) kendynet.StreamSession {
+	this.mu.Lock()
+	this.inbound = in
+	this.mu.Unlock()
+	return this
+}
+
+func (this *Session) SetEncoder(encoder kendynet.EnCoder) kendynet.StreamSession {
+	this.mu.Lock()
+	this.encoder = encoder
+	cur := this.cur
+	this.mu.Unlock()
+	if nil != cur {
+		cur.SetEncoder(encoder)
+	}
+	return this
+}
+
+func (this *Session) BeginRecv(cb func(kendynet.StreamSession, interface{})) error {
+	if nil == cb {
+		return errors.New("cb is nil")
+	}
+
+	this.mu.Lock()
+	if atomic.LoadInt32(&this.closed) == 1 {
+		this.mu.Unlock()
+		return kendynet.ErrSocketClose
+	} else if nil != this.inboundCallBack {
+		this.mu.Unlock()
+		return kendynet.ErrStarted
+	}
+	this.inboundCallBack = cb
+	cur := this.cur
+	this.mu.Unlock()
+
+	if nil != cur {
+		return cur.BeginRecv(func(_ kendynet.StreamSession, msg interface{}) {
+			cb(this, msg)
+		})
+	}
+
+	return nil
+}
+
+/*
+ *  断开期间返回nil
+ */
+func (this *Session) LocalAddr() net.Addr {
+	if cur := this.Current(); nil != cur {
+		return cur.LocalAddr()
+	}
+	return nil
+}
+
+/*
+ *  断开期间返回nil
+ */
+func (this *Session) RemoteAddr() net.Addr {
+	if cur := this.Current(); nil != cur {
+		return cur.RemoteAddr()
+	}
+	return nil
+}
+
+func (this *Session) SetUserData(ud interface{}) kendynet.StreamSession {
+	this.ud.Store(ud)
+	return this
+}
+
+func (this *Session) GetUserData() interface{} {
+	return this.ud.Load()
+}
+
+func (this *Session) GetUnderConn() interface{} {
+	if cur := this.Current(); nil != cur {
+		return cur.GetUnderConn()
+	}
+	return nil
+}
+
+func (this *Session) SetRecvTimeout(timeout time.Duration) kendynet.StreamSession {
+	this.mu.Lock()
+	this.recvTimeout = timeout
+	cur := this.cur
+	this.mu.Unlock()
+	if nil != cur {
+		cur.SetRecvTimeout(timeout)
+	}
+	return this
+}
+
+func (this *Session) SetSendTimeout(timeout time.Duration) kendynet.StreamSession {
+	this.mu.Lock()
+	this.sendTimeout = timeout
+	cur := this.cur
+	this.mu.Unlock()
+	if nil != cur {
+		cur.SetSendTimeout(timeout)
+	}
+	return this
+}
+
+func (this *Session) SetSendQueueSize(size int) kendynet.StreamSession {
+	this.mu.Lock()
+	this.sendQueueSize = size
+	cur := this.cur
+	this.mu.Unlock()
+	if nil != cur {
+		cur.SetSendQueueSize(size)
+	}
+	return this
+}
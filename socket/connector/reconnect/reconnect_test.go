@@ -0,0 +1,161 @@
+package reconnect
+
+import (
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/buffer"
+	connector "github.com/sniperHW/kendynet/socket/connector/tcp"
+	listener "github.com/sniperHW/kendynet/socket/listener/tcp"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	kendynet.InitLogger(&kendynet.EmptyLogger{})
+}
+
+type encoder struct {
+}
+
+func (this *encoder) EnCode(o interface{}, b *buffer.Buffer) error {
+	switch o.(type) {
+	case string:
+		b.AppendString(o.(string))
+	default:
+		return errors.New("invaild o")
+	}
+	return nil
+}
+
+type server struct {
+	mu       sync.Mutex
+	l        *listener.Listener
+	sessions []kendynet.StreamSession
+}
+
+func startServer(t *testing.T, addr string) *server {
+	l, err := listener.New("tcp", addr)
+	assert.Nil(t, err)
+	s := &server{l: l}
+	go l.Serve(func(session kendynet.StreamSession) {
+		s.mu.Lock()
+		s.sessions = append(s.sessions, session)
+		s.mu.Unlock()
+		session.SetEncoder(&encoder{})
+		session.BeginRecv(func(sess kendynet.StreamSession, msg interface{}) {
+			sess.Send(string(msg.([]byte)))
+		})
+	})
+	return s
+}
+
+func (this *server) kick() {
+	this.mu.Lock()
+	sessions := this.sessions
+	this.sessions = nil
+	this.mu.Unlock()
+	for _, v := range sessions {
+		v.Close(nil, 0)
+	}
+}
+
+func (this *server) stop() {
+	this.l.Close()
+	this.kick()
+}
+
+func TestReconnect(t *testing.T) {
+	srv := startServer(t, "localhost:8120")
+
+	c, _ := connector.New("tcp", "localhost:8120")
+
+	connectC := make(chan struct{}, 10)
+	disconnectC := make(chan error, 10)
+	closeC := make(chan error, 1)
+	recvC := make(chan string, 10)
+
+	session, err := New(c, Option{
+		RetryInterval:    time.Millisecond * 10,
+		MaxRetryInterval: time.Millisecond * 50,
+		BufferSize:       2,
+		OnConnect: func(*Session) {
+			connectC <- struct{}{}
+		},
+		OnDisconnect: func(_ *Session, reason error) {
+			disconnectC <- reason
+		},
+	})
+	assert.Nil(t, err)
+
+	session.SetEncoder(&encoder{}).SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+		closeC <- reason
+	})
+
+	//连接建立之前的发送被缓存
+	session.Send("hello")
+
+	session.BeginRecv(func(sess kendynet.StreamSession, msg interface{}) {
+		assert.Equal(t, session, sess)
+		recvC <- string(msg.([]byte))
+	})
+
+	<-connectC
+	assert.True(t, session.IsConnected())
+	assert.Equal(t, "hello", <-recvC)
+
+	//服务端断开后自动重连
+	srv.kick()
+	<-disconnectC
+	<-connectC
+	assert.Nil(t, session.Send("world"))
+	assert.Equal(t, "world", <-recvC)
+
+	//服务端停止期间缓存,超过BufferSize返回ErrSendQueFull
+	srv.stop()
+	<-disconnectC
+	assert.False(t, session.IsConnected())
+	assert.Nil(t, session.LocalAddr())
+	assert.Nil(t, session.Send("a"))
+	assert.Nil(t, session.Send("b"))
+	assert.Equal(t, kendynet.ErrSendQueFull, session.Send("c"))
+	_, err = session.DirectSend([]byte("d"))
+	assert.Equal(t, kendynet.ErrDisconnected, err)
+
+	srv = startServer(t, "localhost:8120")
+	<-connectC
+	//两个对象可能被合并到一次接收中
+	recv := ""
+	for recv != "ab" {
+		recv += <-recvC
+	}
+
+	session.Close(errors.New("close"), 0)
+	assert.Equal(t, "close", (<-closeC).Error())
+	assert.True(t, session.IsClosed())
+	assert.Equal(t, kendynet.ErrSocketClose, session.Send("e"))
+
+	srv.stop()
+}
+
+func TestMaxRetry(t *testing.T) {
+	c, _ := connector.New("tcp", "localhost:8121")
+
+	closeC := make(chan error, 1)
+
+	session, _ := New(c, Option{
+		RetryInterval: time.Millisecond * 10,
+		MaxRetry:      3,
+	})
+
+	session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+		closeC <- reason
+	})
+
+	//BufferSize为0,断开期间直接拒绝
+	assert.Equal(t, kendynet.ErrDisconnected, session.Send("hello"))
+
+	assert.NotNil(t, <-closeC)
+	assert.True(t, session.IsClosed())
+}
@@ -0,0 +1,33 @@
+package rudp
+
+import (
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"github.com/sniperHW/kendynet/socket/rudp"
+	"time"
+)
+
+type Connector struct {
+	nettype string
+	addr    string
+	config  *rudp.Config
+}
+
+func New(nettype string, addr string, config ...*rudp.Config) (*Connector, error) {
+	c := &Connector{nettype: nettype, addr: addr}
+	if len(config) > 0 {
+		c.config = config[0]
+	}
+	return c, nil
+}
+
+/*
+ *  rudp没有握手过程,timeout不起作用,对端不可达时会话在重传失败后以rudp.ErrDeadLink关闭
+ */
+func (this *Connector) Dial(timeout time.Duration) (kendynet.StreamSession, error) {
+	conn, err := rudp.Dial(this.nettype, this.addr, this.config)
+	if err != nil {
+		return nil, err
+	}
+	return socket.NewStreamSocket(conn), nil
+}
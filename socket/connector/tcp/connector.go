@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/socket"
 	"net"
@@ -8,19 +9,58 @@ import (
 )
 
 type Connector struct {
-	nettype string
-	addr    string
+	nettype   string
+	addr      string
+	tlsConfig *tls.Config
 }
 
 func New(nettype string, addr string) (*Connector, error) {
 	return &Connector{nettype: nettype, addr: addr}, nil
 }
 
+/*
+ *  tls连接,config.ServerName为空时使用addr中的主机名校验服务端证书,
+ *  mTLS需在config.Certificates中提供客户端证书
+ */
+func NewTLS(nettype string, addr string, config *tls.Config) (*Connector, error) {
+	if nil == config {
+		return nil, kendynet.ErrInvaildTLSConfig
+	}
+
+	if "" == config.ServerName && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	return &Connector{nettype: nettype, addr: addr, tlsConfig: config}, nil
+}
+
 func (this *Connector) Dial(timeout time.Duration) (kendynet.StreamSession, error) {
-	dialer := &net.Dialer{Timeout: timeout}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	dialer := &net.Dialer{Deadline: deadline}
 	conn, err := dialer.Dial(this.nettype, this.addr)
 	if err != nil {
 		return nil, err
 	}
+
+	if nil != this.tlsConfig {
+		//timeout同时限制连接及握手的总时间
+		tlsConn := tls.Client(conn, this.tlsConfig)
+		tlsConn.SetDeadline(deadline)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		return socket.NewStreamSocket(tlsConn), nil
+	}
+
 	return socket.NewStreamSocket(conn), nil
 }
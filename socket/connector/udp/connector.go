@@ -0,0 +1,29 @@
+package udp
+
+import (
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"net"
+	"time"
+)
+
+type Connector struct {
+	nettype string
+	addr    string
+}
+
+func New(nettype string, addr string) (*Connector, error) {
+	return &Connector{nettype: nettype, addr: addr}, nil
+}
+
+/*
+ *  创建已连接的UDP会话,UDP没有握手过程,timeout仅用于地址解析
+ */
+func (this *Connector) Dial(timeout time.Duration) (kendynet.StreamSession, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial(this.nettype, this.addr)
+	if err != nil {
+		return nil, err
+	}
+	return socket.NewDatagramSocket(conn), nil
+}
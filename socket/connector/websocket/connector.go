@@ -13,6 +13,7 @@ type Connector struct {
 	dialer        *gorilla.Dialer
 	u             url.URL
 	requestHeader http.Header
+	compression   *socket.WSCompressionOption
 }
 
 func New(url url.URL, requestHeader http.Header, dialer ...*gorilla.Dialer) (*Connector, error) {
@@ -22,20 +23,39 @@ func New(url url.URL, requestHeader http.Header, dialer ...*gorilla.Dialer) (*Co
 		requestHeader: requestHeader,
 	}
 
-	if len(dialer) > 0 {
-		client.dialer = dialer[0]
+	//Dial会修改HandshakeTimeout,复制一份避免修改调用者的dialer
+	var d gorilla.Dialer
+	if len(dialer) > 0 && nil != dialer[0] {
+		d = *dialer[0]
 	} else {
-		client.dialer = gorilla.DefaultDialer
+		d = *gorilla.DefaultDialer
 	}
+	client.dialer = &d
 
 	return client, nil
 }
 
+/*
+ *  与服务端协商permessage-deflate,必须在Dial之前调用
+ */
+func (this *Connector) SetCompression(option socket.WSCompressionOption) error {
+	if err := option.Check(); nil != err {
+		return err
+	}
+	this.dialer.EnableCompression = true
+	this.compression = &option
+	return nil
+}
+
 func (this *Connector) Dial(timeout time.Duration) (kendynet.StreamSession, *http.Response, error) {
 	this.dialer.HandshakeTimeout = timeout
-	c, response, err := this.dialer.Dial(this.u.String(), nil)
+	c, response, err := this.dialer.Dial(this.u.String(), this.requestHeader)
 	if err != nil {
 		return nil, nil, err
 	}
-	return socket.NewWSSocket(c), response, nil
+	session := socket.NewWSSocket(c)
+	if nil != this.compression {
+		session.(*socket.WebSocket).SetCompression(*this.compression)
+	}
+	return session, response, nil
 }
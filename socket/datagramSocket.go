@@ -0,0 +1,352 @@
+/*
+*  数据报会话
+*
+*  每个数据报独立解码,每个待发送对象独立编码为一个数据报。
+*  底层连接可以是已连接的*net.UDPConn(客户端),也可以是UDPMux按对端地址分离出的虚拟连接(服务端)。
+ */
+
+package socket
+
+import (
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/buffer"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const MaxDatagramSize = 65507
+
+type DatagramSocketInBoundProcessor interface {
+	kendynet.InBoundProcessor
+	OnDatagram([]byte) //收到一个完整的数据报,返回后[]byte会被复用
+}
+
+type defaultDSInBoundProcessor struct {
+	datagrams [][]byte
+}
+
+func (this *defaultDSInBoundProcessor) OnDatagram(data []byte) {
+	o := make([]byte, 0, len(data))
+	o = append(o, data...)
+	this.datagrams = append(this.datagrams, o)
+}
+
+func (this *defaultDSInBoundProcessor) Unpack() (interface{}, error) {
+	if len(this.datagrams) == 0 {
+		return nil, nil
+	} else {
+		o := this.datagrams[0]
+		this.datagrams[0] = nil
+		this.datagrams = this.datagrams[1:]
+		return o, nil
+	}
+}
+
+type DatagramSocket struct {
+	SocketBase
+	inboundProcessor DatagramSocketInBoundProcessor
+	conn             net.Conn
+}
+
+func (this *DatagramSocket) getInBoundProcessor() kendynet.InBoundProcessor {
+	return this.inboundProcessor
+}
+
+func (this *DatagramSocket) SetInBoundProcessor(in kendynet.InBoundProcessor) kendynet.StreamSession {
+	this.inboundProcessor = in.(DatagramSocketInBoundProcessor)
+	return this
+}
+
+/*
+ *  bytes作为一个数据报直接发送
+ */
+func (this *DatagramSocket) DirectSend(bytes []byte, timeout ...time.Duration) (int, error) {
+	if this.flag.AtomicTest(fclosed | frclosed) {
+		return 0, kendynet.ErrSocketClose
+	} else {
+		var ttimeout time.Duration
+		if len(timeout) > 0 {
+			ttimeout = timeout[0]
+		}
+
+		var n int
+		var err error
+
+		if ttimeout > 0 {
+			this.conn.SetWriteDeadline(time.Now().Add(ttimeout))
+			n, err = this.conn.Write(bytes)
+			this.conn.SetWriteDeadline(time.Time{})
+		} else {
+			n, err = this.conn.Write(bytes)
+		}
+
+		this.metrics.Add(MetricBytesOut, int64(n))
+
+		if kendynet.IsNetTimeout(err) {
+			err = kendynet.ErrSendTimeout
+			this.metrics.Add(MetricSendTimeouts, 1)
+		}
+
+		return n, err
+	}
+}
+
+/*
+ *  RecvTimeout即空闲超时:超过RecvTimeout未收到任何数据报时,
+ *  没有设置错误回调的会话被关闭,否则以ErrRecvTimeout回调错误
+ */
+func (this *DatagramSocket) recvThreadFunc() {
+	defer this.ioDone()
+
+	oldTimeout := this.getRecvTimeout()
+	timeout := oldTimeout
+
+	buff := make([]byte, MaxDatagramSize)
+
+	for !this.flag.AtomicTest(fclosed | frclosed) {
+
+		var (
+			p   interface{}
+			err error
+			n   int
+		)
+
+		isUnpackError := false
+
+		for {
+			p, err = this.inboundProcessor.Unpack()
+			if nil != p {
+				break
+			} else if nil != err {
+				isUnpackError = true
+				break
+			} else {
+
+				oldTimeout = timeout
+				timeout = this.getRecvTimeout()
+
+				if oldTimeout != timeout && timeout == 0 {
+					this.conn.SetReadDeadline(time.Time{})
+				}
+
+				if timeout > 0 {
+					this.conn.SetReadDeadline(time.Now().Add(timeout))
+					n, err = this.conn.Read(buff)
+				} else {
+					n, err = this.conn.Read(buff)
+				}
+
+				if nil == err {
+					this.metrics.Add(MetricBytesIn, int64(n))
+					this.inboundProcessor.OnDatagram(buff[:n])
+				} else {
+					break
+				}
+			}
+		}
+
+		if !this.flag.AtomicTest(fclosed | frclosed) {
+			if nil != err {
+				if kendynet.IsNetTimeout(err) {
+					err = kendynet.ErrRecvTimeout
+					this.metrics.Add(MetricRecvTimeouts, 1)
+				}
+				if nil != this.errorCallback {
+					if isUnpackError {
+						this.Close(err, 0)
+					} else if err != kendynet.ErrRecvTimeout {
+						this.flag.AtomicSet(frclosed)
+					}
+
+					this.errorCallback(this, err)
+				} else {
+					this.Close(err, 0)
+				}
+			} else if p != nil {
+				this.metrics.Add(MetricMessagesIn, 1)
+				this.inboundCallBack(this, p)
+			}
+		} else {
+			break
+		}
+	}
+}
+
+func (this *DatagramSocket) sendThreadFunc() {
+	defer func() {
+		close(this.sendCloseChan)
+		this.ioDone()
+	}()
+
+	localList := make([]interface{}, 0, 32)
+
+	var cbs []func(error)
+
+	closed := false
+
+	oldTimeout := this.getSendTimeout()
+	timeout := oldTimeout
+
+	b := buffer.Get()
+	defer b.Free()
+
+	broken := false //conn已经不可用,剩余的消息不再写入
+
+	for {
+
+		closed, localList, cbs = this.sendQue.GetWithCallbacks(localList, cbs)
+		size := len(localList)
+		if closed && size == 0 {
+			break
+		}
+
+		for i := 0; i < size; i++ {
+			var err error
+			var data []byte
+
+			var cb func(error)
+			if len(cbs) > 0 {
+				cb, cbs[i] = cbs[i], nil
+			}
+
+			if broken {
+				localList[i] = nil
+				if nil != cb {
+					cb(kendynet.ErrSocketClose)
+				}
+				continue
+			}
+
+			switch localList[i].(type) {
+			case []byte:
+				data = localList[i].([]byte)
+			default:
+				b.Reset()
+				if err = this.encoder.EnCode(localList[i], b); nil != err {
+					kendynet.GetLogger().Errorf("encode error:%v", err)
+					this.metrics.Add(MetricEncodeErrors, 1)
+				} else {
+					data = b.Bytes()
+				}
+			}
+			localList[i] = nil
+
+			if len(data) == 0 {
+				if nil != cb {
+					cb(err)
+				}
+				continue
+			}
+
+			oldTimeout = timeout
+			timeout = this.getSendTimeout()
+
+			if oldTimeout != timeout && timeout == 0 {
+				this.conn.SetWriteDeadline(time.Time{})
+			}
+
+			if timeout > 0 {
+				this.conn.SetWriteDeadline(time.Now().Add(timeout))
+			}
+
+			var n int
+			if n, err = this.conn.Write(data); nil == err {
+				this.metrics.Add(MetricMessagesOut, 1)
+				this.metrics.Add(MetricBytesOut, int64(n))
+				if nil != cb {
+					cb(nil)
+				}
+				continue
+			}
+
+			if this.flag.AtomicTest(fclosed) {
+				broken = true
+				if nil != cb {
+					cb(kendynet.ErrSocketClose)
+				}
+				continue
+			}
+
+			if isClosedConnError(err) {
+				broken = true
+				if nil != cb {
+					cb(kendynet.ErrSocketClose)
+				}
+				this.Close(err, 0)
+				if nil != this.errorCallback {
+					this.errorCallback(this, err)
+				}
+				continue
+			}
+
+			//单个数据报的错误(例如数据报过大,对端不可达)不影响后续的发送
+			if kendynet.IsNetTimeout(err) {
+				err = kendynet.ErrSendTimeout
+				this.metrics.Add(MetricSendTimeouts, 1)
+			} else {
+				this.metrics.Add(MetricSendErrors, 1)
+			}
+
+			if nil != cb {
+				cb(err)
+			}
+
+			if nil != this.errorCallback {
+				this.errorCallback(this, err)
+			}
+			//数据报发送失败直接丢弃,不重发
+		}
+
+		this.sendQue.Written()
+	}
+}
+
+/*
+ *  conn本身已经关闭。go1.16之前没有net.ErrClosed,以错误信息判断
+ */
+func isClosedConnError(err error) bool {
+	return err == kendynet.ErrSocketClose || strings.Contains(err.Error(), "use of closed network connection")
+}
+
+/*
+ *  conn必须保持消息边界,即每次Read返回一个数据报,每次Write发送一个数据报
+ */
+func NewDatagramSocket(conn net.Conn) kendynet.StreamSession {
+	switch conn.(type) {
+	case *net.UDPConn, *udpPeerConn:
+		break
+	default:
+		return nil
+	}
+
+	s := &DatagramSocket{
+		conn: conn,
+	}
+	s.SocketBase = SocketBase{
+		sendQue:       NewSendQueue(128),
+		sendCloseChan: make(chan struct{}),
+		imp:           s,
+		metrics:       &SessionMetrics{},
+	}
+
+	runtime.SetFinalizer(s, func(s *DatagramSocket) {
+		s.Close(errors.New("gc"), 0)
+	})
+
+	return s
+}
+
+func (this *DatagramSocket) getNetConn() net.Conn {
+	return this.conn
+}
+
+func (this *DatagramSocket) GetUnderConn() interface{} {
+	return this.conn
+}
+
+func (this *DatagramSocket) defaultInBoundProcessor() kendynet.InBoundProcessor {
+	return &defaultDSInBoundProcessor{}
+}
@@ -0,0 +1,220 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/sniperHW/kendynet"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type HeartbeatOption struct {
+	Interval  time.Duration                      //发送ping的间隔
+	MissCount int                                //连续MissCount个间隔没有收到任何数据时以kendynet.ErrHeartbeatTimeout关闭会话,默认3
+	NewPing   func() interface{}                 //构造ping消息,通过会话的编码器发送。WebSocket上为nil时使用控制帧
+	IsPong    func(msg interface{}) bool         //判断收到的消息是否pong,使用控制帧时不需要
+	IsPing    func(msg interface{}) bool         //可选,判断收到的消息是否对端发来的ping
+	NewPong   func(ping interface{}) interface{} //可选,构造对ping的回复,返回nil不回复
+}
+
+/*
+ *  心跳
+ *
+ *  每隔Interval发送一个ping,收到的任何消息(包括ping,pong)都表明对端存活。
+ *  ping,pong消息由心跳处理,不会传递给会话的消息回调。
+ *
+ *  RTT为最近一次ping到对应pong的时间。使用编码器发送的ping/pong没有序号,以最近一次发出的ping计算;
+ *  WebSocket控制帧在ping中携带发送时间,计算是精确的。
+ *
+ *  StreamSocket,WebSocket,aio.Socket通过SetHeartbeat启用,其它会话可以通过NewHeartbeat构造后在接收回调中调用OnMessage。
+ */
+type Heartbeat struct {
+	session   kendynet.StreamSession
+	option    HeartbeatOption
+	ws        *gorilla.Conn
+	active    int32
+	rtt       int64
+	pingTime  int64 //尚未收到pong的ping的发送时间
+	startOnce int32
+	stopOnce  sync.Once
+	stopC     chan struct{}
+}
+
+func NewHeartbeat(session kendynet.StreamSession, option HeartbeatOption) (*Heartbeat, error) {
+	if nil == session {
+		return nil, errors.New("session == nil")
+	}
+
+	if option.Interval <= 0 {
+		return nil, errors.New("invaild heartbeat interval")
+	}
+
+	if option.MissCount <= 0 {
+		option.MissCount = 3
+	}
+
+	h := &Heartbeat{
+		session: session,
+		option:  option,
+		stopC:   make(chan struct{}),
+	}
+
+	if nil == option.NewPing {
+		if ws, ok := session.(*WebSocket); ok {
+			h.ws = ws.conn
+			h.setWSHandler()
+		} else {
+			return nil, errors.New("NewPing == nil")
+		}
+	} else if nil == option.IsPong {
+		return nil, errors.New("IsPong == nil")
+	}
+
+	return h, nil
+}
+
+func (this *Heartbeat) setWSHandler() {
+	this.ws.SetPingHandler(func(appData string) error {
+		atomic.StoreInt32(&this.active, 1)
+		//与gorilla默认的ping处理一致
+		err := this.ws.WriteControl(gorilla.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		if err == gorilla.ErrCloseSent {
+			return nil
+		} else if e, ok := err.(interface{ Temporary() bool }); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
+
+	this.ws.SetPongHandler(func(appData string) error {
+		atomic.StoreInt32(&this.active, 1)
+		if len(appData) == 8 {
+			sendTime := int64(binary.BigEndian.Uint64([]byte(appData)))
+			if rtt := time.Now().UnixNano() - sendTime; rtt >= 0 {
+				atomic.StoreInt64(&this.rtt, rtt)
+			}
+		}
+		return nil
+	})
+}
+
+/*
+ *  在消息回调之前调用,返回true表示消息是ping/pong,已被心跳处理
+ */
+func (this *Heartbeat) OnMessage(msg interface{}) bool {
+	atomic.StoreInt32(&this.active, 1)
+
+	if nil != this.ws {
+		return false
+	}
+
+	if this.option.IsPong(msg) {
+		if pingTime := atomic.SwapInt64(&this.pingTime, 0); pingTime > 0 {
+			atomic.StoreInt64(&this.rtt, time.Now().UnixNano()-pingTime)
+		}
+		return true
+	}
+
+	if nil != this.option.IsPing && this.option.IsPing(msg) {
+		if nil != this.option.NewPong {
+			if pong := this.option.NewPong(msg); nil != pong {
+				this.send(pong)
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+func (this *Heartbeat) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.rtt))
+}
+
+func (this *Heartbeat) Start() {
+	if atomic.CompareAndSwapInt32(&this.startOnce, 0, 1) {
+		go this.run()
+	}
+}
+
+func (this *Heartbeat) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.stopC)
+	})
+}
+
+//ping/pong以最高优先级发送,避免排在大量数据之后导致误判超时
+func (this *Heartbeat) send(o interface{}) error {
+	if s, ok := this.session.(PrioritySender); ok {
+		return s.SendWithPriority(o, SendPriorityCount-1)
+	} else {
+		return this.session.Send(o)
+	}
+}
+
+func (this *Heartbeat) ping() {
+	now := time.Now()
+	if nil != this.ws {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(now.UnixNano()))
+		this.ws.WriteControl(gorilla.PingMessage, b[:], now.Add(this.option.Interval))
+	} else if nil == this.send(this.option.NewPing()) {
+		//上一个ping没有收到pong时保留其发送时间
+		atomic.CompareAndSwapInt64(&this.pingTime, 0, now.UnixNano())
+	}
+}
+
+func (this *Heartbeat) run() {
+	ticker := time.NewTicker(this.option.Interval)
+	defer ticker.Stop()
+
+	miss := 0
+
+	this.ping()
+
+	for {
+		select {
+		case <-this.stopC:
+			return
+		case <-ticker.C:
+			if atomic.SwapInt32(&this.active, 0) == 1 {
+				miss = 0
+			} else if miss++; miss >= this.option.MissCount {
+				this.Stop()
+				this.session.Close(kendynet.ErrHeartbeatTimeout, 0)
+				return
+			}
+			this.ping()
+		}
+	}
+}
+
+/*
+ *  启用心跳,必须在BeginRecv之前调用
+ */
+func (this *SocketBase) SetHeartbeat(option HeartbeatOption) error {
+	if atomic.LoadInt32(&this.beginOnce) == 1 {
+		return kendynet.ErrStarted
+	}
+
+	h, err := NewHeartbeat(this.imp, option)
+	if nil != err {
+		return err
+	}
+
+	this.heartbeat = h
+	return nil
+}
+
+/*
+ *  没有启用心跳或尚未测得时返回0
+ */
+func (this *SocketBase) RTT() time.Duration {
+	if nil == this.heartbeat {
+		return 0
+	} else {
+		return this.heartbeat.RTT()
+	}
+}
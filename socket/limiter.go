@@ -0,0 +1,278 @@
+package socket
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrMaxSessions       = errors.New("too many sessions")
+	ErrMaxSessionsPerIP  = errors.New("too many sessions from ip")
+	ErrAcceptRate        = errors.New("accept rate exceeded")
+	ErrIPDenied          = errors.New("ip denied")
+	ErrPreAcceptRejected = errors.New("rejected by pre accept hook")
+)
+
+type LimitOption struct {
+	MaxSessions      int                 //最大并发会话数,0不限制
+	MaxSessionsPerIP int                 //单个ip的最大并发会话数,0不限制
+	AcceptRate       float64             //每秒最多接受的连接数,0不限制
+	AcceptBurst      int                 //AcceptRate的突发容量,默认为AcceptRate向上取整
+	Allow            []string            //CIDR或ip,非空时只接受其中的地址
+	Deny             []string            //CIDR或ip,优先于Allow
+	PreAccept        func(net.Conn) bool //创建会话之前调用,返回false拒绝连接
+}
+
+type LimitStats struct {
+	Sessions            int    //当前会话数
+	Accepted            uint64 //累计接受的连接
+	Rejected            uint64 //累计拒绝的连接,以下各项之和
+	RejectedMaxSessions uint64
+	RejectedPerIP       uint64
+	RejectedRate        uint64
+	RejectedIP          uint64
+	RejectedPreAccept   uint64
+}
+
+/*
+ *  监听器的连接限制
+ *
+ *  检查顺序为ip过滤,接受速率,PreAccept,会话数。被拒绝的连接由监听器直接关闭,不会创建会话。
+ *  同一个Limiter可以被多个监听器共享,此时所有限制对这些监听器合并计算。
+ */
+type Limiter struct {
+	//原子操作的计数器放在最前面以保证64位对齐
+	accepted            uint64
+	rejectedMaxSessions uint64
+	rejectedPerIP       uint64
+	rejectedRate        uint64
+	rejectedIP          uint64
+	rejectedPreAccept   uint64
+
+	mu       sync.Mutex
+	option   LimitOption
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	sessions int
+	perIP    map[string]int
+	tokens   float64
+	burst    float64
+	last     time.Time
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if nil == ip {
+				return nil, fmt.Errorf("invaild ip:%s", v)
+			}
+			if nil != ip.To4() {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if nil != err {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func NewLimiter(option LimitOption) (*Limiter, error) {
+	allow, err := parseCIDRs(option.Allow)
+	if nil != err {
+		return nil, err
+	}
+
+	deny, err := parseCIDRs(option.Deny)
+	if nil != err {
+		return nil, err
+	}
+
+	l := &Limiter{
+		option: option,
+		allow:  allow,
+		deny:   deny,
+		perIP:  map[string]int{},
+	}
+
+	if option.AcceptRate > 0 {
+		l.burst = float64(option.AcceptBurst)
+		if l.burst < 1 {
+			l.burst = math.Ceil(option.AcceptRate)
+		}
+		l.tokens = l.burst
+		l.last = time.Now()
+	}
+
+	return l, nil
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); nil == err {
+			return net.ParseIP(host)
+		}
+		return nil
+	}
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Limiter) checkIP(ip net.IP) bool {
+	if nil == ip {
+		return len(this.allow) == 0
+	}
+
+	if contains(this.deny, ip) {
+		return false
+	}
+
+	return len(this.allow) == 0 || contains(this.allow, ip)
+}
+
+func (this *Limiter) takeToken() bool {
+	if this.option.AcceptRate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.option.AcceptRate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+
+	if this.tokens < 1 {
+		return false
+	}
+
+	this.tokens--
+	return true
+}
+
+/*
+ *  检查新连接,通过时返回release,会话结束(或连接被关闭)时必须调用一次release
+ */
+func (this *Limiter) Accept(conn net.Conn) (release func(), err error) {
+	ip := remoteIP(conn)
+
+	if !this.checkIP(ip) {
+		atomic.AddUint64(&this.rejectedIP, 1)
+		return nil, ErrIPDenied
+	}
+
+	this.mu.Lock()
+	ok := this.takeToken()
+	this.mu.Unlock()
+
+	if !ok {
+		atomic.AddUint64(&this.rejectedRate, 1)
+		return nil, ErrAcceptRate
+	}
+
+	if nil != this.option.PreAccept {
+		if !this.option.PreAccept(conn) {
+			atomic.AddUint64(&this.rejectedPreAccept, 1)
+			return nil, ErrPreAcceptRejected
+		}
+	}
+
+	key := ""
+	if nil != ip {
+		key = ip.String()
+	}
+
+	this.mu.Lock()
+	if this.option.MaxSessions > 0 && this.sessions >= this.option.MaxSessions {
+		this.mu.Unlock()
+		atomic.AddUint64(&this.rejectedMaxSessions, 1)
+		return nil, ErrMaxSessions
+	}
+
+	if this.option.MaxSessionsPerIP > 0 && this.perIP[key] >= this.option.MaxSessionsPerIP {
+		this.mu.Unlock()
+		atomic.AddUint64(&this.rejectedPerIP, 1)
+		return nil, ErrMaxSessionsPerIP
+	}
+
+	this.sessions++
+	this.perIP[key]++
+	this.mu.Unlock()
+
+	atomic.AddUint64(&this.accepted, 1)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			this.mu.Lock()
+			this.sessions--
+			if this.perIP[key]--; this.perIP[key] <= 0 {
+				delete(this.perIP, key)
+			}
+			this.mu.Unlock()
+		})
+	}, nil
+}
+
+/*
+ *  在会话关闭时调用release,session为nil时立即调用
+ */
+func (this *Limiter) Track(session kendynet.StreamSession, release func()) {
+	if nil == session {
+		release()
+	} else if n, ok := session.(CloseNotifier); ok {
+		n.NotifyClose(func(kendynet.StreamSession, error) {
+			release()
+		})
+	} else {
+		//无法跟踪关闭的会话不计入会话数
+		release()
+	}
+}
+
+func (this *Limiter) Stats() LimitStats {
+	this.mu.Lock()
+	sessions := this.sessions
+	this.mu.Unlock()
+
+	s := LimitStats{
+		Sessions:            sessions,
+		Accepted:            atomic.LoadUint64(&this.accepted),
+		RejectedMaxSessions: atomic.LoadUint64(&this.rejectedMaxSessions),
+		RejectedPerIP:       atomic.LoadUint64(&this.rejectedPerIP),
+		RejectedRate:        atomic.LoadUint64(&this.rejectedRate),
+		RejectedIP:          atomic.LoadUint64(&this.rejectedIP),
+		RejectedPreAccept:   atomic.LoadUint64(&this.rejectedPreAccept),
+	}
+
+	s.Rejected = s.RejectedMaxSessions + s.RejectedPerIP + s.RejectedRate + s.RejectedIP + s.RejectedPreAccept
+
+	return s
+}
@@ -1,7 +1,9 @@
 package aio
 
 import (
+    "context"
     "github.com/sniperHW/kendynet"
+    "github.com/sniperHW/kendynet/socket"
     "github.com/sniperHW/kendynet/socket/aio"
     "net"
     "sync/atomic"
@@ -12,6 +14,8 @@ type Listener struct {
     started  int32
     closed   int32
     s        *aio.SocketService
+    limiter  *socket.Limiter
+    tracker  socket.SessionTracker
 }
 
 func New(s *aio.SocketService, nettype, service string) (*Listener, error) {
@@ -35,6 +39,26 @@ func (this *Listener) Close() {
     }
 }
 
+/*
+ *  停止接受新连接,以kendynet.ErrServerShutdown关闭所有已接受的会话(尽量发送完发送队列中的数据),
+ *  等待所有会话的关闭回调返回或ctx结束
+ */
+func (this *Listener) Shutdown(ctx context.Context) error {
+    this.Close()
+    return this.tracker.Shutdown(ctx)
+}
+
+/*
+ *  设置连接限制,必须在Serve之前调用
+ */
+func (this *Listener) SetLimiter(limiter *socket.Limiter) error {
+    if atomic.LoadInt32(&this.started) == 1 {
+        return kendynet.ErrServerStarted
+    }
+    this.limiter = limiter
+    return nil
+}
+
 func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
 
     if nil == onNewClient {
@@ -59,9 +83,25 @@ func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
                 return err
             }
 
-        } else {
+        } else if nil == this.limiter {
+
+            if session := aio.NewSocket(this.s, conn); nil == session {
+                conn.Close()
+            } else if this.tracker.Add(session) {
+                onNewClient(session)
+            }
 
-            onNewClient(aio.NewSocket(this.s, conn))
+        } else if release, err := this.limiter.Accept(conn); nil != err {
+            kendynet.GetLogger().Debugf("reject %s:%s\n", conn.RemoteAddr().String(), err.Error())
+            conn.Close()
+        } else if session := aio.NewSocket(this.s, conn); nil == session {
+            conn.Close()
+            release()
+        } else {
+            this.limiter.Track(session, release)
+            if this.tracker.Add(session) {
+                onNewClient(session)
+            }
         }
     }
 }
@@ -0,0 +1,111 @@
+package rudp
+
+import (
+	"context"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"github.com/sniperHW/kendynet/socket/rudp"
+	"net"
+	"sync/atomic"
+)
+
+type Listener struct {
+	listener *rudp.Listener
+	started  int32
+	closed   int32
+	limiter  *socket.Limiter
+	tracker  socket.SessionTracker
+}
+
+/*
+ *  config为nil时使用rudp.DefaultConfig(),客户端与服务端的MTU及窗口配置应保持一致
+ */
+func New(nettype, service string, config ...*rudp.Config) (*Listener, error) {
+	var c *rudp.Config
+	if len(config) > 0 {
+		c = config[0]
+	}
+	listener, err := rudp.Listen(nettype, service, c)
+	if err != nil {
+		kendynet.GetLogger().Errorf("ListenRUDP service:%s error:%s\n", service, err.Error())
+		return nil, err
+	}
+	return &Listener{listener: listener}, nil
+}
+
+func (this *Listener) Close() {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		this.listener.Close()
+	}
+}
+
+/*
+ *  以kendynet.ErrServerShutdown关闭所有已接受的会话(尽量发送完发送队列中的数据),等待所有会话的关闭回调返回或ctx结束,
+ *  然后关闭监听。
+ *
+ *  rudp.Listener关闭时会关闭由其创建的所有连接,所以先等待会话结束再关闭,期间新接受的会话被直接关闭
+ */
+func (this *Listener) Shutdown(ctx context.Context) error {
+	err := this.tracker.Shutdown(ctx)
+	this.Close()
+	return err
+}
+
+/*
+ *  设置连接限制,必须在Serve之前调用
+ */
+func (this *Listener) SetLimiter(limiter *socket.Limiter) error {
+	if atomic.LoadInt32(&this.started) == 1 {
+		return kendynet.ErrServerStarted
+	}
+	this.limiter = limiter
+	return nil
+}
+
+func (this *Listener) limit(conn net.Conn) (func(), bool) {
+	if nil == this.limiter {
+		return nil, true
+	}
+
+	release, err := this.limiter.Accept(conn)
+	if nil != err {
+		kendynet.GetLogger().Debugf("reject %s:%s\n", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return nil, false
+	}
+
+	return release, true
+}
+
+func (this *Listener) onNewSession(session kendynet.StreamSession, release func(), onNewClient func(kendynet.StreamSession)) {
+	if nil != release {
+		this.limiter.Track(session, release)
+	}
+
+	if this.tracker.Add(session) {
+		onNewClient(session)
+	}
+}
+
+func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
+
+	if nil == onNewClient {
+		return kendynet.ErrInvaildNewClientCB
+	}
+
+	if !atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		return kendynet.ErrServerStarted
+	}
+
+	for {
+		conn, err := this.listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&this.closed) == 1 {
+				return nil
+			}
+			return err
+		} else if release, ok := this.limit(conn); ok {
+			this.onNewSession(socket.NewStreamSocket(conn), release, onNewClient)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package rudp
+
+import (
+	"context"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"github.com/sniperHW/kendynet/socket/rudp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func init() {
+	kendynet.InitLogger(&kendynet.EmptyLogger{})
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := New("udp", "localhost:8147", rudp.FastConfig())
+	assert.Nil(t, err)
+
+	assert.Equal(t, kendynet.ErrInvaildNewClientCB, l.Serve(nil))
+
+	recvC := make(chan struct{})
+	closeC := make(chan error, 1)
+	serveC := make(chan error, 1)
+
+	go func() {
+		serveC <- l.Serve(func(session kendynet.StreamSession) {
+			session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+				closeC <- reason
+			})
+			session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+				s.Send(append([]byte("echo:"), msg.([]byte)...))
+				close(recvC)
+			})
+		})
+	}()
+
+	conn, err := rudp.Dial("udp", "localhost:8147", rudp.FastConfig())
+	assert.Nil(t, err)
+
+	respC := make(chan string, 1)
+	session := socket.NewStreamSocket(conn)
+	session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+		respC <- string(msg.([]byte))
+	})
+	defer session.Close(nil, 0)
+
+	session.Send([]byte("hello"))
+	<-recvC
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	//Shutdown在会话关闭回调返回之后返回,并关闭监听
+	assert.Nil(t, l.Shutdown(ctx))
+	assert.Equal(t, kendynet.ErrServerShutdown, <-closeC)
+	assert.Nil(t, <-serveC)
+
+	//关闭前放入发送队列的数据已经发出
+	select {
+	case resp := <-respC:
+		assert.Equal(t, "echo:hello", resp)
+	case <-time.After(time.Second):
+		t.Fatal("response lost")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l, err := New("udp", "localhost:8149", rudp.FastConfig())
+	assert.Nil(t, err)
+
+	limiter, _ := socket.NewLimiter(socket.LimitOption{MaxSessions: 1})
+	assert.Nil(t, l.SetLimiter(limiter))
+
+	sessionC := make(chan kendynet.StreamSession, 2)
+
+	go l.Serve(func(session kendynet.StreamSession) {
+		sessionC <- session
+	})
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, kendynet.ErrServerStarted, l.SetLimiter(nil))
+
+	c1, err := rudp.Dial("udp", "localhost:8149", rudp.FastConfig())
+	assert.Nil(t, err)
+	defer c1.Close()
+	c1.Write([]byte("hello"))
+
+	session := <-sessionC
+
+	//超过会话数的连接被拒绝,不回调onNewClient
+	c2, err := rudp.Dial("udp", "localhost:8149", rudp.FastConfig())
+	if nil == err {
+		defer c2.Close()
+		c2.Write([]byte("hello"))
+	}
+
+	time.Sleep(time.Millisecond * 200)
+
+	assert.Equal(t, 0, len(sessionC))
+	assert.Equal(t, uint64(1), limiter.Stats().RejectedMaxSessions)
+
+	session.Close(nil, 0)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, 0, limiter.Stats().Sessions)
+
+	l.Close()
+}
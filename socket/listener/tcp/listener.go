@@ -1,16 +1,25 @@
 package tcp
 
 import (
+    "context"
+    "crypto/tls"
     "github.com/sniperHW/kendynet"
     "github.com/sniperHW/kendynet/socket"
     "net"
     "sync/atomic"
+    "time"
 )
 
+const DefaultHandshakeTimeout = 10 * time.Second
+
 type Listener struct {
-    listener *net.TCPListener
-    started  int32
-    closed   int32
+    listener         *net.TCPListener
+    started          int32
+    closed           int32
+    tlsConfig        *tls.Config
+    handshakeTimeout time.Duration
+    limiter          *socket.Limiter
+    tracker          socket.SessionTracker
 }
 
 func New(nettype, service string) (*Listener, error) {
@@ -26,6 +35,31 @@ func New(nettype, service string) (*Listener, error) {
     return &Listener{listener: listener}, nil
 }
 
+/*
+ *  tls监听,config至少需要提供服务端证书,要求客户端证书(mTLS)时设置ClientAuth及ClientCAs。
+ *
+ *  握手在独立的goroutine中进行,handshakeTimeout内未完成握手的连接被关闭,默认为DefaultHandshakeTimeout。
+ *  握手成功后才回调onNewClient,可通过session.(*socket.StreamSocket).PeerCertificates()获取客户端证书
+ */
+func NewTLS(nettype, service string, config *tls.Config, handshakeTimeout ...time.Duration) (*Listener, error) {
+    if nil == config {
+        return nil, kendynet.ErrInvaildTLSConfig
+    }
+
+    l, err := New(nettype, service)
+    if err != nil {
+        return nil, err
+    }
+
+    l.tlsConfig = config
+    l.handshakeTimeout = DefaultHandshakeTimeout
+    if len(handshakeTimeout) > 0 && handshakeTimeout[0] > 0 {
+        l.handshakeTimeout = handshakeTimeout[0]
+    }
+
+    return l, nil
+}
+
 func (this *Listener) Close() {
     if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
         if nil != this.listener {
@@ -34,6 +68,51 @@ func (this *Listener) Close() {
     }
 }
 
+/*
+ *  停止接受新连接,以kendynet.ErrServerShutdown关闭所有已接受的会话(尽量发送完发送队列中的数据),
+ *  等待所有会话的关闭回调返回或ctx结束
+ */
+func (this *Listener) Shutdown(ctx context.Context) error {
+    this.Close()
+    return this.tracker.Shutdown(ctx)
+}
+
+/*
+ *  设置连接限制,必须在Serve之前调用
+ */
+func (this *Listener) SetLimiter(limiter *socket.Limiter) error {
+    if atomic.LoadInt32(&this.started) == 1 {
+        return kendynet.ErrServerStarted
+    }
+    this.limiter = limiter
+    return nil
+}
+
+func (this *Listener) limit(conn net.Conn) (func(), bool) {
+    if nil == this.limiter {
+        return nil, true
+    }
+
+    release, err := this.limiter.Accept(conn)
+    if nil != err {
+        kendynet.GetLogger().Debugf("reject %s:%s\n", conn.RemoteAddr().String(), err.Error())
+        conn.Close()
+        return nil, false
+    }
+
+    return release, true
+}
+
+func (this *Listener) onNewSession(session kendynet.StreamSession, release func(), onNewClient func(kendynet.StreamSession)) {
+    if nil != release {
+        this.limiter.Track(session, release)
+    }
+
+    if this.tracker.Add(session) {
+        onNewClient(session)
+    }
+}
+
 func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
 
     if nil == onNewClient {
@@ -58,9 +137,37 @@ func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
                 return err
             }
 
+        } else if release, ok := this.limit(conn); !ok {
+            continue
+        } else if nil != this.tlsConfig {
+            go this.handshake(conn, release, onNewClient)
         } else {
 
-            onNewClient(socket.NewStreamSocket(conn))
+            this.onNewSession(socket.NewStreamSocket(conn), release, onNewClient)
+        }
+    }
+}
+
+func (this *Listener) handshake(conn net.Conn, release func(), onNewClient func(kendynet.StreamSession)) {
+    tlsConn := tls.Server(conn, this.tlsConfig)
+    tlsConn.SetDeadline(time.Now().Add(this.handshakeTimeout))
+    if err := tlsConn.Handshake(); err != nil {
+        kendynet.GetLogger().Errorf("tls handshake with %s error:%s\n", conn.RemoteAddr().String(), err.Error())
+        conn.Close()
+        if nil != release {
+            release()
         }
+        return
     }
+    tlsConn.SetDeadline(time.Time{})
+
+    if atomic.LoadInt32(&this.closed) == 1 {
+        conn.Close()
+        if nil != release {
+            release()
+        }
+        return
+    }
+
+    this.onNewSession(socket.NewStreamSocket(tlsConn), release, onNewClient)
 }
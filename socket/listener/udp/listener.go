@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"context"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"net"
+	"sync/atomic"
+)
+
+/*
+ *  每个对端地址对应一个DatagramSocket会话,会话需通过SetRecvTimeout设置空闲超时
+ */
+type Listener struct {
+	mux     *socket.UDPMux
+	started int32
+	limiter *socket.Limiter
+	tracker socket.SessionTracker
+}
+
+func New(nettype, service string, recvQueueSize ...int) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr(nettype, service)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(nettype, udpAddr)
+	if err != nil {
+		kendynet.GetLogger().Errorf("ListenUDP service:%s error:%s\n", service, err.Error())
+		return nil, err
+	}
+	return &Listener{mux: socket.NewUDPMux(conn, recvQueueSize...)}, nil
+}
+
+func (this *Listener) Close() {
+	this.mux.Close()
+}
+
+/*
+ *  以kendynet.ErrServerShutdown关闭所有会话(尽量发送完发送队列中的数据),等待所有会话的关闭回调返回或ctx结束,
+ *  然后关闭监听。
+ *
+ *  所有会话共享同一个UDPConn,所以先等待会话结束再关闭,期间新地址的会话被直接关闭
+ */
+func (this *Listener) Shutdown(ctx context.Context) error {
+	err := this.tracker.Shutdown(ctx)
+	this.Close()
+	return err
+}
+
+/*
+ *  设置连接限制,必须在Serve之前调用。来自新地址的首个数据报视为一次连接,被拒绝的地址再次发来数据报时重新检查
+ */
+func (this *Listener) SetLimiter(limiter *socket.Limiter) error {
+	if atomic.LoadInt32(&this.started) == 1 {
+		return kendynet.ErrServerStarted
+	}
+	this.limiter = limiter
+	return nil
+}
+
+func (this *Listener) onNewSession(session kendynet.StreamSession, onNewClient func(kendynet.StreamSession)) {
+	if nil != this.limiter {
+		release, err := this.limiter.Accept(session.GetUnderConn().(net.Conn))
+		if nil != err {
+			kendynet.GetLogger().Debugf("reject %s:%s\n", session.RemoteAddr().String(), err.Error())
+			session.Close(err, 0)
+			return
+		}
+		this.limiter.Track(session, release)
+	}
+
+	if this.tracker.Add(session) {
+		onNewClient(session)
+	}
+}
+
+func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
+
+	if nil == onNewClient {
+		return kendynet.ErrInvaildNewClientCB
+	}
+
+	if !atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		return kendynet.ErrServerStarted
+	}
+
+	return this.mux.Serve(func(session kendynet.StreamSession) {
+		this.onNewSession(session, onNewClient)
+	})
+}
@@ -0,0 +1,116 @@
+package udp
+
+import (
+	"context"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func init() {
+	kendynet.InitLogger(&kendynet.EmptyLogger{})
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := New("udp", "localhost:8146")
+	assert.Nil(t, err)
+
+	assert.Equal(t, kendynet.ErrInvaildNewClientCB, l.Serve(nil))
+
+	recvC := make(chan struct{})
+	closeC := make(chan error, 1)
+	serveC := make(chan error, 1)
+
+	go func() {
+		serveC <- l.Serve(func(session kendynet.StreamSession) {
+			session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+				closeC <- reason
+			})
+			session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+				s.Send(append([]byte("echo:"), msg.([]byte)...))
+				close(recvC)
+			})
+		})
+	}()
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", "localhost:8146")
+	c, err := net.DialUDP("udp", nil, udpAddr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	c.Write([]byte("hello"))
+	<-recvC
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	//Shutdown在会话关闭回调返回之后返回,并关闭监听
+	assert.Nil(t, l.Shutdown(ctx))
+	assert.Equal(t, kendynet.ErrServerShutdown, <-closeC)
+	assert.Nil(t, <-serveC)
+
+	//关闭前放入发送队列的数据报已经发出
+	buff := make([]byte, 64)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(buff)
+	assert.Nil(t, err)
+	assert.Equal(t, "echo:hello", string(buff[:n]))
+}
+
+func TestLimiter(t *testing.T) {
+	l, err := New("udp", "localhost:8148")
+	assert.Nil(t, err)
+
+	limiter, _ := socket.NewLimiter(socket.LimitOption{MaxSessions: 1})
+	assert.Nil(t, l.SetLimiter(limiter))
+
+	sessionC := make(chan kendynet.StreamSession, 2)
+
+	go l.Serve(func(session kendynet.StreamSession) {
+		sessionC <- session
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			s.Send(msg)
+		})
+	})
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, kendynet.ErrServerStarted, l.SetLimiter(nil))
+
+	udpAddr, _ := net.ResolveUDPAddr("udp", "localhost:8148")
+	buff := make([]byte, 64)
+
+	c1, _ := net.DialUDP("udp", nil, udpAddr)
+	defer c1.Close()
+	c1.Write([]byte("hello"))
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c1.Read(buff)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buff[:n]))
+
+	//超过会话数的地址被拒绝,不回调onNewClient
+	c2, _ := net.DialUDP("udp", nil, udpAddr)
+	defer c2.Close()
+	c2.Write([]byte("hello"))
+	c2.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err = c2.Read(buff)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 1, len(sessionC))
+	assert.Equal(t, uint64(1), limiter.Stats().RejectedMaxSessions)
+
+	//会话关闭后释放名额
+	(<-sessionC).Close(nil, 0)
+	time.Sleep(time.Millisecond * 100)
+
+	c2.Write([]byte("world"))
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = c2.Read(buff)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buff[:n]))
+
+	l.Close()
+}
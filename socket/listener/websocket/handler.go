@@ -0,0 +1,233 @@
+package websocket
+
+import (
+	"context"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/socket"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+type Option struct {
+	Upgrader       *gorilla.Upgrader           //为nil时使用允许所有origin的默认Upgrader
+	Subprotocols   []string                    //服务端支持的子协议,按优先级排列,覆盖Upgrader.Subprotocols
+	OnAccept       func(r *http.Request) error //升级之前调用,返回非nil拒绝升级,以http.StatusForbidden及错误信息回应
+	TrustedProxies []string                    //可信代理的CIDR或ip,来自这些地址的请求通过X-Forwarded-For/X-Real-IP获取客户端ip
+	Compression    *socket.WSCompressionOption //非nil时与客户端协商permessage-deflate
+}
+
+/*
+ *  websocket升级处理,实现http.Handler,可以挂载到任意的http.ServeMux或http.Server上。
+ *
+ *  升级成功后以socket.NewWSSocket创建会话,会话的Request()返回升级请求,Subprotocol()返回协商的子协议。
+ */
+type Handler struct {
+	upgrader       *gorilla.Upgrader
+	onAccept       func(r *http.Request) error
+	trustedProxies []*net.IPNet
+	compression    *socket.WSCompressionOption
+	onNewClient    func(kendynet.StreamSession)
+	limiter        *socket.Limiter
+	tracker        socket.SessionTracker
+	shutdown       int32
+}
+
+func defaultUpgrader() *gorilla.Upgrader {
+	return &gorilla.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			// allow all connections by default
+			return true
+		},
+	}
+}
+
+func NewHandler(onNewClient func(kendynet.StreamSession), option ...Option) (*Handler, error) {
+	if nil == onNewClient {
+		return nil, kendynet.ErrInvaildNewClientCB
+	}
+
+	h := &Handler{
+		onNewClient: onNewClient,
+	}
+
+	if err := h.setOption(option...); nil != err {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (this *Handler) setOption(option ...Option) error {
+	this.upgrader = defaultUpgrader()
+
+	if len(option) == 0 {
+		return nil
+	}
+
+	o := option[0]
+
+	if nil != o.Upgrader {
+		this.upgrader = o.Upgrader
+	}
+
+	if len(o.Subprotocols) > 0 {
+		upgrader := *this.upgrader
+		upgrader.Subprotocols = o.Subprotocols
+		this.upgrader = &upgrader
+	}
+
+	if nil != o.Compression {
+		if err := o.Compression.Check(); nil != err {
+			return err
+		}
+		upgrader := *this.upgrader
+		upgrader.EnableCompression = true
+		this.upgrader = &upgrader
+		compression := *o.Compression
+		this.compression = &compression
+	}
+
+	this.onAccept = o.OnAccept
+
+	for _, v := range o.TrustedProxies {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); nil != ip && nil != ip.To4() {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(v)
+		if nil != err {
+			return err
+		}
+		this.trustedProxies = append(this.trustedProxies, n)
+	}
+
+	return nil
+}
+
+/*
+ *  设置连接限制,必须在开始处理请求之前调用。
+ *  使用RemoteIP作为连接的地址,检查在websocket握手完成之后进行,被拒绝的连接直接关闭
+ */
+func (this *Handler) SetLimiter(limiter *socket.Limiter) {
+	this.limiter = limiter
+}
+
+func (this *Handler) isTrusted(ip net.IP) bool {
+	for _, n := range this.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  请求的客户端ip。请求来自可信代理时,取X-Forwarded-For中从右往左第一个不可信的地址,
+ *  没有X-Forwarded-For时取X-Real-IP
+ */
+func (this *Handler) RemoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if nil != err {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if nil == ip || !this.isTrusted(ip) {
+		return ip
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		addrs := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			v := net.ParseIP(strings.TrimSpace(addrs[i]))
+			if nil == v {
+				break
+			}
+			ip = v
+			if !this.isTrusted(v) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if v := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); nil != v {
+		return v
+	}
+
+	return ip
+}
+
+//以RemoteIP作为远端地址,用于Limiter
+type remoteIPConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (this *remoteIPConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func (this *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&this.shutdown) == 1 {
+		http.Error(w, kendynet.ErrServerShutdown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if nil != this.onAccept {
+		if err := this.onAccept(r); nil != err {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	c, err := this.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		kendynet.GetLogger().Errorf("wssocket Upgrade failed:%s\n", err.Error())
+		return
+	}
+
+	var release func()
+	if nil != this.limiter {
+		conn := c.UnderlyingConn()
+		if ip := this.RemoteIP(r); nil != ip {
+			conn = &remoteIPConn{Conn: conn, addr: &net.TCPAddr{IP: ip}}
+		}
+
+		if release, err = this.limiter.Accept(conn); nil != err {
+			kendynet.GetLogger().Debugf("reject %s:%s\n", conn.RemoteAddr().String(), err.Error())
+			c.Close()
+			return
+		}
+	}
+
+	sess := socket.NewWSSocket(c, r)
+
+	if nil != this.compression {
+		sess.(*socket.WebSocket).SetCompression(*this.compression)
+	}
+
+	if nil != release {
+		this.limiter.Track(sess, release)
+	}
+
+	if this.tracker.Add(sess) {
+		this.onNewClient(sess)
+	}
+}
+
+/*
+ *  拒绝新的升级请求,以kendynet.ErrServerShutdown关闭所有已接受的会话,
+ *  等待所有会话的关闭回调返回或ctx结束
+ */
+func (this *Handler) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&this.shutdown, 1)
+	return this.tracker.Shutdown(ctx)
+}
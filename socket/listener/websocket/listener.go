@@ -1,6 +1,7 @@
 package websocket
 
 import (
+	"context"
 	gorilla "github.com/gorilla/websocket"
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/socket"
@@ -9,14 +10,32 @@ import (
 	"sync/atomic"
 )
 
+/*
+ *  在私有的http.ServeMux上处理origin路径的websocket升级,不占用http.DefaultServeMux。
+ *  需要挂载到已有的http服务时使用NewHandler
+ */
 type Listener struct {
 	listener *net.TCPListener
-	upgrader *gorilla.Upgrader
+	handler  *Handler
 	origin   string
 	started  int32
+	closed   int32
 }
 
 func New(nettype string, service string, origin string, upgrader ...*gorilla.Upgrader) (*Listener, error) {
+	option := Option{}
+	if len(upgrader) > 0 {
+		option.Upgrader = upgrader[0]
+	}
+	return NewWithOption(nettype, service, origin, option)
+}
+
+func NewWithOption(nettype string, service string, origin string, option Option) (*Listener, error) {
+	handler := &Handler{}
+	if err := handler.setOption(option); nil != err {
+		return nil, err
+	}
+
 	tcpAddr, err := net.ResolveTCPAddr(nettype, service)
 	if err != nil {
 		return nil, err
@@ -26,29 +45,44 @@ func New(nettype string, service string, origin string, upgrader ...*gorilla.Upg
 		return nil, err
 	}
 
-	l := &Listener{
+	return &Listener{
 		listener: listener,
+		handler:  handler,
 		origin:   origin,
-	}
+	}, nil
+}
 
-	if len(upgrader) > 0 {
-		l.upgrader = upgrader[0]
-	} else {
-		l.upgrader = &gorilla.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				// allow all connections by default
-				return true
-			},
+func (this *Listener) Close() {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		if nil != this.listener {
+			this.listener.Close()
 		}
 	}
+}
 
-	return l, nil
+/*
+ *  停止接受新连接,以kendynet.ErrServerShutdown关闭所有已接受的会话(尽量发送完发送队列中的数据),
+ *  等待所有会话的关闭回调返回或ctx结束
+ */
+func (this *Listener) Shutdown(ctx context.Context) error {
+	this.Close()
+	return this.handler.Shutdown(ctx)
 }
 
-func (this *Listener) Close() {
-	if nil != this.listener {
-		this.listener.Close()
+/*
+ *  设置连接限制,必须在Serve之前调用。
+ *  检查在websocket握手完成之后进行,被拒绝的连接直接关闭
+ */
+func (this *Listener) SetLimiter(limiter *socket.Limiter) error {
+	if atomic.LoadInt32(&this.started) == 1 {
+		return kendynet.ErrServerStarted
 	}
+	this.handler.SetLimiter(limiter)
+	return nil
+}
+
+func (this *Listener) Addr() net.Addr {
+	return this.listener.Addr()
 }
 
 func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
@@ -61,17 +95,17 @@ func (this *Listener) Serve(onNewClient func(kendynet.StreamSession)) error {
 		return kendynet.ErrServerStarted
 	}
 
-	http.HandleFunc(this.origin, func(w http.ResponseWriter, r *http.Request) {
-		c, err := this.upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			kendynet.GetLogger().Errorf("wssocket Upgrade failed:%s\n", err.Error())
-			return
-		}
-		sess := socket.NewWSSocket(c)
-		onNewClient(sess)
-	})
+	this.handler.onNewClient = onNewClient
+
+	mux := http.NewServeMux()
+	mux.Handle(this.origin, this.handler)
+
+	err := http.Serve(this.listener, mux)
+
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return nil
+	}
 
-	err := http.Serve(this.listener, nil)
 	if err != nil {
 		kendynet.GetLogger().Errorf("http.Serve() failed:%s\n", err.Error())
 	}
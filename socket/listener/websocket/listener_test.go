@@ -0,0 +1,215 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/message"
+	"github.com/sniperHW/kendynet/socket"
+	connector "github.com/sniperHW/kendynet/socket/connector/websocket"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	kendynet.InitLogger(&kendynet.EmptyLogger{})
+}
+
+func echo(session kendynet.StreamSession) {
+	session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+		s.Send(msg.(*message.WSMessage).Data().([]byte))
+	})
+}
+
+func dialEcho(t *testing.T, url string, header http.Header, subprotocols ...string) (string, *http.Response, error) {
+	dialer := &gorilla.Dialer{Subprotocols: subprotocols}
+	conn, resp, err := dialer.Dial(url, header)
+	if nil != err {
+		return "", resp, err
+	}
+	defer conn.Close()
+	assert.Nil(t, conn.WriteMessage(gorilla.BinaryMessage, []byte("hello")))
+	_, b, err := conn.ReadMessage()
+	return string(b), resp, err
+}
+
+func TestListener(t *testing.T) {
+	//两个监听使用相同的origin互不影响
+	l1, err := New("tcp", "localhost:8135", "/ws")
+	assert.Nil(t, err)
+	l2, err := New("tcp", "localhost:8136", "/ws")
+	assert.Nil(t, err)
+
+	go l1.Serve(echo)
+	go l2.Serve(echo)
+
+	time.Sleep(time.Millisecond * 100)
+
+	assert.Equal(t, kendynet.ErrServerStarted, l1.Serve(echo))
+
+	for _, addr := range []string{"localhost:8135", "localhost:8136"} {
+		resp, _, err := dialEcho(t, "ws://"+addr+"/ws", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", resp)
+	}
+
+	l1.Close()
+	l2.Close()
+
+	_, err = NewWithOption("tcp", "localhost:8135", "/ws", Option{TrustedProxies: []string{"abc"}})
+	assert.NotNil(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	_, err := NewHandler(nil)
+	assert.Equal(t, kendynet.ErrInvaildNewClientCB, err)
+
+	sessions := make(chan *socket.WebSocket, 1)
+
+	var handler *Handler
+
+	handler, err = NewHandler(func(session kendynet.StreamSession) {
+		sessions <- session.(*socket.WebSocket)
+		echo(session)
+	}, Option{
+		Subprotocols:   []string{"v2", "v1"},
+		TrustedProxies: []string{"127.0.0.1"},
+		OnAccept: func(r *http.Request) error {
+			if r.URL.Query().Get("token") != "123" {
+				return errors.New("invaild token")
+			}
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+
+	//挂载到已有的http服务
+	mux := http.NewServeMux()
+	mux.Handle("/ws", handler)
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("world"))
+	})
+
+	listener, _ := net.Listen("tcp", "localhost:8137")
+	go http.Serve(listener, mux)
+
+	//拒绝升级
+	_, resp, err := dialEcho(t, "ws://localhost:8137/ws?token=abc", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	header := http.Header{}
+	header.Set("Cookie", "name=kendynet")
+	header.Set("X-Forwarded-For", "1.2.3.4, 127.0.0.1")
+
+	echoResp, resp, err := dialEcho(t, "ws://localhost:8137/ws?token=123", header, "v1", "v2")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", echoResp)
+	assert.Equal(t, "v2", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	session := <-sessions
+	assert.Equal(t, "v2", session.Subprotocol())
+	assert.NotNil(t, session.Request())
+	cookie, err := session.Request().Cookie("name")
+	assert.Nil(t, err)
+	assert.Equal(t, "kendynet", cookie.Value)
+	assert.Equal(t, "1.2.3.4", handler.RemoteIP(session.Request()).String())
+
+	//不可信的来源忽略X-Forwarded-For
+	r, _ := http.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = "10.0.0.1:1000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "10.0.0.1", handler.RemoteIP(r).String())
+
+	r.RemoteAddr = "127.0.0.1:1000"
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Set("X-Real-IP", "5.6.7.8")
+	assert.Equal(t, "5.6.7.8", handler.RemoteIP(r).String())
+
+	//Shutdown之后拒绝新的升级
+	assert.Nil(t, handler.Shutdown(context.Background()))
+	_, resp, err = dialEcho(t, "ws://localhost:8137/ws?token=123", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	listener.Close()
+}
+
+type countConn struct {
+	net.Conn
+	n *int64
+}
+
+func (this *countConn) Read(b []byte) (int, error) {
+	n, err := this.Conn.Read(b)
+	atomic.AddInt64(this.n, int64(n))
+	return n, err
+}
+
+func TestCompressionAndStream(t *testing.T) {
+	_, err := NewWithOption("tcp", "localhost:8138", "/ws", Option{Compression: &socket.WSCompressionOption{Level: 10}})
+	assert.Equal(t, socket.ErrInvaildCompressionLevel, err)
+
+	l, err := NewWithOption("tcp", "localhost:8138", "/ws", Option{
+		Compression: &socket.WSCompressionOption{Threshold: 1024},
+	})
+	assert.Nil(t, err)
+
+	go l.Serve(func(session kendynet.StreamSession) {
+		//以流的方式接收,分片组成的大消息不需要一次读入内存
+		session.SetInBoundProcessor(socket.NewWSStreamInBoundProcessor())
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			m := msg.(*message.WSStreamMessage)
+			assert.Equal(t, message.WSBinaryMessage, m.Type())
+			n, err := io.Copy(ioutil.Discard, m.Reader())
+			assert.Nil(t, err)
+			s.Send(bytes.Repeat([]byte("a"), int(n)))
+		})
+	})
+
+	var readBytes int64
+
+	dialer := &gorilla.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if nil != err {
+				return nil, err
+			}
+			return &countConn{Conn: conn, n: &readBytes}, nil
+		},
+	}
+
+	c, _ := connector.New(url.URL{Scheme: "ws", Host: "localhost:8138", Path: "/ws"}, nil, dialer)
+	assert.Equal(t, socket.ErrInvaildCompressionLevel, c.SetCompression(socket.WSCompressionOption{Level: -3}))
+	assert.Nil(t, c.SetCompression(socket.WSCompressionOption{Threshold: 1024}))
+
+	session, resp, err := c.Dial(time.Second)
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	assert.Equal(t, time.Duration(0), dialer.HandshakeTimeout)
+
+	respC := make(chan []byte, 1)
+	session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+		respC <- msg.(*message.WSMessage).Data().([]byte)
+	})
+
+	size := 1024 * 1024
+	session.Send(bytes.Repeat([]byte("b"), size))
+
+	resp1 := <-respC
+	assert.Equal(t, size, len(resp1))
+	assert.Equal(t, byte('a'), resp1[0])
+	assert.True(t, atomic.LoadInt64(&readBytes) < int64(size/10))
+
+	session.Close(nil, 0)
+	l.Close()
+}
@@ -0,0 +1,276 @@
+package manager
+
+import (
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/buffer"
+	"github.com/sniperHW/kendynet/socket"
+	"sync"
+)
+
+type entry struct {
+	id      uint64
+	session kendynet.StreamSession
+	groups  map[string]struct{}
+}
+
+/*
+ *  会话管理
+ *
+ *  为加入的会话分配id,会话关闭时自动移除并退出所有分组。
+ *  Broadcast,Multicast,SendTo只编码一次,将编码后的[]byte投递到每个目标会话的发送队列,
+ *  因此目标会话的接收方必须能够解码encoder的输出(WebSocket以二进制消息发送)。
+ */
+type Manager struct {
+	mu       sync.RWMutex
+	encoder  kendynet.EnCoder
+	nextID   uint64
+	sessions map[uint64]*entry
+	groups   map[string]map[uint64]*entry
+}
+
+/*
+ *  encoder用于广播时编码消息,为nil时只能广播[]byte
+ */
+func New(encoder kendynet.EnCoder) *Manager {
+	return &Manager{
+		encoder:  encoder,
+		sessions: map[uint64]*entry{},
+		groups:   map[string]map[uint64]*entry{},
+	}
+}
+
+/*
+ *  加入会话并返回分配的id
+ *
+ *  会话关闭时先从管理器中移除再调用onClose。通过socket.CloseNotifier跟踪关闭,
+ *  不占用会话的关闭回调;未实现CloseNotifier的会话需要调用者自行Remove
+ */
+func (this *Manager) Add(session kendynet.StreamSession, onClose ...func(kendynet.StreamSession, error)) uint64 {
+	this.mu.Lock()
+	this.nextID++
+	e := &entry{
+		id:      this.nextID,
+		session: session,
+		groups:  map[string]struct{}{},
+	}
+	this.sessions[e.id] = e
+	this.mu.Unlock()
+
+	if n, ok := session.(socket.CloseNotifier); ok {
+		//会话已经关闭时回调会立即执行
+		n.NotifyClose(func(s kendynet.StreamSession, reason error) {
+			this.Remove(e.id)
+			if len(onClose) > 0 && nil != onClose[0] {
+				onClose[0](s, reason)
+			}
+		})
+	}
+
+	return e.id
+}
+
+/*
+ *  移除会话(不会关闭会话)
+ */
+func (this *Manager) Remove(id uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if e, ok := this.sessions[id]; ok {
+		delete(this.sessions, id)
+		for g, _ := range e.groups {
+			this.leave(g, e)
+		}
+	}
+}
+
+func (this *Manager) Get(id uint64) kendynet.StreamSession {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if e, ok := this.sessions[id]; ok {
+		return e.session
+	} else {
+		return nil
+	}
+}
+
+func (this *Manager) Len() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return len(this.sessions)
+}
+
+/*
+ *  遍历所有会话,fn返回false时停止。遍历期间持有读锁,fn中不能调用Manager的修改操作
+ */
+func (this *Manager) Range(fn func(uint64, kendynet.StreamSession) bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	for id, e := range this.sessions {
+		if !fn(id, e.session) {
+			return
+		}
+	}
+}
+
+/*
+ *  会话加入分组,会话不存在返回false
+ */
+func (this *Manager) Join(group string, id uint64) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	e, ok := this.sessions[id]
+	if !ok {
+		return false
+	}
+
+	members, ok := this.groups[group]
+	if !ok {
+		members = map[uint64]*entry{}
+		this.groups[group] = members
+	}
+
+	members[id] = e
+	e.groups[group] = struct{}{}
+	return true
+}
+
+func (this *Manager) Leave(group string, id uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if e, ok := this.sessions[id]; ok {
+		this.leave(group, e)
+	}
+}
+
+func (this *Manager) leave(group string, e *entry) {
+	delete(e.groups, group)
+	if members, ok := this.groups[group]; ok {
+		delete(members, e.id)
+		if len(members) == 0 {
+			delete(this.groups, group)
+		}
+	}
+}
+
+/*
+ *  返回分组中的会话id
+ */
+func (this *Manager) Members(group string) []uint64 {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	members := this.groups[group]
+	ids := make([]uint64, 0, len(members))
+	for id, _ := range members {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+/*
+ *  返回会话所在的分组
+ */
+func (this *Manager) Groups(id uint64) []string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	e, ok := this.sessions[id]
+	if !ok {
+		return nil
+	}
+	groups := make([]string, 0, len(e.groups))
+	for g, _ := range e.groups {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+func (this *Manager) encode(o interface{}) ([]byte, error) {
+	if nil == o {
+		return nil, kendynet.ErrInvaildObject
+	}
+
+	if b, ok := o.([]byte); ok {
+		return b, nil
+	}
+
+	if nil == this.encoder {
+		return nil, kendynet.ErrInvaildEncoder
+	}
+
+	//编码结果被多个发送队列共享,不能使用buffer.Get从池中获取
+	b := buffer.New()
+	if err := this.encoder.EnCode(o, b); nil != err {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+func send(bytes []byte, targets []kendynet.StreamSession) int {
+	count := 0
+	for _, s := range targets {
+		if nil == s.Send(bytes) {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+ *  向所有会话发送o,返回成功投递的会话数量(发送队列满或已关闭的会话被跳过)
+ */
+func (this *Manager) Broadcast(o interface{}) (int, error) {
+	bytes, err := this.encode(o)
+	if nil != err {
+		return 0, err
+	}
+
+	this.mu.RLock()
+	targets := make([]kendynet.StreamSession, 0, len(this.sessions))
+	for _, e := range this.sessions {
+		targets = append(targets, e.session)
+	}
+	this.mu.RUnlock()
+
+	return send(bytes, targets), nil
+}
+
+/*
+ *  向分组中的所有会话发送o
+ */
+func (this *Manager) Multicast(group string, o interface{}) (int, error) {
+	bytes, err := this.encode(o)
+	if nil != err {
+		return 0, err
+	}
+
+	this.mu.RLock()
+	members := this.groups[group]
+	targets := make([]kendynet.StreamSession, 0, len(members))
+	for _, e := range members {
+		targets = append(targets, e.session)
+	}
+	this.mu.RUnlock()
+
+	return send(bytes, targets), nil
+}
+
+/*
+ *  向指定的会话发送o,不存在的id被忽略
+ */
+func (this *Manager) SendTo(ids []uint64, o interface{}) (int, error) {
+	bytes, err := this.encode(o)
+	if nil != err {
+		return 0, err
+	}
+
+	this.mu.RLock()
+	targets := make([]kendynet.StreamSession, 0, len(ids))
+	for _, id := range ids {
+		if e, ok := this.sessions[id]; ok {
+			targets = append(targets, e.session)
+		}
+	}
+	this.mu.RUnlock()
+
+	return send(bytes, targets), nil
+}
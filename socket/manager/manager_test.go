@@ -0,0 +1,160 @@
+package manager
+
+import (
+	"errors"
+	"github.com/sniperHW/kendynet"
+	"github.com/sniperHW/kendynet/buffer"
+	connector "github.com/sniperHW/kendynet/socket/connector/tcp"
+	listener "github.com/sniperHW/kendynet/socket/listener/tcp"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	kendynet.InitLogger(&kendynet.EmptyLogger{})
+}
+
+type encoder struct {
+	count int
+}
+
+func (this *encoder) EnCode(o interface{}, b *buffer.Buffer) error {
+	switch o.(type) {
+	case string:
+		this.count++
+		b.AppendString(o.(string))
+	default:
+		return errors.New("invaild o")
+	}
+	return nil
+}
+
+type client struct {
+	mu   sync.Mutex
+	recv string
+}
+
+func (this *client) get() string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return this.recv
+}
+
+func TestManager(t *testing.T) {
+	e := &encoder{}
+	m := New(e)
+
+	closed := make(chan uint64, 3)
+
+	userClosed := make(chan struct{}, 3)
+
+	l, err := listener.New("tcp", "localhost:8132")
+	assert.Nil(t, err)
+
+	go l.Serve(func(session kendynet.StreamSession) {
+		var id uint64
+		id = m.Add(session, func(s kendynet.StreamSession, reason error) {
+			closed <- id
+		})
+		//Add不占用会话的关闭回调
+		session.SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+			userClosed <- struct{}{}
+		})
+		if id%2 == 1 {
+			assert.True(t, m.Join("room", id))
+		}
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {})
+	})
+
+	c, _ := connector.New("tcp", "localhost:8132")
+
+	var clients []*client
+	var sessions []kendynet.StreamSession
+
+	for i := 0; i < 3; i++ {
+		session, err := c.Dial(time.Second)
+		assert.Nil(t, err)
+		cli := &client{}
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			cli.mu.Lock()
+			cli.recv += string(msg.([]byte))
+			cli.mu.Unlock()
+		})
+		//按顺序建立连接,保证会话id与客户端对应
+		assert.Eventually(t, func() bool { return m.Len() == i+1 }, time.Second, time.Millisecond*10)
+		clients = append(clients, cli)
+		sessions = append(sessions, session)
+	}
+
+	members := m.Members("room")
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+	assert.Equal(t, []uint64{1, 3}, members)
+	assert.Equal(t, []string{"room"}, m.Groups(1))
+	assert.Equal(t, 0, len(m.Groups(2)))
+	assert.False(t, m.Join("room", 100))
+	assert.NotNil(t, m.Get(2))
+	assert.Nil(t, m.Get(100))
+
+	n, err := m.Broadcast("a")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	n, err = m.Multicast("room", "b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = m.SendTo([]uint64{2, 100}, "c")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = m.Multicast("none", "d")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	//每次广播只编码一次
+	assert.Equal(t, 4, e.count)
+
+	_, err = m.Broadcast(1)
+	assert.NotNil(t, err)
+
+	_, err = New(nil).Broadcast("a")
+	assert.Equal(t, kendynet.ErrInvaildEncoder, err)
+
+	_, err = m.Broadcast(nil)
+	assert.Equal(t, kendynet.ErrInvaildObject, err)
+
+	expected := []string{"ab", "ac", "ab"}
+	for i, cli := range clients {
+		assert.Eventually(t, func() bool { return cli.get() == expected[i] }, time.Second, time.Millisecond*10)
+	}
+
+	count := 0
+	m.Range(func(id uint64, s kendynet.StreamSession) bool {
+		count++
+		return true
+	})
+	assert.Equal(t, 3, count)
+
+	//会话关闭后自动移除并退出分组
+	sessions[0].Close(nil, 0)
+	assert.Equal(t, uint64(1), <-closed)
+	<-userClosed
+	assert.Equal(t, 2, m.Len())
+	assert.Nil(t, m.Get(1))
+	assert.Equal(t, []uint64{3}, m.Members("room"))
+
+	m.Leave("room", 3)
+	assert.Equal(t, 0, len(m.Members("room")))
+
+	m.Remove(2)
+	assert.Equal(t, 1, m.Len())
+
+	for _, s := range sessions {
+		s.Close(nil, 0)
+	}
+
+	l.Close()
+}
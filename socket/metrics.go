@@ -0,0 +1,301 @@
+package socket
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sniperHW/kendynet"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Metric int
+
+const (
+	MetricBytesIn      = Metric(iota) //从连接读取的字节数
+	MetricBytesOut                    //写入连接的字节数
+	MetricMessagesIn                  //交给消息回调的消息数
+	MetricMessagesOut                 //成功编码并提交写入的消息数
+	MetricEncodeErrors                //编码失败被丢弃的消息数
+	MetricRecvTimeouts                //接收超时次数
+	MetricSendTimeouts                //发送超时次数
+	MetricSendDrops                   //被发送队列溢出策略丢弃的消息数
+	MetricSendErrors                  //写入失败被丢弃的数据报数
+	metricCount
+)
+
+var metricNames = [metricCount]string{
+	"bytes_in_total",
+	"bytes_out_total",
+	"messages_in_total",
+	"messages_out_total",
+	"encode_errors_total",
+	"recv_timeouts_total",
+	"send_timeouts_total",
+	"send_drops_total",
+	"send_errors_total",
+}
+
+var metricHelps = [metricCount]string{
+	"Bytes read from connections.",
+	"Bytes written to connections.",
+	"Messages delivered to the message callback.",
+	"Messages encoded and written.",
+	"Messages dropped because of encode errors.",
+	"Receive timeouts.",
+	"Send timeouts.",
+	"Messages dropped by the send queue overflow policy.",
+	"Datagrams dropped because of write errors.",
+}
+
+/*
+ *  会话统计的汇总接口,实现此接口可以接入其它监控系统
+ */
+type MetricsSink interface {
+	Add(m Metric, delta int64)
+	ObserveQueueWait(d time.Duration) //消息在发送队列中的等待时间
+	OnOpen(s kendynet.StreamSession)
+	OnClose(s kendynet.StreamSession)
+}
+
+type Stats struct {
+	BytesIn        int64
+	BytesOut       int64
+	MessagesIn     int64
+	MessagesOut    int64
+	EncodeErrors   int64
+	RecvTimeouts   int64
+	SendTimeouts   int64
+	SendDrops      int64
+	SendErrors     int64
+	SendQueueLen   int
+	SendQueueBytes int
+}
+
+/*
+ *  单个会话的统计,总是开启。设置了MetricsSink时同时上报到sink
+ */
+type SessionMetrics struct {
+	counters [metricCount]int64
+	sink     atomic.Value
+}
+
+func (this *SessionMetrics) Add(m Metric, delta int64) {
+	atomic.AddInt64(&this.counters[m], delta)
+	if sink, ok := this.sink.Load().(MetricsSink); ok {
+		sink.Add(m, delta)
+	}
+}
+
+func (this *SessionMetrics) Sink() MetricsSink {
+	sink, _ := this.sink.Load().(MetricsSink)
+	return sink
+}
+
+func (this *SessionMetrics) SetSink(sink MetricsSink) {
+	this.sink.Store(sink)
+}
+
+func (this *SessionMetrics) Stats() Stats {
+	return Stats{
+		BytesIn:      atomic.LoadInt64(&this.counters[MetricBytesIn]),
+		BytesOut:     atomic.LoadInt64(&this.counters[MetricBytesOut]),
+		MessagesIn:   atomic.LoadInt64(&this.counters[MetricMessagesIn]),
+		MessagesOut:  atomic.LoadInt64(&this.counters[MetricMessagesOut]),
+		EncodeErrors: atomic.LoadInt64(&this.counters[MetricEncodeErrors]),
+		RecvTimeouts: atomic.LoadInt64(&this.counters[MetricRecvTimeouts]),
+		SendTimeouts: atomic.LoadInt64(&this.counters[MetricSendTimeouts]),
+		SendDrops:    atomic.LoadInt64(&this.counters[MetricSendDrops]),
+		SendErrors:   atomic.LoadInt64(&this.counters[MetricSendErrors]),
+	}
+}
+
+/*
+ *  会话接入MetricsSink,必须在BeginRecv及Send之前调用
+ */
+func (this *SocketBase) SetMetrics(sink MetricsSink) {
+	if nil == sink {
+		return
+	}
+	this.metrics.SetSink(sink)
+	this.sendQue.SetWaitObserver(sink.ObserveQueueWait)
+	sink.OnOpen(this.imp)
+	this.NotifyClose(func(s kendynet.StreamSession, _ error) {
+		sink.OnClose(s)
+	})
+}
+
+func (this *SocketBase) Stats() Stats {
+	s := this.metrics.Stats()
+	s.SendQueueLen = this.sendQue.Len()
+	s.SendQueueBytes = this.sendQue.Bytes()
+	return s
+}
+
+var DefaultQueueWaitBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+type Histogram struct {
+	sum     int64
+	count   uint64
+	buckets []time.Duration
+	counts  []uint64 //最后一个为+Inf
+}
+
+func NewHistogram(buckets ...time.Duration) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultQueueWaitBuckets
+	}
+
+	b := make([]time.Duration, len(buckets))
+	copy(b, buckets)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)+1),
+	}
+}
+
+func (this *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(this.buckets), func(i int) bool { return d <= this.buckets[i] })
+	atomic.AddUint64(&this.counts[i], 1)
+	atomic.AddInt64(&this.sum, int64(d))
+	atomic.AddUint64(&this.count, 1)
+}
+
+func (this *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&this.count)
+}
+
+func (this *Histogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadInt64(&this.sum))
+}
+
+/*
+ *  内置的MetricsSink,汇总所有接入会话的统计,可以作为http.Handler以Prometheus文本格式输出
+ */
+type Metrics struct {
+	counters  [metricCount]int64 //原子操作的计数器放在最前面以保证64位对齐
+	namespace string
+	queueWait *Histogram
+	mu        sync.Mutex
+	sessions  map[kendynet.StreamSession]struct{}
+}
+
+/*
+ *  namespace为指标名的前缀,为空时使用kendynet
+ */
+func NewMetrics(namespace string, queueWaitBuckets ...time.Duration) *Metrics {
+	if "" == namespace {
+		namespace = "kendynet"
+	}
+	return &Metrics{
+		namespace: namespace,
+		queueWait: NewHistogram(queueWaitBuckets...),
+		sessions:  map[kendynet.StreamSession]struct{}{},
+	}
+}
+
+func (this *Metrics) Add(m Metric, delta int64) {
+	atomic.AddInt64(&this.counters[m], delta)
+}
+
+func (this *Metrics) ObserveQueueWait(d time.Duration) {
+	this.queueWait.Observe(d)
+}
+
+func (this *Metrics) OnOpen(s kendynet.StreamSession) {
+	this.mu.Lock()
+	this.sessions[s] = struct{}{}
+	this.mu.Unlock()
+}
+
+func (this *Metrics) OnClose(s kendynet.StreamSession) {
+	this.mu.Lock()
+	delete(this.sessions, s)
+	this.mu.Unlock()
+}
+
+func (this *Metrics) Get(m Metric) int64 {
+	return atomic.LoadInt64(&this.counters[m])
+}
+
+func (this *Metrics) QueueWait() *Histogram {
+	return this.queueWait
+}
+
+/*
+ *  返回当前会话数,所有会话发送队列中的消息总数及字节总数
+ */
+func (this *Metrics) Sessions() (count int, sendQueueLen int, sendQueueBytes int) {
+	this.mu.Lock()
+	sessions := make([]kendynet.StreamSession, 0, len(this.sessions))
+	for s, _ := range this.sessions {
+		sessions = append(sessions, s)
+	}
+	this.mu.Unlock()
+
+	for _, s := range sessions {
+		if v, ok := s.(interface{ Stats() Stats }); ok {
+			stats := v.Stats()
+			sendQueueLen += stats.SendQueueLen
+			sendQueueBytes += stats.SendQueueBytes
+		}
+	}
+
+	return len(sessions), sendQueueLen, sendQueueBytes
+}
+
+func (this *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for i := Metric(0); i < metricCount; i++ {
+		name := this.namespace + "_session_" + metricNames[i]
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, metricHelps[i], name, name, this.Get(i))
+	}
+
+	sessions, queueLen, queueBytes := this.Sessions()
+
+	name := this.namespace + "_sessions"
+	fmt.Fprintf(bw, "# HELP %s Open sessions.\n# TYPE %s gauge\n%s %d\n", name, name, name, sessions)
+
+	name = this.namespace + "_session_send_queue_length"
+	fmt.Fprintf(bw, "# HELP %s Messages waiting in send queues.\n# TYPE %s gauge\n%s %d\n", name, name, name, queueLen)
+
+	name = this.namespace + "_session_send_queue_bytes"
+	fmt.Fprintf(bw, "# HELP %s Bytes waiting in send queues.\n# TYPE %s gauge\n%s %d\n", name, name, name, queueBytes)
+
+	name = this.namespace + "_session_send_queue_wait_seconds"
+	fmt.Fprintf(bw, "# HELP %s Time messages wait in the send queue.\n# TYPE %s histogram\n", name, name)
+
+	h := this.queueWait
+	cumulative := uint64(0)
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(bw, "%s_bucket{le=\"%g\"} %d\n", name, b.Seconds(), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(bw, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(bw, "%s_sum %g\n%s_count %d\n", name, h.Sum().Seconds(), name, h.Count())
+
+	return bw.Flush()
+}
+
+func (this *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	this.WritePrometheus(w)
+}
@@ -0,0 +1,607 @@
+package rudp
+
+import (
+	"encoding/binary"
+)
+
+/*
+ *  KCP风格的ARQ协议(流模式),不是线程安全的,由Conn加锁保护
+ *
+ *  分段头部(小端):conv(4) cmd(1) frg(1) wnd(2) ts(4) sn(4) una(4) len(4)
+ */
+
+const (
+	cmdPush = byte(81) //数据
+	cmdAck  = byte(82) //确认
+	cmdWask = byte(83) //询问对端窗口
+	cmdWins = byte(84) //告知本端窗口
+	cmdRst  = byte(85) //连接关闭
+)
+
+const (
+	askSend = uint32(1)
+	askTell = uint32(2)
+)
+
+const (
+	overhead     = 24
+	rtoMax       = 60000
+	rtoDef       = 200
+	thresholdMin = 2
+	thresholdDef = 2
+	probeInit    = 7000
+	probeLimit   = 120000
+	fastackLimit = 5 //快速重传次数上限,超过后只依靠超时重传
+)
+
+func timediff(later, earlier uint32) int32 {
+	return int32(later - earlier)
+}
+
+type segment struct {
+	conv     uint32
+	cmd      byte
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	data     []byte
+	resendts uint32
+	rto      uint32
+	fastack  uint32
+	xmit     uint32
+}
+
+func (this *segment) encode(b []byte) []byte {
+	var h [overhead]byte
+	binary.LittleEndian.PutUint32(h[0:], this.conv)
+	h[4] = this.cmd
+	binary.LittleEndian.PutUint16(h[6:], this.wnd)
+	binary.LittleEndian.PutUint32(h[8:], this.ts)
+	binary.LittleEndian.PutUint32(h[12:], this.sn)
+	binary.LittleEndian.PutUint32(h[16:], this.una)
+	binary.LittleEndian.PutUint32(h[20:], uint32(len(this.data)))
+	b = append(b, h[:]...)
+	return append(b, this.data...)
+}
+
+type ackItem struct {
+	sn uint32
+	ts uint32
+}
+
+type arq struct {
+	conv       uint32
+	mtu        uint32
+	mss        uint32
+	sndUna     uint32
+	sndNxt     uint32
+	rcvNxt     uint32
+	ssthresh   uint32
+	rxRttvar   int32
+	rxSrtt     int32
+	rxRto      uint32
+	rxMinrto   uint32
+	sndWnd     uint32
+	rcvWnd     uint32
+	rmtWnd     uint32
+	cwnd       uint32
+	incr       uint32
+	probe      uint32
+	tsProbe    uint32
+	probeWait  uint32
+	interval   uint32
+	current    uint32
+	nodelay    bool
+	fastresend uint32
+	nocwnd     bool
+	deadLink   uint32
+	dead       bool
+	rst        bool
+	sndQueue   []*segment
+	rcvQueue   []*segment
+	sndBuf     []*segment
+	rcvBuf     []*segment
+	acklist    []ackItem
+	buffer     []byte
+	output     func([]byte)
+}
+
+func newARQ(conv uint32, config *Config, output func([]byte)) *arq {
+	a := &arq{
+		conv:       conv,
+		mtu:        uint32(config.MTU),
+		mss:        uint32(config.MTU) - overhead,
+		sndWnd:     uint32(config.SndWnd),
+		rcvWnd:     uint32(config.RcvWnd),
+		rmtWnd:     uint32(config.RcvWnd),
+		cwnd:       1,
+		ssthresh:   thresholdDef,
+		rxRto:      rtoDef,
+		rxMinrto:   uint32(config.MinRTO.Milliseconds()),
+		interval:   uint32(config.Interval.Milliseconds()),
+		nodelay:    config.NoDelay,
+		fastresend: uint32(config.FastResend),
+		nocwnd:     config.NoCongestion,
+		deadLink:   uint32(config.DeadLink),
+		output:     output,
+	}
+	a.incr = a.mss
+	a.buffer = make([]byte, 0, a.mtu*3)
+	return a
+}
+
+/*
+ *  从接收队列读取数据,没有数据返回0
+ */
+func (this *arq) recv(buf []byte) int {
+	if len(this.rcvQueue) == 0 {
+		return 0
+	}
+
+	recover := uint32(len(this.rcvQueue)) >= this.rcvWnd
+
+	n := 0
+	for len(this.rcvQueue) > 0 && n < len(buf) {
+		seg := this.rcvQueue[0]
+		c := copy(buf[n:], seg.data)
+		n += c
+		if c < len(seg.data) {
+			seg.data = seg.data[c:]
+			break
+		}
+		this.rcvQueue[0] = nil
+		this.rcvQueue = this.rcvQueue[1:]
+	}
+
+	this.moveRcvBuf()
+
+	//接收窗口重新打开,主动通知对端
+	if uint32(len(this.rcvQueue)) < this.rcvWnd && recover {
+		this.probe |= askTell
+	}
+
+	return n
+}
+
+func (this *arq) readable() bool {
+	return len(this.rcvQueue) > 0
+}
+
+/*
+ *  流模式:数据优先合并到发送队列最后一个未满的分段
+ */
+func (this *arq) send(data []byte) {
+	if n := len(this.sndQueue); n > 0 {
+		last := this.sndQueue[n-1]
+		if uint32(len(last.data)) < this.mss {
+			extend := int(this.mss) - len(last.data)
+			if extend > len(data) {
+				extend = len(data)
+			}
+			last.data = append(last.data, data[:extend]...)
+			data = data[extend:]
+		}
+	}
+
+	for len(data) > 0 {
+		size := int(this.mss)
+		if size > len(data) {
+			size = len(data)
+		}
+		seg := &segment{data: make([]byte, size, this.mss)}
+		copy(seg.data, data)
+		this.sndQueue = append(this.sndQueue, seg)
+		data = data[size:]
+	}
+}
+
+func (this *arq) waitSnd() int {
+	return len(this.sndBuf) + len(this.sndQueue)
+}
+
+func (this *arq) updateAck(rtt int32) {
+	if this.rxSrtt == 0 {
+		this.rxSrtt = rtt
+		this.rxRttvar = rtt / 2
+	} else {
+		delta := rtt - this.rxSrtt
+		if delta < 0 {
+			delta = -delta
+		}
+		this.rxRttvar = (3*this.rxRttvar + delta) / 4
+		this.rxSrtt = (7*this.rxSrtt + rtt) / 8
+		if this.rxSrtt < 1 {
+			this.rxSrtt = 1
+		}
+	}
+
+	rto := uint32(this.rxSrtt) + max(this.interval, uint32(4*this.rxRttvar))
+	this.rxRto = bound(this.rxMinrto, rto, rtoMax)
+}
+
+func (this *arq) shrinkBuf() {
+	if len(this.sndBuf) > 0 {
+		this.sndUna = this.sndBuf[0].sn
+	} else {
+		this.sndUna = this.sndNxt
+	}
+}
+
+func (this *arq) parseAck(sn uint32) {
+	if timediff(sn, this.sndUna) < 0 || timediff(sn, this.sndNxt) >= 0 {
+		return
+	}
+
+	for i, seg := range this.sndBuf {
+		if sn == seg.sn {
+			copy(this.sndBuf[i:], this.sndBuf[i+1:])
+			this.sndBuf[len(this.sndBuf)-1] = nil
+			this.sndBuf = this.sndBuf[:len(this.sndBuf)-1]
+			break
+		} else if timediff(sn, seg.sn) < 0 {
+			break
+		}
+	}
+}
+
+/*
+ *  sn之前尚未确认的分段被跳过一次,只统计在分段最近一次发送之后发出的分段的确认,
+ *  避免同一批重复确认导致连续的快速重传
+ */
+func (this *arq) parseFastack(sn uint32, ts uint32) {
+	if timediff(sn, this.sndUna) < 0 || timediff(sn, this.sndNxt) >= 0 {
+		return
+	}
+
+	for _, seg := range this.sndBuf {
+		if timediff(sn, seg.sn) < 0 {
+			break
+		} else if sn != seg.sn && timediff(ts, seg.ts) >= 0 {
+			seg.fastack++
+		}
+	}
+}
+
+func (this *arq) parseUna(una uint32) {
+	count := 0
+	for _, seg := range this.sndBuf {
+		if timediff(una, seg.sn) > 0 {
+			count++
+		} else {
+			break
+		}
+	}
+
+	if count > 0 {
+		n := copy(this.sndBuf, this.sndBuf[count:])
+		for i := n; i < len(this.sndBuf); i++ {
+			this.sndBuf[i] = nil
+		}
+		this.sndBuf = this.sndBuf[:n]
+	}
+}
+
+func (this *arq) parseData(newseg *segment) {
+	sn := newseg.sn
+	if timediff(sn, this.rcvNxt+this.rcvWnd) >= 0 || timediff(sn, this.rcvNxt) < 0 {
+		return
+	}
+
+	//按sn有序插入,丢弃重复分段
+	i := len(this.rcvBuf) - 1
+	for ; i >= 0; i-- {
+		seg := this.rcvBuf[i]
+		if seg.sn == sn {
+			return
+		} else if timediff(sn, seg.sn) > 0 {
+			break
+		}
+	}
+
+	this.rcvBuf = append(this.rcvBuf, nil)
+	copy(this.rcvBuf[i+2:], this.rcvBuf[i+1:])
+	this.rcvBuf[i+1] = newseg
+
+	this.moveRcvBuf()
+}
+
+func (this *arq) moveRcvBuf() {
+	count := 0
+	for _, seg := range this.rcvBuf {
+		if seg.sn == this.rcvNxt && uint32(len(this.rcvQueue)+count) < this.rcvWnd {
+			this.rcvNxt++
+			count++
+		} else {
+			break
+		}
+	}
+
+	if count > 0 {
+		this.rcvQueue = append(this.rcvQueue, this.rcvBuf[:count]...)
+		n := copy(this.rcvBuf, this.rcvBuf[count:])
+		for i := n; i < len(this.rcvBuf); i++ {
+			this.rcvBuf[i] = nil
+		}
+		this.rcvBuf = this.rcvBuf[:n]
+	}
+}
+
+/*
+ *  处理收到的一个数据报,格式错误返回false
+ */
+func (this *arq) input(data []byte) bool {
+	prevUna := this.sndUna
+	var maxack, latestTs uint32
+	flag := false
+
+	for len(data) >= overhead {
+		conv := binary.LittleEndian.Uint32(data[0:])
+		cmd := data[4]
+		wnd := binary.LittleEndian.Uint16(data[6:])
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		data = data[overhead:]
+
+		if conv != this.conv || uint32(len(data)) < length {
+			return false
+		}
+
+		if cmd == cmdRst {
+			this.rst = true
+			return true
+		}
+
+		if cmd != cmdPush && cmd != cmdAck && cmd != cmdWask && cmd != cmdWins {
+			return false
+		}
+
+		this.rmtWnd = uint32(wnd)
+		this.parseUna(una)
+		this.shrinkBuf()
+
+		switch cmd {
+		case cmdAck:
+			if rtt := timediff(this.current, ts); rtt >= 0 {
+				this.updateAck(rtt)
+			}
+			this.parseAck(sn)
+			this.shrinkBuf()
+			if !flag || timediff(sn, maxack) > 0 {
+				flag = true
+				maxack = sn
+				latestTs = ts
+			}
+		case cmdPush:
+			if timediff(sn, this.rcvNxt+this.rcvWnd) < 0 {
+				this.acklist = append(this.acklist, ackItem{sn: sn, ts: ts})
+				if timediff(sn, this.rcvNxt) >= 0 {
+					seg := &segment{sn: sn, data: make([]byte, length)}
+					copy(seg.data, data[:length])
+					this.parseData(seg)
+				}
+			}
+		case cmdWask:
+			this.probe |= askTell
+		}
+
+		data = data[length:]
+	}
+
+	if flag {
+		this.parseFastack(maxack, latestTs)
+	}
+
+	//拥塞窗口增长:慢启动及拥塞避免
+	if timediff(this.sndUna, prevUna) > 0 && this.cwnd < this.rmtWnd {
+		mss := this.mss
+		if this.cwnd < this.ssthresh {
+			this.cwnd++
+			this.incr += mss
+		} else {
+			if this.incr < mss {
+				this.incr = mss
+			}
+			this.incr += (mss*mss)/this.incr + (mss / 16)
+			if (this.cwnd+1)*mss <= this.incr {
+				this.cwnd = (this.incr + mss - 1) / mss
+			}
+		}
+		if this.cwnd > this.rmtWnd {
+			this.cwnd = this.rmtWnd
+			this.incr = this.rmtWnd * mss
+		}
+	}
+
+	return true
+}
+
+func (this *arq) wndUnused() uint16 {
+	if uint32(len(this.rcvQueue)) < this.rcvWnd {
+		return uint16(this.rcvWnd - uint32(len(this.rcvQueue)))
+	}
+	return 0
+}
+
+func (this *arq) flushBuffer(need int) {
+	if len(this.buffer)+need > int(this.mtu) {
+		this.output(this.buffer)
+		this.buffer = this.buffer[:0]
+	}
+}
+
+/*
+ *  发送确认,窗口探测,新数据及需要重传的数据
+ */
+func (this *arq) flush() {
+	current := this.current
+
+	seg := segment{conv: this.conv, cmd: cmdAck, wnd: this.wndUnused(), una: this.rcvNxt}
+
+	for _, ack := range this.acklist {
+		this.flushBuffer(overhead)
+		seg.sn, seg.ts = ack.sn, ack.ts
+		this.buffer = seg.encode(this.buffer)
+	}
+	this.acklist = this.acklist[:0]
+
+	//对端窗口为0时定期探测
+	if this.rmtWnd == 0 {
+		if this.probeWait == 0 {
+			this.probeWait = probeInit
+			this.tsProbe = current + this.probeWait
+		} else if timediff(current, this.tsProbe) >= 0 {
+			if this.probeWait < probeInit {
+				this.probeWait = probeInit
+			}
+			this.probeWait += this.probeWait / 2
+			if this.probeWait > probeLimit {
+				this.probeWait = probeLimit
+			}
+			this.tsProbe = current + this.probeWait
+			this.probe |= askSend
+		}
+	} else {
+		this.tsProbe = 0
+		this.probeWait = 0
+	}
+
+	seg.sn, seg.ts = 0, 0
+
+	if this.probe&askSend != 0 {
+		seg.cmd = cmdWask
+		this.flushBuffer(overhead)
+		this.buffer = seg.encode(this.buffer)
+	}
+
+	if this.probe&askTell != 0 {
+		seg.cmd = cmdWins
+		this.flushBuffer(overhead)
+		this.buffer = seg.encode(this.buffer)
+	}
+
+	this.probe = 0
+
+	cwnd := min(this.sndWnd, this.rmtWnd)
+	if !this.nocwnd {
+		cwnd = min(this.cwnd, cwnd)
+	}
+
+	for timediff(this.sndNxt, this.sndUna+cwnd) < 0 && len(this.sndQueue) > 0 {
+		newseg := this.sndQueue[0]
+		this.sndQueue[0] = nil
+		this.sndQueue = this.sndQueue[1:]
+		newseg.conv = this.conv
+		newseg.cmd = cmdPush
+		newseg.sn = this.sndNxt
+		this.sndNxt++
+		this.sndBuf = append(this.sndBuf, newseg)
+	}
+
+	resent := this.fastresend
+	if resent == 0 {
+		resent = 0xffffffff
+	}
+
+	rtomin := this.rxRto >> 3
+	if this.nodelay {
+		rtomin = 0
+	}
+
+	change := false
+	lost := false
+
+	for _, s := range this.sndBuf {
+		needsend := false
+		if s.xmit == 0 {
+			needsend = true
+			s.rto = this.rxRto
+			s.resendts = current + s.rto + rtomin
+		} else if timediff(current, s.resendts) >= 0 {
+			//超时重传,nodelay模式下rto按1.5倍增长
+			needsend = true
+			if !this.nodelay {
+				s.rto += max(s.rto, this.rxRto)
+			} else {
+				s.rto += s.rto / 2
+			}
+			s.resendts = current + s.rto
+			lost = true
+		} else if s.fastack >= resent && s.xmit <= fastackLimit {
+			//快速重传
+			needsend = true
+			s.fastack = 0
+			s.resendts = current + s.rto
+			change = true
+		}
+
+		if needsend {
+			s.xmit++
+			s.ts = current
+			s.wnd = seg.wnd
+			s.una = this.rcvNxt
+			this.flushBuffer(overhead + len(s.data))
+			this.buffer = s.encode(this.buffer)
+			if s.xmit >= this.deadLink {
+				this.dead = true
+			}
+		}
+	}
+
+	if len(this.buffer) > 0 {
+		this.output(this.buffer)
+		this.buffer = this.buffer[:0]
+	}
+
+	if change {
+		inflight := this.sndNxt - this.sndUna
+		this.ssthresh = inflight / 2
+		if this.ssthresh < thresholdMin {
+			this.ssthresh = thresholdMin
+		}
+		this.cwnd = this.ssthresh + resent
+		this.incr = this.cwnd * this.mss
+	}
+
+	if lost {
+		this.ssthresh = cwnd / 2
+		if this.ssthresh < thresholdMin {
+			this.ssthresh = thresholdMin
+		}
+		this.cwnd = 1
+		this.incr = this.mss
+	}
+
+	if this.cwnd < 1 {
+		this.cwnd = 1
+		this.incr = this.mss
+	}
+}
+
+/*
+ *  立即发送关闭通知,不可靠
+ */
+func (this *arq) sendRst() {
+	seg := segment{conv: this.conv, cmd: cmdRst}
+	this.output(seg.encode(this.buffer[:0]))
+}
+
+func min(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func bound(lower, middle, upper uint32) uint32 {
+	return min(max(lower, middle), upper)
+}
@@ -0,0 +1,397 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDeadLink = errors.New("rudp: dead link")
+	ErrClosed   = errors.New("rudp: use of closed connection")
+)
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+type Config struct {
+	MTU          int           //数据报最大长度,默认1400
+	SndWnd       int           //发送窗口(分段数),默认128
+	RcvWnd       int           //接收窗口(分段数),默认128
+	Interval     time.Duration //内部刷新间隔,默认20ms
+	NoDelay      bool          //最小rto为0,超时重传时rto按1.5倍(而非2倍)增长,收到数据后立即确认
+	MinRTO       time.Duration //最小rto,默认100ms,NoDelay时默认30ms
+	FastResend   int           //被跳过多少次确认后立即重传,0表示关闭快速重传
+	NoCongestion bool          //关闭拥塞控制,只受发送窗口及对端接收窗口限制
+	DeadLink     int           //一个分段重传多少次后认为连接断开,默认20
+}
+
+/*
+ *  普通模式
+ */
+func DefaultConfig() *Config {
+	return &Config{}
+}
+
+/*
+ *  低延迟模式,以带宽换取延迟
+ */
+func FastConfig() *Config {
+	return &Config{
+		Interval:     10 * time.Millisecond,
+		NoDelay:      true,
+		FastResend:   2,
+		NoCongestion: true,
+	}
+}
+
+func (this *Config) normalize() *Config {
+	c := Config{}
+	if nil != this {
+		c = *this
+	}
+
+	if c.MTU <= overhead {
+		c.MTU = 1400
+	}
+
+	if c.SndWnd <= 0 {
+		c.SndWnd = 128
+	}
+
+	if c.RcvWnd <= 0 {
+		c.RcvWnd = 128
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = 20 * time.Millisecond
+	}
+
+	if c.MinRTO <= 0 {
+		if c.NoDelay {
+			c.MinRTO = 30 * time.Millisecond
+		} else {
+			c.MinRTO = 100 * time.Millisecond
+		}
+	}
+
+	if c.DeadLink <= 0 {
+		c.DeadLink = 20
+	}
+
+	return &c
+}
+
+/*
+ *  基于UDP的可靠有序字节流,实现net.Conn
+ *
+ *  连接没有握手过程,客户端随机选择conv,服务端收到未知(地址,conv)的数据时创建新连接。
+ *  Close向对端发送一次关闭通知(不可靠),尚未被确认的数据被丢弃。
+ *  对端关闭后Read在取完已收到的数据后返回io.EOF,分段重传超过DeadLink次后Read/Write返回ErrDeadLink。
+ */
+type Conn struct {
+	mu            sync.Mutex
+	arq           *arq
+	config        *Config
+	pconn         net.PacketConn
+	raddr         net.Addr
+	start         time.Time
+	readC         chan struct{}
+	writeC        chan struct{}
+	closeC        chan struct{}
+	closeOnce     sync.Once
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	onClose       func()
+}
+
+func newConn(conv uint32, pconn net.PacketConn, raddr net.Addr, config *Config, onClose func()) *Conn {
+	c := &Conn{
+		config:  config,
+		pconn:   pconn,
+		raddr:   raddr,
+		start:   time.Now(),
+		readC:   make(chan struct{}, 1),
+		writeC:  make(chan struct{}, 1),
+		closeC:  make(chan struct{}),
+		onClose: onClose,
+	}
+
+	c.arq = newARQ(conv, config, func(b []byte) {
+		c.pconn.WriteTo(b, c.raddr)
+	})
+
+	go c.updateLoop()
+
+	return c
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (this *Conn) currentMs() uint32 {
+	return uint32(time.Since(this.start) / time.Millisecond)
+}
+
+func (this *Conn) updateLoop() {
+	ticker := time.NewTicker(this.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.closeC:
+			return
+		case <-ticker.C:
+			this.mu.Lock()
+			waitSnd := this.arq.waitSnd()
+			this.arq.current = this.currentMs()
+			this.arq.flush()
+			dead := this.arq.dead
+			if this.arq.waitSnd() < waitSnd {
+				notify(this.writeC)
+			}
+			this.mu.Unlock()
+
+			if dead {
+				this.shutdown(ErrDeadLink, false)
+				return
+			}
+		}
+	}
+}
+
+//处理底层收到的一个数据报
+func (this *Conn) input(data []byte) {
+	this.mu.Lock()
+	waitSnd := this.arq.waitSnd()
+	this.arq.current = this.currentMs()
+	ok := this.arq.input(data)
+	rst := this.arq.rst
+	if ok && !rst {
+		if this.config.NoDelay {
+			this.arq.flush()
+		}
+		if this.arq.readable() {
+			notify(this.readC)
+		}
+		if this.arq.waitSnd() < waitSnd {
+			notify(this.writeC)
+		}
+	}
+	this.mu.Unlock()
+
+	if rst {
+		this.shutdown(io.EOF, false)
+	}
+}
+
+func deadlineC(deadline time.Time) (<-chan time.Time, func(), bool) {
+	if deadline.IsZero() {
+		return nil, func() {}, true
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return nil, nil, false
+	}
+
+	timer := time.NewTimer(d)
+	return timer.C, func() { timer.Stop() }, true
+}
+
+func (this *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for {
+		this.mu.Lock()
+		if n := this.arq.recv(b); n > 0 {
+			this.mu.Unlock()
+			return n, nil
+		}
+
+		if nil != this.err {
+			err := this.err
+			this.mu.Unlock()
+			return 0, err
+		}
+
+		timeoutC, stop, ok := deadlineC(this.readDeadline)
+		this.mu.Unlock()
+
+		if !ok {
+			return 0, timeoutError{}
+		}
+
+		select {
+		case <-this.readC:
+			stop()
+		case <-this.closeC:
+			stop()
+		case <-timeoutC:
+			return 0, timeoutError{}
+		}
+	}
+}
+
+/*
+ *  未确认的数据超过发送窗口的两倍时阻塞
+ */
+func (this *Conn) Write(b []byte) (int, error) {
+	for {
+		this.mu.Lock()
+		if nil != this.err {
+			err := this.err
+			this.mu.Unlock()
+			if err == io.EOF {
+				err = ErrClosed
+			}
+			return 0, err
+		}
+
+		if this.arq.waitSnd() < 2*this.config.SndWnd {
+			this.arq.send(b)
+			if this.config.NoDelay {
+				this.arq.current = this.currentMs()
+				this.arq.flush()
+			}
+			this.mu.Unlock()
+			return len(b), nil
+		}
+
+		timeoutC, stop, ok := deadlineC(this.writeDeadline)
+		this.mu.Unlock()
+
+		if !ok {
+			return 0, timeoutError{}
+		}
+
+		select {
+		case <-this.writeC:
+			stop()
+		case <-this.closeC:
+			stop()
+		case <-timeoutC:
+			return 0, timeoutError{}
+		}
+	}
+}
+
+/*
+ *  终止连接,sendRst表示是否通知对端
+ */
+func (this *Conn) shutdown(err error, sendRst bool) {
+	this.closeOnce.Do(func() {
+		this.mu.Lock()
+		this.err = err
+		if sendRst {
+			this.arq.sendRst()
+		}
+		this.mu.Unlock()
+		close(this.closeC)
+		if nil != this.onClose {
+			this.onClose()
+		}
+	})
+}
+
+func (this *Conn) Close() error {
+	this.shutdown(ErrClosed, true)
+	return nil
+}
+
+func (this *Conn) LocalAddr() net.Addr {
+	return this.pconn.LocalAddr()
+}
+
+func (this *Conn) RemoteAddr() net.Addr {
+	return this.raddr
+}
+
+func (this *Conn) SetDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.readDeadline = t
+	this.writeDeadline = t
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *Conn) SetReadDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.readDeadline = t
+	this.mu.Unlock()
+	return nil
+}
+
+func (this *Conn) SetWriteDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.writeDeadline = t
+	this.mu.Unlock()
+	return nil
+}
+
+/*
+ *  conn由返回的Conn独占,Conn关闭时conn被关闭
+ */
+func DialWithConn(pconn net.PacketConn, raddr net.Addr, config *Config) (*Conn, error) {
+	if nil == pconn || nil == raddr {
+		return nil, errors.New("rudp: invaild conn or addr")
+	}
+
+	var conv uint32
+	for 0 == conv {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		conv = binary.LittleEndian.Uint32(b[:])
+	}
+
+	c := newConn(conv, pconn, raddr, config.normalize(), func() {
+		pconn.Close()
+	})
+
+	go func() {
+		buff := make([]byte, 65536)
+		for {
+			n, addr, err := pconn.ReadFrom(buff)
+			if nil != err {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				c.shutdown(err, false)
+				return
+			} else if addr.String() == raddr.String() {
+				c.input(buff[:n])
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+func Dial(nettype, addr string, config *Config) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(nettype, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pconn, err := net.ListenUDP(nettype, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DialWithConn(pconn, raddr, config)
+}
@@ -0,0 +1,142 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+)
+
+/*
+ *  在一个PacketConn上按(对端地址,conv)分离出多个Conn
+ */
+type Listener struct {
+	pconn     net.PacketConn
+	config    *Config
+	mu        sync.Mutex
+	conns     map[string]*Conn
+	acceptC   chan *Conn
+	closeC    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func Listen(nettype, service string, config *Config) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr(nettype, service)
+	if err != nil {
+		return nil, err
+	}
+
+	pconn, err := net.ListenUDP(nettype, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return ListenWithConn(pconn, config), nil
+}
+
+/*
+ *  pconn由Listener独占,Listener关闭时pconn被关闭
+ */
+func ListenWithConn(pconn net.PacketConn, config *Config) *Listener {
+	l := &Listener{
+		pconn:   pconn,
+		config:  config.normalize(),
+		conns:   map[string]*Conn{},
+		acceptC: make(chan *Conn, 128),
+		closeC:  make(chan struct{}),
+	}
+
+	go l.readLoop()
+
+	return l
+}
+
+func (this *Listener) readLoop() {
+	buff := make([]byte, 65536)
+	for {
+		n, addr, err := this.pconn.ReadFrom(buff)
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			this.close(err)
+			return
+		}
+
+		if n < overhead {
+			continue
+		}
+
+		conv := binary.LittleEndian.Uint32(buff)
+		key := addr.String() + "/" + strconv.FormatUint(uint64(conv), 10)
+
+		drop := false
+
+		this.mu.Lock()
+		c, ok := this.conns[key]
+		if !ok && buff[4] == cmdPush {
+			//只有数据分段才创建新连接,避免已关闭连接的确认或关闭通知产生新连接
+			c = newConn(conv, this.pconn, addr, this.config, func() {
+				this.mu.Lock()
+				if this.conns[key] == c {
+					delete(this.conns, key)
+				}
+				this.mu.Unlock()
+			})
+			this.conns[key] = c
+			select {
+			case this.acceptC <- c:
+			default:
+				//等待Accept的连接过多,丢弃
+				drop = true
+			}
+		}
+		this.mu.Unlock()
+
+		if drop {
+			c.shutdown(ErrClosed, false)
+			continue
+		}
+
+		if nil != c {
+			c.input(buff[:n])
+		}
+	}
+}
+
+func (this *Listener) Accept() (*Conn, error) {
+	select {
+	case c := <-this.acceptC:
+		return c, nil
+	case <-this.closeC:
+		return nil, this.err
+	}
+}
+
+func (this *Listener) close(err error) {
+	this.closeOnce.Do(func() {
+		this.err = err
+		close(this.closeC)
+		this.pconn.Close()
+		this.mu.Lock()
+		conns := this.conns
+		this.conns = map[string]*Conn{}
+		this.mu.Unlock()
+		for _, v := range conns {
+			v.Close()
+		}
+	})
+}
+
+/*
+ *  关闭Listener及所有由其创建的连接
+ */
+func (this *Listener) Close() error {
+	this.close(ErrClosed)
+	return nil
+}
+
+func (this *Listener) Addr() net.Addr {
+	return this.pconn.LocalAddr()
+}
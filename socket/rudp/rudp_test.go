@@ -0,0 +1,158 @@
+package rudp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//按比例丢弃发出的数据报,模拟丢包
+type lossyConn struct {
+	net.PacketConn
+	mu       sync.Mutex
+	rand     *rand.Rand
+	lossRate float64
+}
+
+func newLossyConn(conn net.PacketConn, lossRate float64) *lossyConn {
+	return &lossyConn{
+		PacketConn: conn,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		lossRate:   lossRate,
+	}
+}
+
+func (this *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	this.mu.Lock()
+	drop := this.rand.Float64() < this.lossRate
+	this.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return this.PacketConn.WriteTo(b, addr)
+}
+
+func listenLossy(t *testing.T, lossRate float64, config *Config) *Listener {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	return ListenWithConn(newLossyConn(conn, lossRate), config)
+}
+
+func dialLossy(t *testing.T, addr net.Addr, lossRate float64, config *Config) *Conn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	c, err := DialWithConn(newLossyConn(conn, lossRate), addr, config)
+	assert.Nil(t, err)
+	return c
+}
+
+func testEcho(t *testing.T, lossRate float64, config *Config) {
+	l := listenLossy(t, lossRate, config)
+	defer l.Close()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+
+	c := dialLossy(t, l.Addr(), lossRate, config)
+	defer c.Close()
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+
+	go func() {
+		for b := data; len(b) > 0; {
+			n := rand.Intn(4096) + 1
+			if n > len(b) {
+				n = len(b)
+			}
+			c.Write(b[:n])
+			b = b[n:]
+		}
+	}()
+
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+	recv := make([]byte, len(data))
+	_, err := io.ReadFull(c, recv)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, recv))
+}
+
+func TestEcho(t *testing.T) {
+	testEcho(t, 0, nil)
+	testEcho(t, 0, FastConfig())
+	//双向各丢弃20%的数据报
+	testEcho(t, 0.2, FastConfig())
+	testEcho(t, 0.2, &Config{Interval: 10 * time.Millisecond, FastResend: 2, MinRTO: 20 * time.Millisecond, SndWnd: 64, RcvWnd: 64})
+}
+
+func TestClose(t *testing.T) {
+	l, err := Listen("udp", "127.0.0.1:0", nil)
+	assert.Nil(t, err)
+
+	acceptC := make(chan *Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		acceptC <- c
+	}()
+
+	c, err := Dial("udp", l.Addr().String(), FastConfig())
+	assert.Nil(t, err)
+
+	c.Write([]byte("hello"))
+
+	s := <-acceptC
+
+	buff := make([]byte, 16)
+	n, err := s.Read(buff)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buff[:n]))
+
+	//对端关闭后Read返回io.EOF
+	c.Close()
+	_, err = s.Read(buff)
+	assert.Equal(t, io.EOF, err)
+
+	_, err = c.Write([]byte("hello"))
+	assert.Equal(t, ErrClosed, err)
+
+	//读超时
+	c, _ = Dial("udp", l.Addr().String(), nil)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = c.Read(buff)
+	assert.NotNil(t, err)
+	assert.True(t, err.(net.Error).Timeout())
+	c.Close()
+
+	l.Close()
+	_, err = l.Accept()
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestDeadLink(t *testing.T) {
+	//对端不存在,重传DeadLink次后连接断开
+	pconn, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	addr := pconn.LocalAddr()
+	pconn.Close()
+
+	c, err := Dial("udp", addr.String(), &Config{NoDelay: true, Interval: 10 * time.Millisecond, MinRTO: 10 * time.Millisecond, DeadLink: 3})
+	assert.Nil(t, err)
+
+	c.Write([]byte("hello"))
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 16))
+	assert.Equal(t, ErrDeadLink, err)
+}
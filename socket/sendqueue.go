@@ -2,6 +2,7 @@ package socket
 
 import (
 	"errors"
+	"github.com/sniperHW/kendynet"
 	"sync"
 	"time"
 )
@@ -10,6 +11,9 @@ var (
 	ErrQueueClosed = errors.New("queue closed")
 	ErrQueueFull   = errors.New("queue full")
 	ErrAddTimeout  = errors.New("add timeout")
+
+	ErrQueueOverflow          = errors.New("queue overflow")
+	ErrInvaildSendQueueOption = errors.New("invaild send queue option")
 )
 
 const (
@@ -156,8 +160,91 @@ func (c *cond) broadcast() {
 	}
 }
 
+type OverflowPolicy int
+
+const (
+	OverflowReject       = OverflowPolicy(iota) //Add返回ErrQueueFull,AddWithTimeout等待
+	OverflowDropOldest                          //丢弃队列中最早的消息(不区分优先级)
+	OverflowDropNewest                          //丢弃新加入的消息
+	OverflowDropPriority                        //丢弃最低优先级通道中最早的消息,新消息的优先级更低时丢弃新消息
+	OverflowClose                               //返回ErrQueueOverflow,由会话关闭慢速的对端
+)
+
+/*
+ *  发送队列的优先级通道数,优先级从0到SendPriorityCount-1,值越大越优先发送,超出范围的优先级被截断
+ */
+const SendPriorityCount = 4
+
+/*
+ *  实现此接口的消息通过Add加入时进入Priority()对应的优先级通道。未实现的消息优先级为0
+ */
+type Prioritized interface {
+	Priority() int
+}
+
+type SendQueueOption struct {
+	Policy          OverflowPolicy
+	MaxBytes        int                   //队列中消息的总字节数上限,0不限制。队列为空时总是可以加入一个消息
+	HighWatermark   int                   //Bytes()达到HighWatermark时调用OnHighWatermark,0不启用水位回调
+	LowWatermark    int                   //调用OnHighWatermark之后Bytes()降到LowWatermark及以下时调用OnLowWatermark
+	OnHighWatermark func()                //在锁外调用,可以在回调中调用Add
+	OnLowWatermark  func()                //同上
+	OnDrop          func(interface{})     //消息被策略丢弃时调用,消息的完成回调以kendynet.ErrSendDropped调用
+	Sizer           func(interface{}) int //计算消息的字节数,为nil时使用SizeOf
+}
+
+/*
+ *  默认的消息字节数:[]byte及string取长度,实现了Size() int的取Size(),其它为0。
+ *  字节数在入队时计算,此时消息尚未编码,由encoder编码的消息不计入MaxBytes及水位,
+ *  需要按字节限制这类消息时通过SendQueueOption.Sizer提供估算
+ */
+func SizeOf(o interface{}) int {
+	switch o.(type) {
+	case []byte:
+		return len(o.([]byte))
+	case string:
+		return len(o.(string))
+	case interface{ Size() int }:
+		return o.(interface{ Size() int }).Size()
+	default:
+		return 0
+	}
+}
+
+func priorityOf(o interface{}) int {
+	if p, ok := o.(Prioritized); ok {
+		return p.Priority()
+	} else {
+		return 0
+	}
+}
+
+func clampPriority(priority int) int {
+	if priority < 0 {
+		return 0
+	} else if priority >= SendPriorityCount {
+		return SendPriorityCount - 1
+	} else {
+		return priority
+	}
+}
+
+type sendItem struct {
+	v       interface{}
+	size    int
+	seq     uint64
+	addTime time.Time //设置了waitObserver时记录入队时间
+	cb      func(error)
+}
+
+/*
+ *  多通道的发送队列,Get按优先级从高到低取出所有通道中的消息,同一通道内保持加入顺序
+ */
 type SendQueue struct {
-	list        []interface{}
+	lanes       [SendPriorityCount][]sendItem
+	count       int
+	cbCount     int //设置了完成回调的消息数
+	seq         uint64
 	listGuard   sync.Mutex
 	emptyCond   *cond
 	fullCond    *cond
@@ -165,39 +252,255 @@ type SendQueue struct {
 	closed      bool
 	emptyWaited int
 	fullWaited  int
+	swapedTimes []time.Time
+	onWait      func(time.Duration)
+	option      SendQueueOption
+	bytes       int
+	writing     int //最近一次Get取出,尚未调用Written的字节数
+	aboveHigh   bool
+}
+
+/*
+ *  设置后每个元素被Get取出时以其在队列中的等待时间调用observer,必须在使用队列之前调用
+ */
+func (self *SendQueue) SetWaitObserver(observer func(time.Duration)) {
+	self.listGuard.Lock()
+	self.onWait = observer
+	self.listGuard.Unlock()
+}
+
+/*
+ *  设置溢出策略,字节数上限及水位回调,必须在使用队列之前调用
+ */
+func (self *SendQueue) SetOption(option SendQueueOption) error {
+	if option.MaxBytes < 0 || option.HighWatermark < 0 || option.LowWatermark < 0 {
+		return ErrInvaildSendQueueOption
+	}
+
+	if option.HighWatermark > 0 && option.LowWatermark >= option.HighWatermark {
+		return ErrInvaildSendQueueOption
+	}
+
+	switch option.Policy {
+	case OverflowReject, OverflowDropOldest, OverflowDropNewest, OverflowDropPriority, OverflowClose:
+	default:
+		return ErrInvaildSendQueueOption
+	}
+
+	if nil == option.Sizer {
+		option.Sizer = SizeOf
+	}
+
+	self.listGuard.Lock()
+	self.option = option
+	self.bytes = 0
+	for p := range self.lanes {
+		for i := range self.lanes[p] {
+			item := &self.lanes[p][i]
+			item.size = option.Sizer(item.v)
+			self.bytes += item.size
+		}
+	}
+	self.listGuard.Unlock()
+	return nil
+}
+
+func (self *SendQueue) sizeOf(item interface{}) int {
+	if nil == self.option.Sizer {
+		return 0
+	} else {
+		return self.option.Sizer(item)
+	}
+}
+
+func (self *SendQueue) full(size int) bool {
+	if self.count >= self.fullSize {
+		return true
+	}
+	return self.option.MaxBytes > 0 && self.count > 0 && self.bytes+size > self.option.MaxBytes
+}
+
+func (self *SendQueue) appendLocked(item interface{}, size int, priority int, cb func(error)) {
+	self.seq++
+	i := sendItem{v: item, size: size, seq: self.seq, cb: cb}
+	if nil != self.onWait {
+		i.addTime = time.Now()
+	}
+	self.lanes[priority] = append(self.lanes[priority], i)
+	self.count++
+	if nil != cb {
+		self.cbCount++
+	}
+	self.bytes += size
+}
+
+//移除通道priority中最早的消息
+func (self *SendQueue) removeLocked(priority int) sendItem {
+	lane := self.lanes[priority]
+	item := lane[0]
+	last := len(lane) - 1
+	copy(lane, lane[1:])
+	lane[last] = sendItem{}
+	self.lanes[priority] = lane[:last]
+	self.count--
+	if nil != item.cb {
+		self.cbCount--
+	}
+	self.bytes -= item.size
+	return item
+}
+
+//最低优先级的非空通道,队列为空时返回-1
+func (self *SendQueue) lowLocked() int {
+	for p := range self.lanes {
+		if len(self.lanes[p]) > 0 {
+			return p
+		}
+	}
+	return -1
+}
+
+//最早加入的消息所在的通道,队列为空时返回-1
+func (self *SendQueue) oldestLocked() int {
+	oldest := -1
+	for p := range self.lanes {
+		if len(self.lanes[p]) > 0 && (oldest < 0 || self.lanes[p][0].seq < self.lanes[oldest][0].seq) {
+			oldest = p
+		}
+	}
+	return oldest
+}
+
+/*
+ *  按策略为item腾出空间,返回被丢弃的消息及item是否可以加入队列
+ */
+func (self *SendQueue) overflowLocked(item interface{}, size int, priority int, cb func(error)) (dropped []sendItem, accept bool, err error) {
+	switch self.option.Policy {
+	case OverflowDropNewest:
+		return []sendItem{{v: item, cb: cb}}, false, nil
+	case OverflowDropOldest:
+		for self.full(size) && self.count > 0 {
+			dropped = append(dropped, self.removeLocked(self.oldestLocked()))
+		}
+		return dropped, true, nil
+	case OverflowDropPriority:
+		for self.full(size) && self.count > 0 {
+			low := self.lowLocked()
+			if low > priority {
+				return append(dropped, sendItem{v: item, cb: cb}), false, nil
+			}
+			dropped = append(dropped, self.removeLocked(low))
+		}
+		return dropped, true, nil
+	case OverflowClose:
+		return nil, false, ErrQueueOverflow
+	default:
+		return nil, false, ErrQueueFull
+	}
+}
+
+//返回需要在锁外调用的水位回调
+func (self *SendQueue) watermarkLocked() func() {
+	if self.option.HighWatermark <= 0 {
+		return nil
+	}
+
+	bytes := self.bytes + self.writing
+
+	if !self.aboveHigh && bytes >= self.option.HighWatermark {
+		self.aboveHigh = true
+		return self.option.OnHighWatermark
+	} else if self.aboveHigh && bytes <= self.option.LowWatermark {
+		self.aboveHigh = false
+		return self.option.OnLowWatermark
+	}
+
+	return nil
+}
+
+func (self *SendQueue) afterAdd(needSignal bool, dropped []sendItem, watermark func()) {
+	if needSignal {
+		self.emptyCond.signal()
+	}
+
+	for _, v := range dropped {
+		if nil != self.option.OnDrop {
+			self.option.OnDrop(v.v)
+		}
+		if nil != v.cb {
+			v.cb(kendynet.ErrSendDropped)
+		}
+	}
+
+	if nil != watermark {
+		watermark()
+	}
 }
 
 //如果队列满返回busy
 func (self *SendQueue) Add(item interface{}) error {
+	return self.AddWithPriority(item, priorityOf(item))
+}
+
+func (self *SendQueue) AddWithPriority(item interface{}, priority int) error {
+	return self.AddWithCallback(item, priority, nil)
+}
+
+/*
+ *  cb在消息处理完成时由消费者调用,见GetWithCallbacks。返回错误时不会调用cb
+ */
+func (self *SendQueue) AddWithCallback(item interface{}, priority int, cb func(error)) error {
+	priority = clampPriority(priority)
+
 	self.listGuard.Lock()
 	if self.closed {
 		self.listGuard.Unlock()
 		return ErrQueueClosed
 	}
 
-	if len(self.list) >= self.fullSize {
-		self.listGuard.Unlock()
-		return ErrQueueFull
+	size := self.sizeOf(item)
+	accept := true
+	var dropped []sendItem
+
+	if self.full(size) {
+		var err error
+		if dropped, accept, err = self.overflowLocked(item, size, priority, cb); nil != err {
+			self.listGuard.Unlock()
+			return err
+		}
 	}
 
-	self.list = append(self.list, item)
+	if accept {
+		self.appendLocked(item, size, priority, cb)
+	}
 
-	needSignal := self.emptyWaited > 0
+	needSignal := accept && self.emptyWaited > 0
+	watermark := self.watermarkLocked()
 	self.listGuard.Unlock()
-	if needSignal {
-		self.emptyCond.signal()
-	}
+	self.afterAdd(needSignal, dropped, watermark)
 	return nil
 }
 
+/*
+ *  只有OverflowReject策略下队列满时等待,其它策略与Add相同
+ */
 func (self *SendQueue) AddWithTimeout(item interface{}, timeout time.Duration) error {
+	priority := clampPriority(priorityOf(item))
+
 	self.listGuard.Lock()
 	if self.closed {
 		self.listGuard.Unlock()
 		return ErrQueueClosed
 	}
 
-	for len(self.list) >= self.fullSize {
+	if self.option.Policy != OverflowReject {
+		self.listGuard.Unlock()
+		return self.AddWithPriority(item, priority)
+	}
+
+	size := self.sizeOf(item)
+
+	for self.full(size) {
 		if timeout > 0 {
 			self.fullWaited++
 			ok := self.fullCond.waitWithTimeout(timeout)
@@ -220,38 +523,133 @@ func (self *SendQueue) AddWithTimeout(item interface{}, timeout time.Duration) e
 		}
 	}
 
-	self.list = append(self.list, item)
+	self.appendLocked(item, size, priority, nil)
 
 	needSignal := self.emptyWaited > 0
+	watermark := self.watermarkLocked()
 	self.listGuard.Unlock()
-	if needSignal {
-		self.emptyCond.signal()
-	}
+	self.afterAdd(needSignal, nil, watermark)
 	return nil
 }
 
+/*
+ *  取出队列中所有的消息追加到swaped[0:0],高优先级通道的消息在前。
+ *  不返回完成回调,队列中有通过AddWithCallback加入的消息时使用GetWithCallbacks。
+ *
+ *  取出的消息的字节数在调用Written之前仍计入Bytes()及水位,再次Get时视为上一批已经写入完成
+ */
 func (self *SendQueue) Get(swaped []interface{}) (closed bool, datas []interface{}) {
-	swaped = swaped[0:0]
+	closed, datas, _ = self.GetWithCallbacks(swaped, nil)
+	return
+}
+
+/*
+ *  与Get相同,同时将完成回调追加到callbacks[0:0]。批次中有任何消息设置了回调时len(cbs) == len(datas),
+ *  cbs[i]为datas[i]的回调(可能为nil),否则cbs为空
+ */
+func (self *SendQueue) GetWithCallbacks(swaped []interface{}, callbacks []func(error)) (closed bool, datas []interface{}, cbs []func(error)) {
+	datas = swaped[0:0]
+	cbs = callbacks[0:0]
 	self.listGuard.Lock()
-	for !self.closed && len(self.list) == 0 {
+	for !self.closed && self.count == 0 {
 		self.emptyWaited++
 		self.emptyCond.wait()
 		self.emptyWaited--
 	}
-	datas = self.list
+
+	onWait := self.onWait
+	addTimes := self.swapedTimes[0:0]
+	withCB := self.cbCount > 0
+
+	for p := SendPriorityCount - 1; p >= 0; p-- {
+		lane := self.lanes[p]
+		for i := range lane {
+			datas = append(datas, lane[i].v)
+			if withCB {
+				cbs = append(cbs, lane[i].cb)
+			}
+			if nil != onWait {
+				addTimes = append(addTimes, lane[i].addTime)
+			}
+			lane[i] = sendItem{}
+		}
+		self.lanes[p] = lane[0:0]
+	}
+
 	closed = self.closed
 	needSignal := self.fullWaited > 0
-	self.list = swaped
+	self.count = 0
+	self.cbCount = 0
+	self.writing = self.bytes
+	self.bytes = 0
+	watermark := self.watermarkLocked()
 	self.listGuard.Unlock()
 	if needSignal {
 		self.fullCond.broadcast()
 	}
+	if nil != watermark {
+		watermark()
+	}
+	if nil != onWait {
+		now := time.Now()
+		for _, t := range addTimes {
+			onWait(now.Sub(t))
+		}
+		self.swapedTimes = addTimes
+	}
 	return
 }
 
+/*
+ *  消费者在最近一次Get取出的消息写入完成(或失败)之后调用,释放它们占用的字节数
+ */
+func (self *SendQueue) Written() {
+	self.listGuard.Lock()
+	if self.writing == 0 {
+		self.listGuard.Unlock()
+		return
+	}
+	self.writing = 0
+	watermark := self.watermarkLocked()
+	self.listGuard.Unlock()
+	if nil != watermark {
+		watermark()
+	}
+}
+
+/*
+ *  移除队列中所有的消息并以err调用它们的完成回调,不等待。用于消费者结束之后
+ */
+func (self *SendQueue) Discard(err error) {
+	self.listGuard.Lock()
+	self.writing = 0
+	if self.count == 0 {
+		self.listGuard.Unlock()
+		return
+	}
+	var cbs []func(error)
+	for p := range self.lanes {
+		for i := range self.lanes[p] {
+			if nil != self.lanes[p][i].cb {
+				cbs = append(cbs, self.lanes[p][i].cb)
+			}
+			self.lanes[p][i] = sendItem{}
+		}
+		self.lanes[p] = self.lanes[p][0:0]
+	}
+	self.count = 0
+	self.cbCount = 0
+	self.bytes = 0
+	self.listGuard.Unlock()
+
+	for _, cb := range cbs {
+		cb(err)
+	}
+}
+
 func (self *SendQueue) Close() (bool, int) {
 	self.listGuard.Lock()
-	n := len(self.list)
+	n := self.count
 	if self.closed {
 		self.listGuard.Unlock()
 		return false, n
@@ -292,7 +690,22 @@ func (self *SendQueue) Closed() bool {
 func (self *SendQueue) Empty() bool {
 	self.listGuard.Lock()
 	defer self.listGuard.Unlock()
-	return len(self.list) == 0
+	return self.count == 0
+}
+
+/*
+ *  队列中及已经取出尚未写入完成的消息的字节数
+ */
+func (self *SendQueue) Bytes() int {
+	self.listGuard.Lock()
+	defer self.listGuard.Unlock()
+	return self.bytes + self.writing
+}
+
+func (self *SendQueue) Len() int {
+	self.listGuard.Lock()
+	defer self.listGuard.Unlock()
+	return self.count
 }
 
 func NewSendQueue(fullSize ...int) *SendQueue {
@@ -300,7 +713,7 @@ func NewSendQueue(fullSize ...int) *SendQueue {
 	self.closed = false
 	self.emptyCond = newCond(&self.listGuard)
 	self.fullCond = newCond(&self.listGuard)
-	self.list = make([]interface{}, 0, initCap)
+	self.lanes[0] = make([]sendItem, 0, initCap)
 
 	if len(fullSize) > 0 {
 		if fullSize[0] <= 0 {
@@ -6,6 +6,7 @@ import (
 	"github.com/sniperHW/kendynet/util"
 	"net"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -46,6 +47,9 @@ type SocketBase struct {
 	errorCallback   func(kendynet.StreamSession, error)
 	closeCallBack   func(kendynet.StreamSession, error)
 	inboundCallBack func(kendynet.StreamSession, interface{})
+	heartbeat       *Heartbeat
+	closeNotify     CloseNotify
+	metrics         *SessionMetrics
 }
 
 func (this *SocketBase) IsClosed() bool {
@@ -89,6 +93,13 @@ func (this *SocketBase) SetCloseCallBack(cb func(kendynet.StreamSession, error))
 	return this.imp
 }
 
+/*
+ *  在关闭回调之后调用fn,与SetCloseCallBack互不覆盖。会话已经关闭时立即调用
+ */
+func (this *SocketBase) NotifyClose(fn func(kendynet.StreamSession, error)) {
+	this.closeNotify.Add(this.imp, fn)
+}
+
 func (this *SocketBase) SetEncoder(encoder kendynet.EnCoder) kendynet.StreamSession {
 	this.encoder = encoder
 	return this.imp
@@ -99,6 +110,21 @@ func (this *SocketBase) SetSendQueueSize(size int) kendynet.StreamSession {
 	return this.imp
 }
 
+/*
+ *  设置发送队列的溢出策略及水位回调,必须在Send之前调用。
+ *  OverflowClose策略下队列满时会话以kendynet.ErrSlowConsumer关闭,Send返回kendynet.ErrSlowConsumer
+ */
+func (this *SocketBase) SetSendQueueOption(option SendQueueOption) error {
+	onDrop := option.OnDrop
+	option.OnDrop = func(o interface{}) {
+		this.metrics.Add(MetricSendDrops, 1)
+		if nil != onDrop {
+			onDrop(o)
+		}
+	}
+	return this.sendQue.SetOption(option)
+}
+
 func (this *SocketBase) getRecvTimeout() time.Duration {
 	return time.Duration(atomic.LoadInt64(&this.recvTimeout))
 }
@@ -108,17 +134,44 @@ func (this *SocketBase) getSendTimeout() time.Duration {
 }
 
 func (this *SocketBase) Send(o interface{}) error {
+	return this.SendWithPriority(o, priorityOf(o))
+}
+
+/*
+ *  o进入发送队列中priority对应的优先级通道(0到SendPriorityCount-1),高优先级的消息先于已经在队列中的低优先级消息发送
+ */
+func (this *SocketBase) SendWithPriority(o interface{}, priority int) error {
+	return this.send(o, priority, nil)
+}
+
+/*
+ *  o处理完成后在发送线程中调用cb:nil表示已经全部写入内核,否则为编码错误,kendynet.ErrSendTimeout,
+ *  kendynet.ErrSendDropped(被溢出策略丢弃)或kendynet.ErrSocketClose(会话关闭时尚未发送)。
+ *  返回错误时不会调用cb。cb中不能阻塞
+ */
+func (this *SocketBase) SendWithCallback(o interface{}, cb func(error), priority ...int) error {
+	if len(priority) > 0 {
+		return this.send(o, priority[0], cb)
+	} else {
+		return this.send(o, priorityOf(o), cb)
+	}
+}
+
+func (this *SocketBase) send(o interface{}, priority int, cb func(error)) error {
 	if nil == o {
 		return kendynet.ErrInvaildObject
 	} else if _, ok := o.([]byte); !ok && nil == this.encoder {
 		return kendynet.ErrInvaildEncoder
 	} else {
 
-		if err := this.sendQue.Add(o); nil != err {
+		if err := this.sendQue.AddWithCallback(o, priority, cb); nil != err {
 			if err == ErrQueueClosed {
 				err = kendynet.ErrSocketClose
 			} else if err == ErrQueueFull {
 				err = kendynet.ErrSendQueFull
+			} else if err == ErrQueueOverflow {
+				err = kendynet.ErrSlowConsumer
+				this.imp.Close(err, 0)
 			}
 			return err
 		}
@@ -145,6 +198,9 @@ func (this *SocketBase) SendWithTimeout(o interface{}, timeout time.Duration) er
 				err = kendynet.ErrSendQueFull
 			} else if err == ErrAddTimeout {
 				err = kendynet.ErrSendTimeout
+			} else if err == ErrQueueOverflow {
+				err = kendynet.ErrSlowConsumer
+				this.imp.Close(err, 0)
 			}
 			return err
 		}
@@ -171,7 +227,16 @@ func (this *SocketBase) BeginRecv(cb func(kendynet.StreamSession, interface{}))
 					this.imp.SetInBoundProcessor(this.imp.defaultInBoundProcessor())
 				}
 				this.addIO()
-				this.inboundCallBack = cb
+				if h := this.heartbeat; nil != h {
+					this.inboundCallBack = func(s kendynet.StreamSession, msg interface{}) {
+						if !h.OnMessage(msg) {
+							cb(s, msg)
+						}
+					}
+					h.Start()
+				} else {
+					this.inboundCallBack = cb
+				}
 				go this.imp.recvThreadFunc()
 			}
 		}
@@ -180,6 +245,16 @@ func (this *SocketBase) BeginRecv(cb func(kendynet.StreamSession, interface{}))
 	return
 }
 
+//以err调用一批消息的完成回调
+func notifySendResult(cbs []func(error), err error) {
+	for i, cb := range cbs {
+		if nil != cb {
+			cb(err)
+			cbs[i] = nil
+		}
+	}
+}
+
 func (this *SocketBase) addIO() {
 	atomic.AddInt32(&this.ioCount, 1)
 }
@@ -187,22 +262,40 @@ func (this *SocketBase) addIO() {
 func (this *SocketBase) ioDone() {
 	if atomic.AddInt32(&this.ioCount, -1) == 0 && this.flag.AtomicTest(fdoclose) {
 		if atomic.CompareAndSwapInt32(&this.doCloseOnce, 0, 1) {
+			this.sendQue.Discard(kendynet.ErrSocketClose)
 			if nil != this.closeCallBack {
 				this.closeCallBack(this.imp, this.closeReason)
 			}
+			this.closeNotify.Notify(this.imp, this.closeReason)
 		}
 	}
 }
 
 func (this *SocketBase) ShutdownRead() {
 	this.flag.AtomicSet(frclosed)
-	this.imp.getNetConn().(interface{ CloseRead() error }).CloseRead()
+	closeRead(this.imp.getNetConn())
 }
 
 func (this *SocketBase) ShutdownWrite() {
 	closeOK, remain := this.sendQue.Close()
 	if closeOK && remain == 0 {
-		this.imp.getNetConn().(interface{ CloseWrite() error }).CloseWrite()
+		closeWrite(this.imp.getNetConn())
+	}
+}
+
+/*
+ *  tls.Conn只支持CloseWrite(发送close_notify后关闭底层连接的写端),不支持CloseRead,
+ *  不支持的连接仅设置标记,由Close关闭连接
+ */
+func closeRead(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	}
+}
+
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
 	}
 }
 
@@ -213,6 +306,10 @@ func (this *SocketBase) Close(reason error, delay time.Duration) {
 
 		this.flag.AtomicSet(fclosed)
 
+		if nil != this.heartbeat {
+			this.heartbeat.Stop()
+		}
+
 		_, remain := this.sendQue.Close()
 
 		if remain > 0 && delay > 0 {
@@ -240,10 +337,69 @@ func (this *SocketBase) Close(reason error, delay time.Duration) {
 
 		if atomic.LoadInt32(&this.ioCount) == 0 {
 			if atomic.CompareAndSwapInt32(&this.doCloseOnce, 0, 1) {
+				this.sendQue.Discard(kendynet.ErrSocketClose)
 				if nil != this.closeCallBack {
 					this.closeCallBack(this.imp, reason)
 				}
+				this.closeNotify.Notify(this.imp, reason)
 			}
 		}
 	}
 }
+
+/*
+ *  按优先级发送,StreamSocket,WebSocket,DatagramSocket及aio.Socket实现了此接口
+ */
+type PrioritySender interface {
+	SendWithPriority(o interface{}, priority int) error
+}
+
+/*
+ *  发送并在处理完成后回调,实现者同PrioritySender
+ */
+type CallbackSender interface {
+	SendWithCallback(o interface{}, cb func(error), priority ...int) error
+}
+
+/*
+ *  供监听器,管理器等组件跟踪会话的关闭,不占用会话的关闭回调
+ */
+type CloseNotifier interface {
+	NotifyClose(func(kendynet.StreamSession, error))
+}
+
+type CloseNotify struct {
+	mu     sync.Mutex
+	done   bool
+	reason error
+	fns    []func(kendynet.StreamSession, error)
+}
+
+func (this *CloseNotify) Add(s kendynet.StreamSession, fn func(kendynet.StreamSession, error)) {
+	this.mu.Lock()
+	if this.done {
+		reason := this.reason
+		this.mu.Unlock()
+		fn(s, reason)
+	} else {
+		this.fns = append(this.fns, fn)
+		this.mu.Unlock()
+	}
+}
+
+func (this *CloseNotify) Notify(s kendynet.StreamSession, reason error) {
+	this.mu.Lock()
+	if this.done {
+		this.mu.Unlock()
+		return
+	}
+	this.done = true
+	this.reason = reason
+	fns := this.fns
+	this.fns = nil
+	this.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(s, reason)
+	}
+}
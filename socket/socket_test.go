@@ -3,21 +3,34 @@ package socket
 //go test -covermode=count -v -coverprofile=coverage.out -run=.
 //go tool cover -html=coverage.out
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"fmt"
 	gorilla "github.com/gorilla/websocket"
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/buffer"
+	"github.com/sniperHW/kendynet/codec"
 	"github.com/sniperHW/kendynet/message"
+	"github.com/sniperHW/kendynet/socket/rudp"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	_ "net/http/pprof"
 	"net/url"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -847,6 +860,64 @@ func TestStreamSocket(t *testing.T) {
 
 }
 
+//codec包的长度前缀分帧用于StreamSocket
+func TestCodec(t *testing.T) {
+	o := codec.Option{HeaderSize: 2}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8150")
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if nil != err {
+			return
+		}
+		e, _ := codec.NewEncoder(o)
+		r, _ := codec.NewReceiver(o)
+		session := NewStreamSocket(conn)
+		session.SetEncoder(e).SetInBoundProcessor(r)
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			//[]byte会被session直接发送而不经过encoder,转成string以添加长度头
+			s.Send(string(msg.([]byte)))
+		})
+	}()
+
+	conn, err := net.Dial("tcp", "localhost:8150")
+	assert.Nil(t, err)
+
+	e, _ := codec.NewEncoder(o)
+	r, _ := codec.NewReceiver(o)
+	session := NewStreamSocket(conn)
+	session.SetEncoder(e).SetInBoundProcessor(r)
+
+	msgC := make(chan string, 10)
+
+	session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+		msgC <- string(msg.([]byte))
+	})
+
+	assert.Nil(t, session.Send("hello"))
+	assert.Nil(t, session.Send(strings.Repeat("a", 5000)))
+
+	select {
+	case msg := <-msgC:
+		assert.Equal(t, "hello", msg)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	select {
+	case msg := <-msgC:
+		assert.Equal(t, strings.Repeat("a", 5000), msg)
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+
+	session.Close(nil, 0)
+}
+
 func TestShutDownWrite(t *testing.T) {
 	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8110")
 
@@ -1049,3 +1120,1371 @@ func BenchmarkCond(b *testing.B) {
 		cNotify.signal()
 	}
 }
+
+//生成自签名证书,同时用作CA及服务端/客户端证书
+func genTLSCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kendynet"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestTLS(t *testing.T) {
+	cert, pool := genTLSCert(t)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8111")
+
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	peerC := make(chan string, 1)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			} else {
+				tlsConn := tls.Server(conn, serverConfig)
+				if nil != tlsConn.Handshake() {
+					conn.Close()
+					continue
+				}
+				session := NewStreamSocket(tlsConn)
+				peerC <- session.(*StreamSocket).PeerCertificates()[0].Subject.CommonName
+				session.SetErrorCallBack(func(sess kendynet.StreamSession, reason error) {
+					if reason == io.EOF {
+						sess.Send("hello")
+					}
+					sess.Close(nil, time.Second)
+				}).SetEncoder(&encoder{}).BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+					s.Send(msg)
+				})
+			}
+		}
+	}()
+
+	{
+		//非tls连接
+		conn, _ := net.Dial("tcp", "localhost:8111")
+		session := NewStreamSocket(conn).(*StreamSocket)
+		_, ok := session.ConnectionState()
+		assert.False(t, ok)
+		assert.Nil(t, session.PeerCertificates())
+		session.Close(nil, 0)
+	}
+
+	{
+		//未提供客户端证书,握手失败
+		conn, err := tls.Dial("tcp", "localhost:8111", &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if nil == err {
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		assert.NotNil(t, err)
+	}
+
+	{
+		conn, err := tls.Dial("tcp", "localhost:8111", clientConfig)
+		assert.Nil(t, err)
+
+		session := NewStreamSocket(conn)
+		assert.NotNil(t, session)
+
+		state, ok := session.(*StreamSocket).ConnectionState()
+		assert.True(t, ok)
+		assert.True(t, state.HandshakeComplete)
+		assert.Equal(t, "kendynet", session.(*StreamSocket).PeerCertificates()[0].Subject.CommonName)
+
+		assert.Equal(t, "kendynet", <-peerC)
+
+		die := make(chan struct{})
+
+		var recvs []string
+
+		session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+			close(die)
+		}).SetEncoder(&encoder{}).SetRecvTimeout(time.Second * 5)
+
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			recvs = append(recvs, string(msg.([]byte)))
+			if strings.Join(recvs, "") == "echohello" {
+				s.Close(nil, 0)
+			}
+		})
+
+		session.Send("echo")
+
+		time.Sleep(time.Millisecond * 100)
+
+		//发送close_notify,服务端读到io.EOF后回复hello
+		session.ShutdownWrite()
+
+		<-die
+
+		assert.Equal(t, "echohello", strings.Join(recvs, ""))
+	}
+
+	listener.Close()
+}
+
+func TestTLSSendTimeout(t *testing.T) {
+	cert, pool := genTLSCert(t)
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8144")
+
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	holdC := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*net.TCPConn).SetReadBuffer(0)
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		tlsConn.Handshake()
+		//握手之后不再读取
+		holdC <- tlsConn
+	}()
+
+	conn, err := tls.Dial("tcp", "localhost:8144", &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	assert.Nil(t, err)
+
+	hold := <-holdC
+
+	session := NewStreamSocket(conn)
+
+	die := make(chan error, 1)
+
+	var timeouts int32
+
+	session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+		die <- reason
+	}).SetErrorCallBack(func(sess kendynet.StreamSession, err error) {
+		if err == kendynet.ErrSendTimeout {
+			atomic.AddInt32(&timeouts, 1)
+		}
+	}).SetEncoder(&encoder{}).SetSendTimeout(time.Millisecond * 200)
+
+	go func() {
+		data := strings.Repeat("a", 65536)
+		for {
+			err := session.Send(data)
+			if err == kendynet.ErrSocketClose {
+				return
+			} else if nil != err {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	select {
+	case reason := <-die:
+		//tls写超时后不再重试,会话被关闭
+		assert.Equal(t, kendynet.ErrSendTimeout, reason)
+	case <-time.After(time.Second * 10):
+		assert.FailNow(t, "tls session not closed after send timeout")
+	}
+
+	time.Sleep(time.Millisecond * 500)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&timeouts))
+
+	hold.Close()
+	listener.Close()
+}
+
+func TestDatagramSocket(t *testing.T) {
+	udpAddr, _ := net.ResolveUDPAddr("udp", "localhost:8112")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+
+	mux := NewUDPMux(conn)
+
+	var mtx sync.Mutex
+	serverSessions := 0
+	serverCloseC := make(chan error, 10)
+
+	go mux.Serve(func(session kendynet.StreamSession) {
+		mtx.Lock()
+		serverSessions++
+		mtx.Unlock()
+		session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+			serverCloseC <- reason
+		}).SetEncoder(&encoder{}).SetRecvTimeout(time.Millisecond * 500)
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			//每个数据报独立回显
+			s.Send(append([]byte("echo:"), msg.([]byte)...))
+		})
+	})
+
+	{
+		//不支持的连接类型
+		assert.Nil(t, NewDatagramSocket(&net.TCPConn{}))
+	}
+
+	{
+		c, _ := net.DialUDP("udp", nil, udpAddr)
+		session := NewDatagramSocket(c)
+		assert.NotNil(t, session)
+		session.SetUserData(1)
+		assert.Equal(t, 1, session.GetUserData())
+
+		recvC := make(chan string, 10)
+
+		session.SetEncoder(&encoder{})
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			recvC <- string(msg.([]byte))
+		})
+
+		session.Send("hello")
+		assert.Equal(t, "echo:hello", <-recvC)
+
+		session.Send("world")
+		session.Send([]byte("!"))
+		assert.Equal(t, "echo:world", <-recvC)
+		assert.Equal(t, "echo:!", <-recvC)
+
+		n, err := session.DirectSend([]byte("direct"))
+		assert.Nil(t, err)
+		assert.Equal(t, 6, n)
+		assert.Equal(t, "echo:direct", <-recvC)
+
+		mtx.Lock()
+		assert.Equal(t, 1, serverSessions)
+		mtx.Unlock()
+
+		//空闲超时,服务端会话被关闭
+		assert.Equal(t, kendynet.ErrRecvTimeout, <-serverCloseC)
+
+		//同一地址再次发送创建新会话
+		session.Send("again")
+		assert.Equal(t, "echo:again", <-recvC)
+
+		mtx.Lock()
+		assert.Equal(t, 2, serverSessions)
+		mtx.Unlock()
+
+		session.Close(nil, 0)
+	}
+
+	{
+		c, _ := net.DialUDP("udp", nil, udpAddr)
+		session := NewDatagramSocket(c)
+		session.SetEncoder(&encoder{})
+		recvC := make(chan string, 1)
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			recvC <- string(msg.([]byte))
+		})
+		session.Send("hello")
+		assert.Equal(t, "echo:hello", <-recvC)
+
+		//关闭UDPMux关闭所有会话
+		mux.Close()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-serverCloseC:
+			case <-time.After(time.Second):
+				assert.FailNow(t, "server session not closed")
+			}
+		}
+
+		session.Close(nil, 0)
+	}
+}
+
+func TestDatagramSendError(t *testing.T) {
+	udpAddr, _ := net.ResolveUDPAddr("udp", "localhost:8145")
+	conn, _ := net.ListenUDP("udp", udpAddr)
+
+	recvC := make(chan string, 10)
+	go func() {
+		buff := make([]byte, MaxDatagramSize)
+		for {
+			n, err := conn.Read(buff)
+			if nil != err {
+				return
+			}
+			recvC <- string(buff[:n])
+		}
+	}()
+
+	c, _ := net.DialUDP("udp", nil, udpAddr)
+	session := NewDatagramSocket(c)
+
+	errC := make(chan error, 10)
+	session.SetEncoder(&encoder{}).SetErrorCallBack(func(s kendynet.StreamSession, err error) {
+		errC <- err
+	})
+
+	results := make(chan error, 10)
+	cb := func(err error) {
+		results <- err
+	}
+
+	//过大的数据报写入失败被丢弃,不影响会话及后续的发送
+	assert.Nil(t, session.(CallbackSender).SendWithCallback(make([]byte, MaxDatagramSize+1), cb))
+	assert.NotNil(t, <-results)
+	assert.NotNil(t, <-errC)
+
+	assert.Nil(t, session.(CallbackSender).SendWithCallback([]byte("hello"), cb))
+	assert.Nil(t, <-results)
+	assert.Equal(t, "hello", <-recvC)
+
+	assert.False(t, session.IsClosed())
+	assert.Equal(t, int64(1), session.(*DatagramSocket).Stats().SendErrors)
+
+	//conn被关闭时会话关闭,队列中剩余的消息以ErrSocketClose回调
+	closeC := make(chan struct{})
+	session.SetCloseCallBack(func(kendynet.StreamSession, error) {
+		close(closeC)
+	})
+	c.Close()
+	accepted := 0
+	for i := 0; i < 3; i++ {
+		//会话关闭之后返回错误,不调用回调
+		if nil == session.(CallbackSender).SendWithCallback([]byte("world"), cb) {
+			accepted++
+		}
+	}
+	assert.True(t, accepted > 0)
+	<-closeC
+	for i := 0; i < accepted; i++ {
+		assert.Equal(t, kendynet.ErrSocketClose, <-results)
+	}
+
+	conn.Close()
+}
+
+func TestRUDPStreamSocket(t *testing.T) {
+	l, err := rudp.Listen("udp", "localhost:8113", rudp.FastConfig())
+	assert.Nil(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if nil != err {
+				return
+			}
+			session := NewStreamSocket(conn)
+			session.SetEncoder(&encoder{}).BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+				s.Send(msg)
+			})
+		}
+	}()
+
+	conn, err := rudp.Dial("udp", "localhost:8113", rudp.FastConfig())
+	assert.Nil(t, err)
+
+	session := NewStreamSocket(conn)
+	assert.NotNil(t, session)
+
+	die := make(chan struct{})
+
+	var recvs []string
+
+	session.SetCloseCallBack(func(sess kendynet.StreamSession, reason error) {
+		close(die)
+	}).SetEncoder(&encoder{}).SetRecvTimeout(time.Second * 5)
+
+	session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+		recvs = append(recvs, string(msg.([]byte)))
+		if strings.Join(recvs, "") == "hello world" {
+			s.Close(nil, 0)
+		}
+	})
+
+	session.Send("hello")
+	session.Send(" world")
+
+	<-die
+
+	assert.Equal(t, "hello world", strings.Join(recvs, ""))
+
+	l.Close()
+}
+
+//只实现SendWithPriority,记录心跳发送的消息及优先级
+type prioSession struct {
+	kendynet.StreamSession
+	sent       []interface{}
+	priorities []int
+}
+
+func (this *prioSession) SendWithPriority(o interface{}, priority int) error {
+	this.sent = append(this.sent, o)
+	this.priorities = append(this.priorities, priority)
+	return nil
+}
+
+func TestHeartbeat(t *testing.T) {
+	isAll := func(msg interface{}, c byte) bool {
+		b, ok := msg.([]byte)
+		if !ok || len(b) == 0 {
+			return false
+		}
+		for _, v := range b {
+			if v != c {
+				return false
+			}
+		}
+		return true
+	}
+
+	option := HeartbeatOption{
+		Interval:  time.Millisecond * 50,
+		MissCount: 3,
+		NewPing:   func() interface{} { return "p" },
+		IsPong:    func(msg interface{}) bool { return isAll(msg, 'P') },
+	}
+
+	{
+		_, err := NewHeartbeat(NewStreamSocket(&net.TCPConn{}), HeartbeatOption{Interval: time.Second})
+		assert.NotNil(t, err)
+	}
+
+	//ping/pong以最高优先级发送
+	{
+		s := &prioSession{}
+		o := option
+		o.IsPing = func(msg interface{}) bool { return msg == "p" }
+		o.NewPong = func(interface{}) interface{} { return "P" }
+		h, err := NewHeartbeat(s, o)
+		assert.Nil(t, err)
+		h.ping()
+		assert.True(t, h.OnMessage("p"))
+		assert.Equal(t, []interface{}{"p", "P"}, s.sent)
+		assert.Equal(t, []int{SendPriorityCount - 1, SendPriorityCount - 1}, s.priorities)
+	}
+
+	//TCP,通过编码器发送ping/pong
+	{
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8130")
+		listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				session := NewStreamSocket(conn)
+				session.SetEncoder(&encoder{})
+				session.(*StreamSocket).SetHeartbeat(HeartbeatOption{
+					Interval: time.Second,
+					NewPing:  func() interface{} { return "" },
+					IsPong:   func(msg interface{}) bool { return false },
+					IsPing:   func(msg interface{}) bool { return isAll(msg, 'p') },
+					NewPong:  func(ping interface{}) interface{} { return "P" },
+				})
+				session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+					s.Send(msg)
+				})
+			}
+		}()
+
+		conn, _ := net.Dial("tcp", "localhost:8130")
+		session := NewStreamSocket(conn).(*StreamSocket)
+		session.SetEncoder(&encoder{})
+		assert.Nil(t, session.SetHeartbeat(option))
+		assert.Equal(t, time.Duration(0), session.RTT())
+
+		respChan := make(chan interface{}, 1)
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			respChan <- msg
+		})
+
+		assert.Equal(t, kendynet.ErrStarted, session.SetHeartbeat(option))
+
+		time.Sleep(time.Millisecond * 300)
+
+		assert.True(t, session.RTT() > 0)
+		assert.False(t, session.IsClosed())
+
+		//ping/pong可能与数据合并在同一次读取中
+		session.Send("hello")
+		assert.Equal(t, "hello", strings.Trim(string((<-respChan).([]byte)), "pP"))
+
+		session.Close(nil, 0)
+		listener.Close()
+	}
+
+	//对端不回应
+	{
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8130")
+		listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		conn, _ := net.Dial("tcp", "localhost:8130")
+		session := NewStreamSocket(conn).(*StreamSocket)
+
+		die := make(chan error)
+
+		session.SetEncoder(&encoder{}).SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+			die <- reason
+		})
+		session.SetHeartbeat(option)
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {})
+
+		assert.Equal(t, kendynet.ErrHeartbeatTimeout, <-die)
+		assert.Equal(t, time.Duration(0), session.RTT())
+
+		listener.Close()
+	}
+
+	//WebSocket,使用控制帧
+	{
+		upgrader := &gorilla.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		}
+
+		die := make(chan error, 1)
+		rtt := make(chan time.Duration, 1)
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+			conn, _ := upgrader.Upgrade(w, r, nil)
+			session := NewWSSocket(conn).(*WebSocket)
+			session.SetEncoder(&wsencoder{}).SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+				rtt <- session.RTT()
+				die <- reason
+			})
+			assert.Nil(t, session.SetHeartbeat(HeartbeatOption{Interval: time.Millisecond * 50}))
+			session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {})
+		})
+
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8131")
+		listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+		go func() {
+			http.Serve(listener, mux)
+		}()
+
+		u := url.URL{Scheme: "ws", Host: "localhost:8131", Path: "/heartbeat"}
+
+		conn, _, _ := gorilla.DefaultDialer.Dial(u.String(), nil)
+		assert.NotNil(t, conn)
+		session := NewWSSocket(conn)
+		session.SetEncoder(&wsencoder{}).BeginRecv(func(s kendynet.StreamSession, msg interface{}) {})
+
+		time.Sleep(time.Millisecond * 300)
+
+		session.Close(nil, 0)
+
+		<-die
+		assert.True(t, <-rtt > 0)
+
+		//对端连接后不再读取,ping得不到回应
+		conn, _, _ = gorilla.DefaultDialer.Dial(u.String(), nil)
+		assert.NotNil(t, conn)
+
+		select {
+		case reason := <-die:
+			assert.Equal(t, kendynet.ErrHeartbeatTimeout, reason)
+		case <-time.After(time.Second * 5):
+			assert.FailNow(t, "heartbeat timeout not triggered")
+		}
+
+		conn.Close()
+		listener.Close()
+	}
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (this *addrConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func newAddrConn(ip string) net.Conn {
+	return &addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}}
+}
+
+func TestLimiter(t *testing.T) {
+	_, err := NewLimiter(LimitOption{Allow: []string{"abc"}})
+	assert.NotNil(t, err)
+
+	_, err = NewLimiter(LimitOption{Deny: []string{"10.0.0.0/33"}})
+	assert.NotNil(t, err)
+
+	//ip过滤
+	{
+		l, err := NewLimiter(LimitOption{
+			Allow: []string{"10.0.0.0/8", "192.168.1.1"},
+			Deny:  []string{"10.1.0.0/16"},
+		})
+		assert.Nil(t, err)
+
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Nil(t, err)
+		_, err = l.Accept(newAddrConn("192.168.1.1"))
+		assert.Nil(t, err)
+		_, err = l.Accept(newAddrConn("10.1.0.1"))
+		assert.Equal(t, ErrIPDenied, err)
+		_, err = l.Accept(newAddrConn("192.168.1.2"))
+		assert.Equal(t, ErrIPDenied, err)
+
+		stats := l.Stats()
+		assert.Equal(t, 2, stats.Sessions)
+		assert.Equal(t, uint64(2), stats.RejectedIP)
+		assert.Equal(t, uint64(2), stats.Rejected)
+	}
+
+	//会话数
+	{
+		l, _ := NewLimiter(LimitOption{
+			MaxSessions:      3,
+			MaxSessionsPerIP: 2,
+		})
+
+		r1, err := l.Accept(newAddrConn("10.0.0.1"))
+		assert.Nil(t, err)
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Nil(t, err)
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Equal(t, ErrMaxSessionsPerIP, err)
+		_, err = l.Accept(newAddrConn("10.0.0.2"))
+		assert.Nil(t, err)
+		_, err = l.Accept(newAddrConn("10.0.0.3"))
+		assert.Equal(t, ErrMaxSessions, err)
+
+		//release只生效一次
+		r1()
+		r1()
+		assert.Equal(t, 2, l.Stats().Sessions)
+
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Nil(t, err)
+
+		stats := l.Stats()
+		assert.Equal(t, uint64(4), stats.Accepted)
+		assert.Equal(t, uint64(1), stats.RejectedPerIP)
+		assert.Equal(t, uint64(1), stats.RejectedMaxSessions)
+	}
+
+	//接受速率及PreAccept
+	{
+		l, _ := NewLimiter(LimitOption{
+			AcceptRate:  10,
+			AcceptBurst: 2,
+			PreAccept: func(conn net.Conn) bool {
+				return conn.RemoteAddr().(*net.TCPAddr).Port != 0
+			},
+		})
+
+		//PreAccept在速率检查之后,被拒绝的连接同样消耗速率
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Nil(t, err)
+		_, err = l.Accept(&addrConn{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}})
+		assert.Equal(t, ErrPreAcceptRejected, err)
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Equal(t, ErrAcceptRate, err)
+
+		time.Sleep(time.Millisecond * 150)
+
+		_, err = l.Accept(newAddrConn("10.0.0.1"))
+		assert.Nil(t, err)
+
+		stats := l.Stats()
+		assert.Equal(t, uint64(1), stats.RejectedRate)
+		assert.Equal(t, uint64(1), stats.RejectedPreAccept)
+	}
+
+	//会话关闭时释放
+	{
+		l, _ := NewLimiter(LimitOption{MaxSessions: 1})
+
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8133")
+		listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+		accepted := make(chan kendynet.StreamSession, 1)
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				release, err := l.Accept(conn)
+				if nil != err {
+					conn.Close()
+				} else {
+					session := NewStreamSocket(conn)
+					l.Track(session, release)
+					accepted <- session
+				}
+			}
+		}()
+
+		conn1, _ := net.Dial("tcp", "localhost:8133")
+		session := <-accepted
+
+		closeCallBack := make(chan struct{})
+		session.SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+			close(closeCallBack)
+		})
+
+		conn2, _ := net.Dial("tcp", "localhost:8133")
+		assert.Eventually(t, func() bool { return l.Stats().RejectedMaxSessions == 1 }, time.Second, time.Millisecond*10)
+
+		session.Close(nil, 0)
+		<-closeCallBack
+		assert.Equal(t, 0, l.Stats().Sessions)
+
+		conn3, _ := net.Dial("tcp", "localhost:8133")
+		session = <-accepted
+		assert.Equal(t, 1, l.Stats().Sessions)
+
+		//会话已经关闭时立即调用
+		session.Close(nil, 0)
+		notified := false
+		session.(*StreamSocket).NotifyClose(func(kendynet.StreamSession, error) {
+			notified = true
+		})
+		assert.True(t, notified)
+		assert.Equal(t, 0, l.Stats().Sessions)
+
+		conn1.Close()
+		conn2.Close()
+		conn3.Close()
+		listener.Close()
+	}
+}
+
+//Close之后不会关闭的会话
+type stuckSession struct {
+	kendynet.StreamSession
+	reason error
+	delay  time.Duration
+	notify func(kendynet.StreamSession, error)
+}
+
+func (this *stuckSession) Close(reason error, delay time.Duration) {
+	this.reason = reason
+	this.delay = delay
+}
+
+func (this *stuckSession) NotifyClose(fn func(kendynet.StreamSession, error)) {
+	this.notify = fn
+}
+
+func TestSessionTracker(t *testing.T) {
+	tracker := &SessionTracker{}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8134")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	var mu sync.Mutex
+	closed := 0
+
+	accepted := make(chan kendynet.StreamSession, 2)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			session := NewStreamSocket(conn)
+			session.SetEncoder(&encoder{}).SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+				assert.Equal(t, kendynet.ErrServerShutdown, reason)
+				time.Sleep(time.Millisecond * 50)
+				mu.Lock()
+				closed++
+				mu.Unlock()
+			})
+			if tracker.Add(session) {
+				session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {})
+				accepted <- session
+			}
+		}
+	}()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, _ := net.Dial("tcp", "localhost:8134")
+		clients = append(clients, conn)
+		session := <-accepted
+		session.Send(strings.Repeat("a", 1000))
+	}
+
+	assert.Equal(t, 2, tracker.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	//Shutdown在所有关闭回调返回之后返回
+	assert.Nil(t, tracker.Shutdown(ctx))
+	assert.Equal(t, 0, tracker.Len())
+	mu.Lock()
+	assert.Equal(t, 2, closed)
+	mu.Unlock()
+
+	//发送队列中的数据在关闭前发送完毕
+	for _, c := range clients {
+		b, err := ioutil.ReadAll(c)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, len(b))
+		c.Close()
+	}
+
+	//Shutdown之后加入的会话被直接关闭
+	conn, _ := net.Dial("tcp", "localhost:8134")
+	b := make([]byte, 1)
+	_, err := conn.Read(b)
+	assert.Equal(t, io.EOF, err)
+	conn.Close()
+
+	listener.Close()
+
+	//ctx到期
+	{
+		tracker := &SessionTracker{}
+		session := &stuckSession{}
+		assert.True(t, tracker.Add(session))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, tracker.Shutdown(ctx))
+		assert.Equal(t, kendynet.ErrServerShutdown, session.reason)
+		assert.True(t, session.delay > 0)
+
+		session.notify(session, nil)
+		assert.Equal(t, 0, tracker.Len())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics("")
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8139")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	accepted := make(chan kendynet.StreamSession, 1)
+	closed := make(chan struct{})
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		session := NewStreamSocket(conn)
+		session.(*StreamSocket).SetMetrics(metrics)
+		session.SetEncoder(&encoder{}).SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+			close(closed)
+		})
+		session.BeginRecv(func(s kendynet.StreamSession, msg interface{}) {
+			s.Send(1) //编码错误
+			s.Send(string(msg.([]byte)))
+		})
+		accepted <- session
+	}()
+
+	conn, _ := net.Dial("tcp", "localhost:8139")
+	session := <-accepted
+
+	conn.Write([]byte("hello"))
+	b := make([]byte, 5)
+	_, err := io.ReadFull(conn, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	time.Sleep(time.Millisecond * 50)
+
+	stats := session.(*StreamSocket).Stats()
+	assert.Equal(t, int64(5), stats.BytesIn)
+	assert.Equal(t, int64(5), stats.BytesOut)
+	assert.Equal(t, int64(1), stats.MessagesIn)
+	assert.Equal(t, int64(1), stats.MessagesOut)
+	assert.Equal(t, int64(1), stats.EncodeErrors)
+	assert.Equal(t, 0, stats.SendQueueLen)
+
+	assert.Equal(t, int64(5), metrics.Get(MetricBytesIn))
+	assert.Equal(t, int64(1), metrics.Get(MetricEncodeErrors))
+	assert.Equal(t, uint64(2), metrics.QueueWait().Count())
+
+	n, _, _ := metrics.Sessions()
+	assert.Equal(t, 1, n)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, req)
+	text := w.Body.String()
+	assert.Contains(t, text, "kendynet_session_bytes_in_total 5\n")
+	assert.Contains(t, text, "kendynet_session_encode_errors_total 1\n")
+	assert.Contains(t, text, "kendynet_sessions 1\n")
+	assert.Contains(t, text, "kendynet_session_send_queue_wait_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, text, "kendynet_session_send_queue_wait_seconds_count 2\n")
+
+	conn.Close()
+	<-closed
+
+	n, _, _ = metrics.Sessions()
+	assert.Equal(t, 0, n)
+
+	listener.Close()
+}
+
+type prioMsg struct {
+	s string
+	p int
+}
+
+func (this *prioMsg) Priority() int {
+	return this.p
+}
+
+func (this *prioMsg) Size() int {
+	return len(this.s)
+}
+
+func TestSendQueueOption(t *testing.T) {
+	assert.Equal(t, ErrInvaildSendQueueOption, NewSendQueue().SetOption(SendQueueOption{HighWatermark: 10, LowWatermark: 10}))
+	assert.Equal(t, ErrInvaildSendQueueOption, NewSendQueue().SetOption(SendQueueOption{Policy: OverflowPolicy(100)}))
+
+	//按字节数限制
+	{
+		q := NewSendQueue()
+		q.SetOption(SendQueueOption{MaxBytes: 10})
+		assert.Nil(t, q.Add(strings.Repeat("a", 8)))
+		assert.Equal(t, ErrQueueFull, q.Add("abc"))
+		assert.Equal(t, ErrAddTimeout, q.AddWithTimeout("abc", time.Millisecond*10))
+		assert.Equal(t, 8, q.Bytes())
+		q.Get(nil)
+		//取出的消息在写入完成之前仍然计入Bytes()
+		assert.Equal(t, 8, q.Bytes())
+		q.Written()
+		assert.Equal(t, 0, q.Bytes())
+		//队列为空时可以加入超过上限的消息
+		assert.Nil(t, q.Add(strings.Repeat("a", 20)))
+	}
+
+	//丢弃最早的
+	{
+		var dropped []interface{}
+		q := NewSendQueue(2)
+		q.SetOption(SendQueueOption{Policy: OverflowDropOldest, OnDrop: func(o interface{}) {
+			dropped = append(dropped, o)
+		}})
+		q.Add("1")
+		q.Add("2")
+		assert.Nil(t, q.Add("3"))
+		assert.Equal(t, []interface{}{"1"}, dropped)
+		_, l := q.Get(nil)
+		assert.Equal(t, []interface{}{"2", "3"}, l)
+	}
+
+	//丢弃新加入的
+	{
+		var dropped []interface{}
+		q := NewSendQueue(2)
+		q.SetOption(SendQueueOption{Policy: OverflowDropNewest, OnDrop: func(o interface{}) {
+			dropped = append(dropped, o)
+		}})
+		q.Add("1")
+		q.Add("2")
+		assert.Nil(t, q.AddWithTimeout("3", time.Second))
+		assert.Equal(t, []interface{}{"3"}, dropped)
+		_, l := q.Get(nil)
+		assert.Equal(t, []interface{}{"1", "2"}, l)
+	}
+
+	//按优先级丢弃
+	{
+		var dropped []interface{}
+		q := NewSendQueue(3)
+		q.SetOption(SendQueueOption{Policy: OverflowDropPriority, OnDrop: func(o interface{}) {
+			dropped = append(dropped, o.(*prioMsg).s)
+		}})
+		q.Add(&prioMsg{s: "a", p: 1})
+		q.Add(&prioMsg{s: "b", p: 0})
+		q.Add(&prioMsg{s: "c", p: 2})
+		q.Add(&prioMsg{s: "d", p: 1})
+		assert.Equal(t, []interface{}{"b"}, dropped)
+		q.Add(&prioMsg{s: "e", p: 0})
+		assert.Equal(t, []interface{}{"b", "e"}, dropped)
+		_, l := q.Get(nil)
+		assert.Equal(t, 3, len(l))
+		assert.Equal(t, "c", l[0].(*prioMsg).s)
+		assert.Equal(t, "a", l[1].(*prioMsg).s)
+		assert.Equal(t, "d", l[2].(*prioMsg).s)
+	}
+
+	//水位回调
+	{
+		high, low := 0, 0
+		q := NewSendQueue()
+		q.SetOption(SendQueueOption{
+			HighWatermark:   10,
+			LowWatermark:    2,
+			OnHighWatermark: func() { high++ },
+			OnLowWatermark:  func() { low++ },
+		})
+		q.Add(strings.Repeat("a", 6))
+		assert.Equal(t, 0, high)
+		q.Add(strings.Repeat("a", 6))
+		q.Add(strings.Repeat("a", 6))
+		assert.Equal(t, 1, high)
+		assert.Equal(t, 0, low)
+		q.Get(nil)
+		//写入完成之后才降到低水位
+		assert.Equal(t, 0, low)
+		q.Written()
+		assert.Equal(t, 1, low)
+		q.Add(strings.Repeat("a", 10))
+		assert.Equal(t, 2, high)
+	}
+
+	//只有[]byte,string及实现了Size()的消息计入字节数,其它消息需要提供Sizer
+	{
+		high := 0
+		q := NewSendQueue()
+		q.SetOption(SendQueueOption{
+			HighWatermark:   10,
+			OnHighWatermark: func() { high++ },
+		})
+		q.Add([]rune(strings.Repeat("a", 20)))
+		assert.Equal(t, 0, q.Bytes())
+		assert.Equal(t, 0, high)
+
+		q = NewSendQueue()
+		q.SetOption(SendQueueOption{
+			HighWatermark:   10,
+			OnHighWatermark: func() { high++ },
+			Sizer: func(o interface{}) int {
+				return len(o.([]rune))
+			},
+		})
+		q.Add([]rune(strings.Repeat("a", 20)))
+		assert.Equal(t, 20, q.Bytes())
+		assert.Equal(t, 1, high)
+	}
+
+	//溢出时关闭会话
+	{
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8140")
+		listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			//不读取数据
+			time.Sleep(time.Second)
+			conn.Close()
+		}()
+
+		conn, _ := net.Dial("tcp", "localhost:8140")
+		session := NewStreamSocket(conn)
+		closed := make(chan error, 1)
+		session.SetCloseCallBack(func(s kendynet.StreamSession, reason error) {
+			closed <- reason
+		})
+		assert.Nil(t, session.(*StreamSocket).SetSendQueueOption(SendQueueOption{Policy: OverflowClose, MaxBytes: 1024 * 1024}))
+
+		var err error
+		for i := 0; i < 10000 && nil == err; i++ {
+			err = session.Send(make([]byte, 64*1024))
+		}
+
+		assert.Equal(t, kendynet.ErrSlowConsumer, err)
+		assert.Equal(t, kendynet.ErrSlowConsumer, <-closed)
+		listener.Close()
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	q := NewSendQueue()
+	q.Add("1")
+	q.Add("2")
+	q.AddWithPriority("3", 2)
+	q.AddWithPriority("4", 100) //截断为SendPriorityCount-1
+	q.Add(&prioMsg{s: "5", p: 2})
+	q.AddWithPriority("6", -1)
+	assert.Equal(t, 6, q.Len())
+
+	_, l := q.Get(nil)
+	assert.Equal(t, 6, len(l))
+	assert.Equal(t, "4", l[0])
+	assert.Equal(t, "3", l[1])
+	assert.Equal(t, "5", l[2].(*prioMsg).s)
+	assert.Equal(t, []interface{}{"1", "2", "6"}, l[3:])
+	assert.True(t, q.Empty())
+
+	//丢弃最早的消息不区分优先级
+	q = NewSendQueue(2)
+	q.SetOption(SendQueueOption{Policy: OverflowDropOldest})
+	q.AddWithPriority("a", 3)
+	q.Add("b")
+	q.Add("c")
+	_, l = q.Get(l)
+	assert.Equal(t, []interface{}{"b", "c"}, l)
+
+	//会话按优先级发送
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8141")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		session := NewStreamSocket(conn)
+		//发送线程启动前加入队列的消息在同一批次中按优先级排列
+		session.(*StreamSocket).sendQue.Add([]byte("b"))
+		session.(*StreamSocket).sendQue.AddWithPriority([]byte("a"), 1)
+		session.(*StreamSocket).sendQue.AddWithPriority([]byte("d"), 3)
+		session.(PrioritySender).SendWithPriority([]byte("c"), 0)
+		session.Close(nil, time.Second)
+	}()
+
+	conn, _ := net.Dial("tcp", "localhost:8141")
+	b, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, "dabc", string(b))
+	conn.Close()
+	listener.Close()
+}
+
+//长度头+不拷贝的消息体
+type buffersEncoder struct {
+	encoder
+}
+
+func (this *buffersEncoder) EnCodeBuffers(o interface{}, bufs net.Buffers) (net.Buffers, error) {
+	switch o.(type) {
+	case string:
+		s := o.(string)
+		return append(bufs, []byte{byte(len(s))}, []byte(s)), nil
+	default:
+		return bufs, errors.New("invaild o")
+	}
+}
+
+func TestWritev(t *testing.T) {
+	{
+		b := buffer.New()
+		builder := &BuffersBuilder{}
+		builder.Reset(b)
+		big := make([]byte, BorrowThreshold)
+		builder.Add([]byte("a"), &encoder{})
+		builder.Add("b", &encoder{})
+		builder.Add(big, &encoder{})
+		assert.NotNil(t, builder.Add(1, &encoder{}))
+		builder.Add([]byte("c"), &encoder{})
+		bufs := builder.Buffers()
+		assert.Equal(t, 3, len(bufs))
+		assert.Equal(t, "ab", string(bufs[0]))
+		//大的[]byte直接引用
+		assert.True(t, &big[0] == &bufs[1][0])
+		assert.Equal(t, "c", string(bufs[2]))
+	}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8142")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	big := []byte(strings.Repeat("x", BorrowThreshold*4))
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		session := NewStreamSocket(conn)
+		session.SetEncoder(&buffersEncoder{})
+		session.Send([]byte("head"))
+		session.Send(big)
+		session.Send("hello")
+		session.Send(1) //编码错误
+		session.Send([]byte("tail"))
+		session.Close(nil, time.Second)
+	}()
+
+	conn, _ := net.Dial("tcp", "localhost:8142")
+	b, _ := ioutil.ReadAll(conn)
+	assert.Equal(t, "head"+string(big)+"\x05hello"+"tail", string(b))
+	conn.Close()
+	listener.Close()
+}
+
+func TestSendCallback(t *testing.T) {
+	//被溢出策略丢弃
+	{
+		q := NewSendQueue(1)
+		q.SetOption(SendQueueOption{Policy: OverflowDropNewest})
+		var results []error
+		q.AddWithCallback("a", 0, func(err error) { results = append(results, err) })
+		q.AddWithCallback("b", 0, func(err error) { results = append(results, err) })
+		assert.Equal(t, []error{kendynet.ErrSendDropped}, results)
+		_, l, cbs := q.GetWithCallbacks(nil, nil)
+		assert.Equal(t, 1, len(l))
+		assert.Equal(t, 1, len(cbs))
+
+		q.Add("c")
+		_, _, cbs = q.GetWithCallbacks(nil, cbs)
+		assert.Equal(t, 0, len(cbs))
+	}
+
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:8143")
+	listener, _ := net.ListenTCP("tcp", tcpAddr)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	//写入完成及编码错误
+	{
+		conn, _ := net.Dial("tcp", "localhost:8143")
+		peer := <-accepted
+		session := NewStreamSocket(conn)
+		session.SetEncoder(&encoder{})
+
+		results := make(chan error, 2)
+		cb := func(err error) {
+			results <- err
+		}
+
+		assert.Nil(t, session.(CallbackSender).SendWithCallback("hello", cb))
+		assert.Nil(t, session.(CallbackSender).SendWithCallback(1, cb))
+
+		got := []error{<-results, <-results}
+		assert.Contains(t, got, nil)
+		assert.Contains(t, got, errors.New("invaild o"))
+
+		b := make([]byte, 5)
+		io.ReadFull(peer, b)
+		assert.Equal(t, "hello", string(b))
+
+		session.Close(nil, 0)
+		//关闭之后不再加入队列,不调用回调
+		assert.Equal(t, kendynet.ErrSocketClose, session.(CallbackSender).SendWithCallback("hello", cb))
+		peer.Close()
+	}
+
+	//关闭时尚未发送
+	{
+		conn, _ := net.Dial("tcp", "localhost:8143")
+		peer := <-accepted //不读取
+		session := NewStreamSocket(conn)
+
+		var mu sync.Mutex
+		var results []error
+		var wg sync.WaitGroup
+
+		//发送队列满时返回错误,不调用回调
+		for i := 0; i < 1000; i++ {
+			wg.Add(1)
+			if nil != session.(CallbackSender).SendWithCallback(make([]byte, 64*1024), func(err error) {
+				mu.Lock()
+				results = append(results, err)
+				mu.Unlock()
+				wg.Done()
+			}) {
+				wg.Done()
+			}
+		}
+
+		time.Sleep(time.Millisecond * 100)
+		session.Close(nil, 0)
+		wg.Wait()
+
+		mu.Lock()
+		assert.Contains(t, results, kendynet.ErrSocketClose)
+		mu.Unlock()
+		peer.Close()
+	}
+
+	listener.Close()
+
+	//WebSocket
+	{
+		upgrader := &gorilla.Upgrader{}
+		recvC := make(chan []byte, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if nil != err {
+				return
+			}
+			for {
+				_, data, err := conn.ReadMessage()
+				if nil != err {
+					conn.Close()
+					return
+				}
+				recvC <- data
+			}
+		}))
+
+		conn, _, err := gorilla.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		assert.Nil(t, err)
+		session := NewWSSocket(conn)
+
+		results := make(chan error, 1)
+		assert.Nil(t, session.(CallbackSender).SendWithCallback([]byte("hello"), func(err error) {
+			results <- err
+		}))
+		assert.Nil(t, <-results)
+		assert.Equal(t, "hello", string(<-recvC))
+
+		assert.Nil(t, session.(PrioritySender).SendWithPriority([]byte("world"), SendPriorityCount-1))
+		assert.Equal(t, "world", string(<-recvC))
+
+		session.Close(nil, 0)
+		server.Close()
+	}
+}
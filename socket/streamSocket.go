@@ -1,13 +1,16 @@
 /*
-*  tcp或unix域套接字会话
+*  tcp,unix域套接字,tls或可靠udp(rudp)会话
  */
 
 package socket
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/buffer"
+	"github.com/sniperHW/kendynet/socket/rudp"
 	"net"
 	"runtime"
 	"time"
@@ -78,8 +81,11 @@ func (this *StreamSocket) DirectSend(bytes []byte, timeout ...time.Duration) (in
 			n, err = this.conn.Write(bytes)
 		}
 
+		this.metrics.Add(MetricBytesOut, int64(n))
+
 		if kendynet.IsNetTimeout(err) {
 			err = kendynet.ErrSendTimeout
+			this.metrics.Add(MetricSendTimeouts, 1)
 		}
 
 		return n, err
@@ -126,6 +132,10 @@ func (this *StreamSocket) recvThreadFunc() {
 					n, err = this.conn.Read(buff)
 				}
 
+				if n > 0 {
+					this.metrics.Add(MetricBytesIn, int64(n))
+				}
+
 				if nil == err {
 					this.inboundProcessor.OnData(buff[:n])
 				} else {
@@ -138,6 +148,7 @@ func (this *StreamSocket) recvThreadFunc() {
 			if nil != err {
 				if kendynet.IsNetTimeout(err) {
 					err = kendynet.ErrRecvTimeout
+					this.metrics.Add(MetricRecvTimeouts, 1)
 				}
 				if nil != this.errorCallback {
 					if isUnpackError {
@@ -151,6 +162,7 @@ func (this *StreamSocket) recvThreadFunc() {
 					this.Close(err, 0)
 				}
 			} else if p != nil {
+				this.metrics.Add(MetricMessagesIn, 1)
 				this.inboundCallBack(this, p)
 			}
 		} else {
@@ -169,47 +181,56 @@ func (this *StreamSocket) sendThreadFunc() {
 
 	localList := make([]interface{}, 0, 32)
 
+	var cbs []func(error)
+
+	pending := make([]func(error), 0, 32) //已经编码,等待写入完成的回调
+
 	closed := false
 
-	var n int
+	var n int64
+
+	var builder BuffersBuilder
 
 	oldTimeout := this.getSendTimeout()
 	timeout := oldTimeout
 
 	for {
 
-		closed, localList = this.sendQue.Get(localList)
+		closed, localList, cbs = this.sendQue.GetWithCallbacks(localList, cbs)
 		size := len(localList)
 		if closed && size == 0 {
-			this.conn.(interface{ CloseWrite() error }).CloseWrite()
+			closeWrite(this.conn)
 			break
 		}
 
 		b := buffer.Get()
-		for i := 0; i < size; {
-			if b.Len() == 0 {
-				for i < size {
-					l := b.Len()
-
-					switch localList[i].(type) {
-					case []byte:
-						b.AppendBytes(localList[i].([]byte))
-					default:
-						err = this.encoder.EnCode(localList[i], b)
-					}
-					localList[i] = nil
-					i++
-					if nil != err {
-						//EnCode错误，这个包已经写入到b中的内容需要直接丢弃
-						b.SetLen(l)
-						kendynet.GetLogger().Errorf("encode error:%v", err)
-					}
-				}
+		builder.Reset(b)
+
+		for i := 0; i < size; i++ {
+			var cb func(error)
+			if len(cbs) > 0 {
+				cb, cbs[i] = cbs[i], nil
 			}
 
-			if b.Len() == 0 {
-				break
+			if err = builder.Add(localList[i], this.encoder); nil != err {
+				//EnCode错误，这个包已经写入的内容已经被丢弃
+				kendynet.GetLogger().Errorf("encode error:%v", err)
+				this.metrics.Add(MetricEncodeErrors, 1)
+				if nil != cb {
+					cb(err)
+				}
+			} else {
+				this.metrics.Add(MetricMessagesOut, 1)
+				if nil != cb {
+					pending = append(pending, cb)
+				}
 			}
+			localList[i] = nil
+		}
+
+		bufs := builder.Buffers()
+
+		for len(bufs) > 0 {
 
 			oldTimeout = timeout
 			timeout = this.getSendTimeout()
@@ -220,16 +241,25 @@ func (this *StreamSocket) sendThreadFunc() {
 
 			if timeout > 0 {
 				this.conn.SetWriteDeadline(time.Now().Add(timeout))
-				n, err = this.conn.Write(b.Bytes())
-			} else {
-				n, err = this.conn.Write(b.Bytes())
+			}
+
+			//WriteTo会从bufs中移除已经写入的部分
+			n, err = bufs.WriteTo(this.conn)
+
+			if n > 0 {
+				this.metrics.Add(MetricBytesOut, n)
 			}
 
 			if nil == err {
-				b.Reset()
+				break
 			} else if !this.flag.AtomicTest(fclosed) {
 				if kendynet.IsNetTimeout(err) {
 					err = kendynet.ErrSendTimeout
+					this.metrics.Add(MetricSendTimeouts, 1)
+					if _, ok := this.conn.(*tls.Conn); ok {
+						//tls写超时后连接状态已经损坏,不能继续发送,直接关闭
+						this.Close(err, 0)
+					}
 				} else {
 					this.Close(err, 0)
 				}
@@ -240,21 +270,34 @@ func (this *StreamSocket) sendThreadFunc() {
 
 				if this.flag.AtomicTest(fclosed) {
 					break
-				} else {
-					//超时可能完成部分发送，将已经发送部分丢弃
-					b.DropFirstNBytes(n)
 				}
+				//超时可能完成部分发送,继续发送剩余的部分(tls连接除外)
 			} else {
 				break
 			}
 		}
+
+		this.sendQue.Written()
+
+		if len(pending) > 0 {
+			if len(bufs) == 0 {
+				notifySendResult(pending, nil)
+			} else if err == kendynet.ErrSendTimeout {
+				notifySendResult(pending, err)
+			} else {
+				notifySendResult(pending, kendynet.ErrSocketClose)
+			}
+			pending = pending[:0]
+		}
+
+		builder.Reset(b)
 		b.Free()
 	}
 }
 
 func NewStreamSocket(conn net.Conn) kendynet.StreamSession {
 	switch conn.(type) {
-	case *net.TCPConn, *net.UnixConn:
+	case *net.TCPConn, *net.UnixConn, *tls.Conn, *rudp.Conn:
 		break
 	default:
 		return nil
@@ -267,6 +310,7 @@ func NewStreamSocket(conn net.Conn) kendynet.StreamSession {
 		sendQue:       NewSendQueue(128),
 		sendCloseChan: make(chan struct{}),
 		imp:           s,
+		metrics:       &SessionMetrics{},
 	}
 
 	runtime.SetFinalizer(s, func(s *StreamSocket) {
@@ -284,6 +328,28 @@ func (this *StreamSocket) GetUnderConn() interface{} {
 	return this.conn
 }
 
+/*
+ *  返回tls连接的状态,非tls连接返回false
+ */
+func (this *StreamSocket) ConnectionState() (tls.ConnectionState, bool) {
+	if c, ok := this.conn.(*tls.Conn); ok {
+		return c.ConnectionState(), true
+	} else {
+		return tls.ConnectionState{}, false
+	}
+}
+
+/*
+ *  返回对端证书链,第一个为对端证书。非tls连接或对端未提供证书时返回nil
+ */
+func (this *StreamSocket) PeerCertificates() []*x509.Certificate {
+	if state, ok := this.ConnectionState(); ok {
+		return state.PeerCertificates
+	} else {
+		return nil
+	}
+}
+
 func (this *StreamSocket) defaultInBoundProcessor() kendynet.InBoundProcessor {
 	return &defaultSSInBoundProcessor{buffer: make([]byte, 4096)}
 }
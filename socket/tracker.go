@@ -0,0 +1,110 @@
+package socket
+
+import (
+	"context"
+	"github.com/sniperHW/kendynet"
+	"sync"
+	"time"
+)
+
+//ctx没有设置deadline时,Shutdown给会话清空发送队列的时间
+const DefaultDrainDelay = 5 * time.Second
+
+/*
+ *  跟踪监听器接受的会话,用于监听器的Shutdown。零值可以直接使用
+ */
+type SessionTracker struct {
+	mu        sync.Mutex
+	sessions  map[kendynet.StreamSession]struct{}
+	shutdown  bool
+	drainC    chan struct{}
+	drainOnce sync.Once
+}
+
+func (this *SessionTracker) init() {
+	if nil == this.sessions {
+		this.sessions = map[kendynet.StreamSession]struct{}{}
+		this.drainC = make(chan struct{})
+	}
+}
+
+func (this *SessionTracker) drain() {
+	this.drainOnce.Do(func() {
+		close(this.drainC)
+	})
+}
+
+/*
+ *  跟踪session直到其关闭回调返回。已经调用Shutdown时以kendynet.ErrServerShutdown关闭session并返回false
+ */
+func (this *SessionTracker) Add(session kendynet.StreamSession) bool {
+	n, ok := session.(CloseNotifier)
+	if !ok {
+		return true
+	}
+
+	this.mu.Lock()
+	this.init()
+	if this.shutdown {
+		this.mu.Unlock()
+		session.Close(kendynet.ErrServerShutdown, 0)
+		return false
+	}
+	this.sessions[session] = struct{}{}
+	this.mu.Unlock()
+
+	n.NotifyClose(func(s kendynet.StreamSession, _ error) {
+		this.mu.Lock()
+		delete(this.sessions, s)
+		if this.shutdown && len(this.sessions) == 0 {
+			this.drain()
+		}
+		this.mu.Unlock()
+	})
+
+	return true
+}
+
+func (this *SessionTracker) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	return len(this.sessions)
+}
+
+/*
+ *  以kendynet.ErrServerShutdown关闭所有会话,发送队列中的数据在ctx的deadline之前尽量发送
+ *  (没有deadline时为DefaultDrainDelay),等待所有会话的关闭回调返回或ctx结束
+ */
+func (this *SessionTracker) Shutdown(ctx context.Context) error {
+	this.mu.Lock()
+	this.init()
+	this.shutdown = true
+	sessions := make([]kendynet.StreamSession, 0, len(this.sessions))
+	for s, _ := range this.sessions {
+		sessions = append(sessions, s)
+	}
+	if len(this.sessions) == 0 {
+		this.drain()
+	}
+	this.mu.Unlock()
+
+	delay := DefaultDrainDelay
+	if deadline, ok := ctx.Deadline(); ok {
+		delay = time.Until(deadline)
+	}
+
+	for _, s := range sessions {
+		if delay > 0 {
+			s.Close(kendynet.ErrServerShutdown, delay)
+		} else {
+			s.Close(kendynet.ErrServerShutdown, 0)
+		}
+	}
+
+	select {
+	case <-this.drainC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
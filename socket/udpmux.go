@@ -0,0 +1,220 @@
+package socket
+
+import (
+	"github.com/sniperHW/kendynet"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultPeerRecvQueueSize = 256
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+/*
+ *  UDPMux中对端地址对应的虚拟连接,实现net.Conn供DatagramSocket使用
+ */
+type udpPeerConn struct {
+	mux          *UDPMux
+	addr         *net.UDPAddr
+	key          string
+	recvC        chan []byte
+	closeC       chan struct{}
+	closeOnce    sync.Once
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (this *udpPeerConn) Read(b []byte) (int, error) {
+	this.mu.Lock()
+	deadline := this.readDeadline
+	this.mu.Unlock()
+
+	var timeoutC <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, timeoutError{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	select {
+	case data := <-this.recvC:
+		return copy(b, data), nil
+	case <-this.closeC:
+		return 0, io.EOF
+	case <-timeoutC:
+		return 0, timeoutError{}
+	}
+}
+
+func (this *udpPeerConn) Write(b []byte) (int, error) {
+	select {
+	case <-this.closeC:
+		return 0, kendynet.ErrSocketClose
+	default:
+		return this.mux.conn.WriteToUDP(b, this.addr)
+	}
+}
+
+func (this *udpPeerConn) Close() error {
+	this.closeOnce.Do(func() {
+		close(this.closeC)
+		this.mux.removePeer(this)
+	})
+	return nil
+}
+
+func (this *udpPeerConn) LocalAddr() net.Addr {
+	return this.mux.conn.LocalAddr()
+}
+
+func (this *udpPeerConn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func (this *udpPeerConn) SetDeadline(t time.Time) error {
+	return this.SetReadDeadline(t)
+}
+
+func (this *udpPeerConn) SetReadDeadline(t time.Time) error {
+	this.mu.Lock()
+	this.readDeadline = t
+	this.mu.Unlock()
+	return nil
+}
+
+//共享的UDPConn上写操作不会长时间阻塞,忽略写超时
+func (this *udpPeerConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+/*
+ *  将一个net.UDPConn上收到的数据报按对端地址分离成独立的DatagramSocket。
+ *
+ *  收到未知地址的数据报时创建新会话并回调onNewClient,会话关闭后该地址再次发来数据报将创建新的会话。
+ *  UDP没有连接状态,需要通过SetRecvTimeout设置空闲超时来回收不再活动的会话。
+ *
+ *  每个会话的接收队列最多缓存recvQueueSize个数据报,队列满时丢弃新到达的数据报。
+ */
+type UDPMux struct {
+	conn          *net.UDPConn
+	mu            sync.Mutex
+	peers         map[string]*udpPeerConn
+	recvQueueSize int
+	started       int32
+	closed        int32
+}
+
+func NewUDPMux(conn *net.UDPConn, recvQueueSize ...int) *UDPMux {
+	m := &UDPMux{
+		conn:          conn,
+		peers:         map[string]*udpPeerConn{},
+		recvQueueSize: defaultPeerRecvQueueSize,
+	}
+
+	if len(recvQueueSize) > 0 && recvQueueSize[0] > 0 {
+		m.recvQueueSize = recvQueueSize[0]
+	}
+
+	return m
+}
+
+func (this *UDPMux) LocalAddr() net.Addr {
+	return this.conn.LocalAddr()
+}
+
+/*
+ *  关闭UDPConn及所有会话的虚拟连接
+ */
+func (this *UDPMux) Close() {
+	if atomic.CompareAndSwapInt32(&this.closed, 0, 1) {
+		this.conn.Close()
+		this.mu.Lock()
+		peers := this.peers
+		this.peers = map[string]*udpPeerConn{}
+		this.mu.Unlock()
+		for _, v := range peers {
+			v.Close()
+		}
+	}
+}
+
+func (this *UDPMux) removePeer(peer *udpPeerConn) {
+	this.mu.Lock()
+	if this.peers[peer.key] == peer {
+		delete(this.peers, peer.key)
+	}
+	this.mu.Unlock()
+}
+
+func (this *UDPMux) Serve(onNewClient func(kendynet.StreamSession)) error {
+
+	if nil == onNewClient {
+		return kendynet.ErrInvaildNewClientCB
+	}
+
+	if !atomic.CompareAndSwapInt32(&this.started, 0, 1) {
+		return kendynet.ErrServerStarted
+	}
+
+	buff := make([]byte, MaxDatagramSize)
+
+	for {
+		n, addr, err := this.conn.ReadFromUDP(buff)
+		if err != nil {
+			if atomic.LoadInt32(&this.closed) == 1 {
+				return nil
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				kendynet.GetLogger().Errorf("udp read temp err: %v", ne)
+				continue
+			} else {
+				return err
+			}
+		}
+
+		key := addr.String()
+
+		this.mu.Lock()
+		if atomic.LoadInt32(&this.closed) == 1 {
+			this.mu.Unlock()
+			return nil
+		}
+		peer, ok := this.peers[key]
+		if !ok {
+			peer = &udpPeerConn{
+				mux:    this,
+				addr:   addr,
+				key:    key,
+				recvC:  make(chan []byte, this.recvQueueSize),
+				closeC: make(chan struct{}),
+			}
+			this.peers[key] = peer
+		}
+		this.mu.Unlock()
+
+		data := make([]byte, n)
+		copy(data, buff[:n])
+
+		select {
+		case peer.recvC <- data:
+		default:
+			//接收队列满,丢弃
+		}
+
+		if !ok {
+			onNewClient(NewDatagramSocket(peer))
+		}
+	}
+}
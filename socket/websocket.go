@@ -11,7 +11,9 @@ import (
 	"github.com/sniperHW/kendynet"
 	"github.com/sniperHW/kendynet/buffer"
 	"github.com/sniperHW/kendynet/message"
+	"io"
 	"net"
+	"net/http"
 	"runtime"
 	"time"
 )
@@ -50,21 +52,114 @@ func (this *defaultWSInBoundProcessor) Unpack() (interface{}, error) {
 	}
 }
 
+/*
+ *  以流的方式接收消息,消息(可能由多个分片组成)不需要完整读入内存
+ */
+type WebsocketStreamInBoundProcessor interface {
+	kendynet.InBoundProcessor
+	OnReader(int, io.Reader)
+}
+
+type defaultWSStreamInBoundProcessor struct {
+	msg *message.WSStreamMessage
+}
+
+func (this *defaultWSStreamInBoundProcessor) OnReader(messageType int, r io.Reader) {
+	this.msg = message.NewWSStreamMessage(messageType, r)
+}
+
+func (this *defaultWSStreamInBoundProcessor) Unpack() (interface{}, error) {
+	if nil != this.msg {
+		msg := this.msg
+		this.msg = nil
+		return msg, nil
+	} else {
+		return nil, nil
+	}
+}
+
+//统计流模式下读取的字节数
+type countReader struct {
+	r       io.Reader
+	metrics *SessionMetrics
+}
+
+func (this *countReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	if n > 0 {
+		this.metrics.Add(MetricBytesIn, int64(n))
+	}
+	return n, err
+}
+
+/*
+ *  每个消息以*message.WSStreamMessage交给消息回调。
+ *  Reader只在消息回调中有效,回调返回后未读取的部分被丢弃
+ */
+func NewWSStreamInBoundProcessor() WebsocketStreamInBoundProcessor {
+	return &defaultWSStreamInBoundProcessor{}
+}
+
+var ErrInvaildCompressionLevel = fmt.Errorf("invaild compression level")
+
+type WSCompressionOption struct {
+	Level     int //压缩级别,-2(flate.HuffmanOnly)到9(flate.BestCompression),0使用flate.BestSpeed
+	Threshold int //小于Threshold字节的消息不压缩
+}
+
+func (this WSCompressionOption) Check() error {
+	if this.Level < -2 || this.Level > 9 {
+		return ErrInvaildCompressionLevel
+	}
+	return nil
+}
+
 type WebSocket struct {
 	SocketBase
-	inboundProcessor WebsocketInBoundProcessor
-	conn             *gorilla.Conn
+	inboundProcessor  kendynet.InBoundProcessor
+	conn              *gorilla.Conn
+	request           *http.Request
+	compressThreshold int
 }
 
 func (this *WebSocket) getInBoundProcessor() kendynet.InBoundProcessor {
 	return this.inboundProcessor
 }
 
+/*
+ *  in必须实现WebsocketInBoundProcessor或WebsocketStreamInBoundProcessor
+ */
 func (this *WebSocket) SetInBoundProcessor(in kendynet.InBoundProcessor) kendynet.StreamSession {
-	this.inboundProcessor = in.(WebsocketInBoundProcessor)
+	switch in.(type) {
+	case WebsocketInBoundProcessor, WebsocketStreamInBoundProcessor:
+		this.inboundProcessor = in
+	default:
+		panic("invaild websocket inbound processor")
+	}
 	return this
 }
 
+/*
+ *  设置发送消息的压缩级别及阈值,只有握手时协商了permessage-deflate才生效,必须在Send之前调用
+ */
+func (this *WebSocket) SetCompression(option WSCompressionOption) error {
+	if err := option.Check(); nil != err {
+		return err
+	}
+
+	level := option.Level
+	if 0 == level {
+		level = 1
+	}
+
+	if err := this.conn.SetCompressionLevel(level); nil != err {
+		return err
+	}
+
+	this.compressThreshold = option.Threshold
+	return nil
+}
+
 func (this *WebSocket) DirectSend(bytes []byte, timeout ...time.Duration) (int, error) {
 	if this.flag.AtomicTest(fclosed | frclosed) {
 		return 0, kendynet.ErrSocketClose
@@ -87,8 +182,10 @@ func (this *WebSocket) DirectSend(bytes []byte, timeout ...time.Duration) (int,
 
 		if nil == err {
 			n = len(bytes)
+			this.metrics.Add(MetricBytesOut, int64(n))
 		} else if kendynet.IsNetTimeout(err) {
 			err = kendynet.ErrSendTimeout
+			this.metrics.Add(MetricSendTimeouts, 1)
 		}
 
 		return n, err
@@ -130,14 +227,22 @@ func (this *WebSocket) recvThreadFunc() {
 
 				if timeout > 0 {
 					this.conn.SetReadDeadline(time.Now().Add(timeout))
-					messageType, data, err = this.conn.ReadMessage()
-				} else {
-					messageType, data, err = this.conn.ReadMessage()
 				}
 
-				if nil == err {
-					this.inboundProcessor.OnData(messageType, data)
-				} else {
+				switch this.inboundProcessor.(type) {
+				case WebsocketStreamInBoundProcessor:
+					var r io.Reader
+					if messageType, r, err = this.conn.NextReader(); nil == err {
+						this.inboundProcessor.(WebsocketStreamInBoundProcessor).OnReader(messageType, &countReader{r: r, metrics: this.metrics})
+					}
+				default:
+					if messageType, data, err = this.conn.ReadMessage(); nil == err {
+						this.metrics.Add(MetricBytesIn, int64(len(data)))
+						this.inboundProcessor.(WebsocketInBoundProcessor).OnData(messageType, data)
+					}
+				}
+
+				if nil != err {
 					break
 				}
 			}
@@ -147,6 +252,7 @@ func (this *WebSocket) recvThreadFunc() {
 			if nil != err {
 				if kendynet.IsNetTimeout(err) {
 					err = kendynet.ErrRecvTimeout
+					this.metrics.Add(MetricRecvTimeouts, 1)
 				}
 
 				if nil != this.errorCallback {
@@ -163,6 +269,7 @@ func (this *WebSocket) recvThreadFunc() {
 				}
 
 			} else if p != nil {
+				this.metrics.Add(MetricMessagesIn, 1)
 				this.inboundCallBack(this, p)
 			}
 		} else {
@@ -180,6 +287,8 @@ func (this *WebSocket) sendThreadFunc() {
 
 	localList := make([]interface{}, 0, 32)
 
+	var cbs []func(error)
+
 	closed := false
 
 	oldTimeout := this.getSendTimeout()
@@ -187,10 +296,10 @@ func (this *WebSocket) sendThreadFunc() {
 
 	for {
 
-		closed, localList = this.sendQue.Get(localList)
+		closed, localList, cbs = this.sendQue.GetWithCallbacks(localList, cbs)
 		size := len(localList)
 		if closed && size == 0 {
-			this.conn.UnderlyingConn().(interface{ CloseWrite() error }).CloseWrite()
+			closeWrite(this.conn.UnderlyingConn())
 			break
 		}
 
@@ -200,6 +309,11 @@ func (this *WebSocket) sendThreadFunc() {
 
 			var msgType int
 
+			var cb func(error)
+			if len(cbs) > 0 {
+				cb, cbs[i] = cbs[i], nil
+			}
+
 			switch localList[i].(type) {
 			case []byte:
 				b.AppendBytes(localList[i].([]byte))
@@ -211,6 +325,11 @@ func (this *WebSocket) sendThreadFunc() {
 					b = buffer.Get()
 					if err = this.encoder.EnCode(msg.Data(), b); nil != err {
 						kendynet.GetLogger().Errorf("encode error:%v", err)
+						this.metrics.Add(MetricEncodeErrors, 1)
+						if nil != cb {
+							cb(err)
+						}
+						localList[i] = nil
 						b.Reset()
 						continue
 					}
@@ -228,6 +347,10 @@ func (this *WebSocket) sendThreadFunc() {
 				this.conn.SetWriteDeadline(time.Time{})
 			}
 
+			if this.compressThreshold > 0 {
+				this.conn.EnableWriteCompression(b.Len() >= this.compressThreshold)
+			}
+
 			if timeout > 0 {
 				this.conn.SetWriteDeadline(time.Now().Add(timeout))
 				err = this.conn.WriteMessage(msgType, b.Bytes())
@@ -236,12 +359,28 @@ func (this *WebSocket) sendThreadFunc() {
 				err = this.conn.WriteMessage(msgType, b.Bytes())
 			}
 
+			if nil == err {
+				this.metrics.Add(MetricMessagesOut, 1)
+				this.metrics.Add(MetricBytesOut, int64(b.Len()))
+			}
+
+			if nil != cb {
+				if nil == err {
+					cb(nil)
+				} else if kendynet.IsNetTimeout(err) {
+					cb(kendynet.ErrSendTimeout)
+				} else {
+					cb(kendynet.ErrSocketClose)
+				}
+			}
+
 			b.Reset()
 
 			if err != nil && !this.flag.AtomicTest(fclosed) {
 
 				if kendynet.IsNetTimeout(err) {
 					err = kendynet.ErrSendTimeout
+					this.metrics.Add(MetricSendTimeouts, 1)
 				} else {
 					this.Close(err, 0)
 				}
@@ -251,14 +390,22 @@ func (this *WebSocket) sendThreadFunc() {
 				}
 
 				if this.flag.AtomicTest(fclosed) {
+					if len(cbs) > 0 {
+						notifySendResult(cbs[i+1:], kendynet.ErrSocketClose)
+					}
 					return
 				}
 			}
 		}
+
+		this.sendQue.Written()
 	}
 }
 
-func NewWSSocket(conn *gorilla.Conn) kendynet.StreamSession {
+/*
+ *  request为服务端升级时的请求,可通过Request()获取
+ */
+func NewWSSocket(conn *gorilla.Conn, request ...*http.Request) kendynet.StreamSession {
 	if nil == conn {
 		return nil
 	} else {
@@ -271,10 +418,15 @@ func NewWSSocket(conn *gorilla.Conn) kendynet.StreamSession {
 		s := &WebSocket{
 			conn: conn,
 		}
+
+		if len(request) > 0 {
+			s.request = request[0]
+		}
 		s.SocketBase = SocketBase{
 			sendQue:       NewSendQueue(128),
 			sendCloseChan: make(chan struct{}),
 			imp:           s,
+			metrics:       &SessionMetrics{},
 		}
 
 		runtime.SetFinalizer(s, func(s *WebSocket) {
@@ -293,6 +445,20 @@ func (this *WebSocket) SetPongHandler(h func(appData string) error) {
 	this.conn.SetPongHandler(h)
 }
 
+/*
+ *  服务端会话返回升级请求(可获取header,cookie,query等),客户端会话返回nil
+ */
+func (this *WebSocket) Request() *http.Request {
+	return this.request
+}
+
+/*
+ *  协商得到的子协议,没有协商时返回空串
+ */
+func (this *WebSocket) Subprotocol() string {
+	return this.conn.Subprotocol()
+}
+
 func (this *WebSocket) GetUnderConn() interface{} {
 	return this.conn
 }